@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v3"
+	"github.com/mailgun/mailgun-go/v3/events"
+)
+
+// webhookMaxAge is how old the signature of a webhook call can be, so recorded calls cannot be replayed later.
+const webhookMaxAge = 15 * time.Minute
+
+// adminAlerts mails the admins about problems that need someone to look at them.
+type adminAlerts struct {
+	tenant *tenant
+	to     []string
+}
+
+func (al *adminAlerts) send(ctx context.Context, subject, text string) {
+	if al == nil {
+		log.Printf("no admins to tell: %s", subject)
+		return
+	}
+	for _, to := range al.to {
+		if _, err := al.tenant.mailer.Send(ctx, al.tenant.message(to, subject, text+"\n"+al.tenant.signatureBlock())); err != nil {
+			log.Printf("unable to alert admin %s: %v", to, err)
+		}
+	}
+}
+
+// readWebhookKey reads the key Mailgun signs its webhook calls with.
+func readWebhookKey(path string) (*mailgun.MailgunImpl, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return mailgun.NewMailgun("", strings.TrimSpace(string(b))), nil
+}
+
+// mailgunEvents handles the event webhooks of Mailgun. The delivery of the notifications
+// in the mail is tracked. Addresses that bounce permanently or report the alarms as spam
+// are not mailed anymore, the sensors switch to their fallback channels and the admins
+// are told. The sensors are the ones the mail was about.
+func (a *apiServer) mailgunEvents(w http.ResponseWriter, r *http.Request) {
+	if a.mailgun == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var payload mailgun.WebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	now := nowFunc()
+	if ok, err := a.mailgun.VerifyWebhookSignature(payload.Signature); err != nil || !ok || !freshSignature(payload.Signature, now) {
+		apiError(w, http.StatusNotAcceptable, "invalid signature")
+		return
+	}
+	event, err := mailgun.ParseEvent(payload.EventData)
+	if err != nil {
+		// Mailgun disables webhooks that keep failing, so unknown events are accepted
+		log.Printf("ignoring Mailgun event: %v", err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var recipient, reason string
+	var variables map[string]interface{}
+	switch e := event.(type) {
+	case *events.Delivered:
+		a.trackDelivery(r.Context(), e.Message.Headers.MessageID, deliveryDelivered, "", e.GetTimestamp())
+	case *events.Failed:
+		detail := e.Reason
+		if e.DeliveryStatus.Description != "" {
+			detail += ", " + e.DeliveryStatus.Description
+		} else if e.DeliveryStatus.Message != "" {
+			detail += ", " + e.DeliveryStatus.Message
+		}
+		if e.Severity != events.SeverityPermanent {
+			a.trackDelivery(r.Context(), e.Message.Headers.MessageID, deliveryDeferred, detail, e.GetTimestamp())
+			break
+		}
+		a.trackDelivery(r.Context(), e.Message.Headers.MessageID, deliveryBounced, detail, e.GetTimestamp())
+		recipient, variables = e.Recipient, e.UserVariables
+		reason = "bounced: " + detail
+	case *events.Complained:
+		a.trackDelivery(r.Context(), e.Message.Headers.MessageID, deliveryComplained, "", e.GetTimestamp())
+		recipient, variables = e.Recipient, e.UserVariables
+		reason = "reported as spam"
+	}
+	if recipient == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sensors, _ := variables["sensors"].(string)
+	for _, id := range strings.Split(sensors, ",") {
+		if id == "" {
+			continue
+		}
+		// the address is undeliverable for every subscription to the sensor that mails it
+		added := make(map[string][]Channel)
+		subErrs := make(map[string]error)
+		subs, err := a.updateSubscriptions(r.Context(), id, func(s *Sensor) {
+			added[s.DocumentID], subErrs[s.DocumentID] = s.undeliverable(recipient, reason, now)
+		})
+		if err == ErrSensorNotFound {
+			continue // nothing to turn off
+		}
+		if err != nil {
+			log.Printf("unable to mark %s of sensor %s undeliverable: %v", recipient, id, err)
+			apiError(w, http.StatusInternalServerError, "something went wrong, please try again later")
+			return
+		}
+		for _, s := range subs {
+			if subErrs[s.DocumentID] != nil {
+				continue
+			}
+			log.Printf("mails of sensor %s to %s are undeliverable: %s", id, recipient, reason)
+			a.alerts.send(r.Context(), "Alarms of sensor "+id+" cannot be mailed", undeliverableAlert(id, recipient, reason, added[s.DocumentID]))
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// trackDelivery records what the provider reported about a message on its notifications.
+func (a *apiServer) trackDelivery(ctx context.Context, messageID, delivery, detail string, at time.Time) {
+	if a.outbox == nil || messageID == "" {
+		return
+	}
+	// Mailgun reports the ID without the angle brackets it returns on sending,
+	// and the time as a float, up to the microsecond
+	messageID = "<" + strings.Trim(messageID, "<>") + ">"
+	at = at.Round(time.Microsecond)
+	a.do(func() {
+		notifications, err := a.outbox.ByMessage(ctx, messageID)
+		if err != nil {
+			log.Printf("unable to find the notifications of message %s: %v", messageID, err)
+			return
+		}
+		for _, n := range notifications {
+			if !n.track(delivery, detail, at) {
+				continue
+			}
+			if err := a.outbox.Update(ctx, n); err != nil {
+				log.Printf("unable to update notification %s: %v", n.ID, err)
+			}
+		}
+	})
+}
+
+func freshSignature(sig mailgun.Signature, now time.Time) bool {
+	ts, err := strconv.ParseInt(sig.TimeStamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	return age < webhookMaxAge && age > -webhookMaxAge
+}
+
+func undeliverableAlert(sensor, address, reason string, fallback []Channel) string {
+	sb := strings.Builder{}
+	sb.WriteString("Hi,\n\n")
+	sb.WriteString("The alarms of sensor " + sensor + " are no longer mailed to " + address + ", the mail was " + reason + ".\n")
+	if len(fallback) == 0 {
+		sb.WriteString("The sensor has no fallback channels, please find another way to reach its owner.\n")
+		return sb.String()
+	}
+	sb.WriteString("The alarms go to its fallback channels instead:\n")
+	for _, c := range fallback {
+		sb.WriteString("- " + c.Type + " " + c.Target + "\n")
+	}
+	return sb.String()
+}
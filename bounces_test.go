@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/mailgun/mailgun-go/v3"
+)
+
+// signedEvent is the body of a Mailgun webhook call with the event, signed with the key at the time.
+func signedEvent(t *testing.T, key string, event map[string]interface{}, at time.Time) string {
+	sig := mailgun.Signature{TimeStamp: strconv.FormatInt(at.Unix(), 10), Token: "0123456789abcdef0123456789abcdef0123456789abcdef50"}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(sig.TimeStamp + sig.Token))
+	sig.Signature = hex.EncodeToString(mac.Sum(nil))
+	b, err := json.Marshal(map[string]interface{}{"signature": sig, "event-data": event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMailgunEvents(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+	bounce := map[string]interface{}{
+		"event":           "failed",
+		"severity":        "permanent",
+		"reason":          "bounce",
+		"recipient":       "owner@example.com",
+		"delivery-status": map[string]interface{}{"description": "No such user"},
+		"user-variables":  map[string]interface{}{"sensors": "123,999"},
+	}
+	temporary := map[string]interface{}{
+		"event":          "failed",
+		"severity":       "temporary",
+		"recipient":      "owner@example.com",
+		"user-variables": map[string]interface{}{"sensors": "123"},
+	}
+	complaint := map[string]interface{}{
+		"event":          "complained",
+		"recipient":      "owner@example.com",
+		"user-variables": map[string]interface{}{"sensors": "123"},
+	}
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantError string
+	}{
+		{
+			name:      "permanent failure",
+			body:      signedEvent(t, "webhook-key", bounce, testDate),
+			wantCode:  http.StatusOK,
+			wantError: "bounced: bounce, No such user",
+		},
+		{
+			name:     "temporary failure",
+			body:     signedEvent(t, "webhook-key", temporary, testDate),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:      "complaint",
+			body:      signedEvent(t, "webhook-key", complaint, testDate),
+			wantCode:  http.StatusOK,
+			wantError: "reported as spam",
+		},
+		{
+			name:     "other key",
+			body:     signedEvent(t, "other-key", bounce, testDate),
+			wantCode: http.StatusNotAcceptable,
+		},
+		{
+			name:     "replayed",
+			body:     signedEvent(t, "webhook-key", bounce, testDate.Add(-time.Hour)),
+			wantCode: http.StatusNotAcceptable,
+		},
+		{
+			name:     "other event",
+			body:     signedEvent(t, "webhook-key", map[string]interface{}{"event": "delivered"}, testDate),
+			wantCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := sensorStoreMock{sensors: map[string]Sensor{
+				"123": {ID: "123", EmailAddress: "owner@example.com", Fallback: []Channel{{Type: "ntfy", Target: "sensor-123"}}},
+			}}
+			mailer := mailerMock{}
+			a := apiServer{
+				sensors: &store,
+				mailgun: mailgun.NewMailgun("", "webhook-key"),
+				alerts:  &adminAlerts{tenant: &tenant{mailer: &mailer}, to: []string{"admin@example.com"}},
+			}
+			rec := httptest.NewRecorder()
+			a.routes().ServeHTTP(rec, httptest.NewRequest("POST", "/mailgun/events", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body)
+			}
+
+			channels := store.sensors["123"].Channels
+			if tt.wantError == "" {
+				if len(channels) != 0 || len(mailer.sent) != 0 {
+					t.Errorf("expected nothing to change, got %+v and %d mails", channels, len(mailer.sent))
+				}
+				return
+			}
+			if len(channels) != 2 || channels[0].Undeliverable != testDate || channels[0].LastError != tt.wantError || channels[1].Type != "ntfy" {
+				t.Errorf("expected the e-mail to be undeliverable and the fallback added, got %+v", channels)
+			}
+			if len(mailer.sent) != 1 || mailer.sent[0].To != "admin@example.com" || !strings.Contains(mailer.sent[0].Text, "- ntfy sensor-123") {
+				t.Errorf("expected an alert to the admin, got %+v", mailer.sent)
+			}
+		})
+	}
+}
+
+func TestDeliveryTracking(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+	ob := newMemoryOutbox()
+	n := newNotification(Channel{Type: "email", Target: "owner@example.com"}, false, newAlarmEvent(sensorStatus{sensor: Sensor{
+		ID: "123", Alarms: Alarm{Offline: testDate}, Incident: &Incident{Started: testDate},
+	}}), testDate)
+	n.Status, n.Attempts, n.Sent, n.MessageID = statusSent, 1, testDate, "<20190703231245.1@mg.example.com>"
+	ob.Add(context.Background(), n)
+
+	a := apiServer{sensors: &sensorStoreMock{}, outbox: ob, token: "secret", mailgun: mailgun.NewMailgun("", "webhook-key")}
+	for _, event := range []map[string]interface{}{
+		{"event": "delivered", "timestamp": float64(testDate.Add(2 * time.Minute).Unix()), "message": map[string]interface{}{"headers": map[string]interface{}{"message-id": "20190703231245.1@mg.example.com"}}},
+		// reports can arrive late
+		{"event": "failed", "severity": "temporary", "reason": "generic", "timestamp": float64(testDate.Add(time.Minute).Unix()), "message": map[string]interface{}{"headers": map[string]interface{}{"message-id": "20190703231245.1@mg.example.com"}}},
+	} {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, httptest.NewRequest("POST", "/mailgun/events", strings.NewReader(signedEvent(t, "webhook-key", event, testDate))))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the event to be taken, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/sensors/123/notifications", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, req)
+	var got []deliveryReport
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("expected the notifications, got %d (%v)", rec.Code, err)
+	}
+	delivered := time.Unix(testDate.Add(2*time.Minute).Unix(), 0).UTC()
+	want := []deliveryReport{{
+		ID:              n.ID,
+		Created:         testDate,
+		Channel:         "email",
+		Target:          "owner@example.com",
+		Event:           "alarm",
+		Alarms:          []string{AlarmOffline},
+		Incident:        &testDate,
+		Status:          statusSent,
+		Attempts:        1,
+		Sent:            &testDate,
+		MessageID:       "<20190703231245.1@mg.example.com>",
+		Delivery:        deliveryDelivered,
+		DeliveryUpdated: &delivered,
+	}}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
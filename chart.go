@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"time"
+)
+
+const (
+	chartWidth   = 600
+	chartHeight  = 200
+	chartMargin  = 10
+	chartTicks   = 20 // height of the strip with message arrivals
+	chartWindow  = 3 * 24 * time.Hour
+	chartMinVolt = 2.8
+	chartMaxVolt = 4.2
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartGrid       = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	chartThreshold  = color.RGBA{0xd3, 0x2f, 0x2f, 0xff}
+	chartVoltage    = color.RGBA{0x19, 0x76, 0xd2, 0xff}
+	chartArrival    = color.RGBA{0x38, 0x8e, 0x3c, 0xff}
+)
+
+// voltageChart draws the voltage of the readings in the window before now as a line,
+// with the threshold as a red line and a tick at the bottom for every message that arrived.
+// It returns a PNG image.
+func voltageChart(readings []Reading, threshold float32, now time.Time) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.ZP, draw.Src)
+
+	plotBottom := chartHeight - chartMargin - chartTicks
+	start := now.Add(-chartWindow)
+
+	x := func(t time.Time) int {
+		return chartMargin + int(float64(chartWidth-2*chartMargin)*t.Sub(start).Seconds()/chartWindow.Seconds())
+	}
+	y := func(v float32) int {
+		f := (float64(v) - chartMinVolt) / (chartMaxVolt - chartMinVolt)
+		if f < 0 {
+			f = 0
+		}
+		if f > 1 {
+			f = 1
+		}
+		return plotBottom - int(f*float64(plotBottom-chartMargin))
+	}
+
+	// a grid line per day
+	for d := start; !d.After(now); d = d.Add(24 * time.Hour) {
+		line(img, x(d), chartMargin, x(d), chartHeight-chartMargin, chartGrid)
+	}
+	line(img, chartMargin, plotBottom, chartWidth-chartMargin, plotBottom, chartGrid)
+
+	if threshold == 0 {
+		threshold = 3.26 // default
+	}
+	for px := chartMargin; px < chartWidth-chartMargin; px += 8 {
+		line(img, px, y(threshold), px+4, y(threshold), chartThreshold)
+	}
+
+	prevX, prevY := -1, -1
+	for i := len(readings) - 1; i >= 0; i-- { // readings are newest first
+		r := readings[i]
+		if r.Date.Before(start) || r.Date.After(now) {
+			continue
+		}
+		px, py := x(r.Date), y(r.Voltage)
+		if prevX >= 0 {
+			line(img, prevX, prevY, px, py, chartVoltage)
+		}
+		prevX, prevY = px, py
+		line(img, px, chartHeight-chartMargin-chartTicks+4, px, chartHeight-chartMargin, chartArrival)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// line draws a straight line using Bresenham's algorithm.
+func line(img draw.Image, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestVoltageChart(t *testing.T) {
+	var readings []Reading
+	for i := 0; i < 48; i++ {
+		readings = append(readings, Reading{Date: testDate.Add(-time.Duration(i) * time.Hour), Voltage: 3.3 + float32(i)*0.01})
+	}
+
+	b, err := voltageChart(readings, 3.2, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("chart is not a PNG: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != chartWidth || size.Y != chartHeight {
+		t.Errorf("unexpected size %v", size)
+	}
+
+	// the newest reading is drawn at the right edge of the plot
+	var found bool
+	for y := 0; y < chartHeight; y++ {
+		if img.At(chartWidth-chartMargin, y) == chartVoltage {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("voltage line is missing at the newest reading")
+	}
+}
+
+func TestRenderChart(t *testing.T) {
+	d := digest{sections: []sensorStatus{
+		{
+			sensor:  Sensor{ID: "123", Alarms: Alarm{LowVoltage: testDate}},
+			reading: Reading{Date: testDate, Voltage: 3.2},
+			history: []Reading{{Date: testDate, Voltage: 3.2}, {Date: testDate.Add(-time.Hour), Voltage: 3.25}},
+		},
+	}}
+
+	msg, err := testTemplates.renderIn(d, testTenant, nil, "en", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.inline) != 1 || msg.inline[0].Filename != "chart-123.png" {
+		t.Fatalf("expected one inline chart, got %v", msg.inline)
+	}
+	if !bytes.Contains([]byte(msg.html), []byte(`src="cid:chart-123.png"`)) {
+		t.Errorf("html does not reference the chart: %s", msg.html)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const sensorURL = "https://meetjestad.net/data/sensors_recent.php?sensor=%s"
+
+// chatMessage is an alarm or recovery of one sensor, ready to be formatted for a chat platform.
+type chatMessage struct {
+	sensorID string
+	url      string
+	headline string
+	details  []string
+}
+
+func newChatMessage(e AlarmEvent, location *time.Location) chatMessage {
+	m := chatMessage{
+		sensorID: e.Sensor.ID,
+		url:      fmt.Sprintf(sensorURL, url.QueryEscape(e.Sensor.ID)),
+	}
+	if e.Recovery {
+		m.headline = "working normally again"
+		return m
+	}
+
+	m.headline = e.Severity.String()
+	loc := sensorLocation(e.Sensor, location)
+	for _, f := range e.Findings {
+		switch f.Type {
+		case AlarmOffline:
+			m.details = append(m.details, "offline since "+formatDate("en", f.Since.In(loc)))
+		case AlarmVoltage:
+			m.details = append(m.details, fmt.Sprintf("battery low: %.2fV", e.Reading.Voltage))
+		case AlarmGPS:
+			m.details = append(m.details, "no GPS fix")
+		}
+	}
+	return m
+}
+
+func chatIcon(e AlarmEvent) string {
+	switch {
+	case e.Recovery:
+		return ":white_check_mark:"
+	case e.Severity == SeverityCritical:
+		return ":rotating_light:"
+	default:
+		return ":warning:"
+	}
+}
+
+// slackNotifier posts to Slack compatible incoming webhooks, which Mattermost has as well.
+// The channel's target is the webhook URL. Incoming webhooks do not tell the ID of the
+// message they created, so there is no threading.
+type slackNotifier struct {
+	client   *http.Client
+	location *time.Location // time zone for sensors that have none set
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	var lines []string
+	for _, e := range events {
+		m := newChatMessage(e, s.location)
+		lines = append(lines, fmt.Sprintf("%s *<%s|Sensor %s>*: %s", chatIcon(e), m.url, slackEscape(m.sensorID), m.headline))
+		for _, d := range m.details {
+			lines = append(lines, "• "+d)
+		}
+	}
+
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{strings.Join(lines, "\n")})
+	if err != nil {
+		return err
+	}
+	_, err = chatRequest(ctx, s.client, "POST", c.Target, "", body)
+	return err
+}
+
+// slackEscape escapes the characters with a meaning in Slack's message markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// matrixNotifier sends a notice per sensor to the Matrix room in the channel's target.
+// The first message of an incident starts a thread; updates and the recovery go in there.
+type matrixNotifier struct {
+	client     *http.Client
+	homeserver string
+	token      string
+	location   *time.Location // time zone for sensors that have none set
+}
+
+func newMatrixNotifier(client *http.Client, c MatrixConfig, location *time.Location) (*matrixNotifier, error) {
+	m := matrixNotifier{client: client, homeserver: strings.TrimSuffix(c.Homeserver, "/"), location: location}
+	if c.TokenPath != "" {
+		b, err := ioutil.ReadFile(c.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Matrix token file: %v", err)
+		}
+		m.token = strings.TrimSpace(string(b))
+	}
+	return &m, nil
+}
+
+type matrixRelation struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+}
+
+type matrixMessage struct {
+	MsgType       string          `json:"msgtype"`
+	Body          string          `json:"body"`
+	Format        string          `json:"format"`
+	FormattedBody string          `json:"formatted_body"`
+	RelatesTo     *matrixRelation `json:"m.relates_to,omitempty"`
+}
+
+func (m *matrixNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	if m.homeserver == "" {
+		return fmt.Errorf("no Matrix homeserver configured")
+	}
+
+	for i, e := range events {
+		msg := newMatrixMessage(e, m.location)
+		if e.Thread != "" {
+			msg.RelatesTo = &matrixRelation{RelType: "m.thread", EventID: e.Thread}
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		// the same transaction ID makes the homeserver ignore a repeated send
+		txn := e.Key
+		if txn == "" {
+			txn = eventID(e)
+			if e.Recovery {
+				txn += "-recovery"
+			}
+		}
+		endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+			m.homeserver, url.PathEscape(c.Target), txn)
+		res, err := chatRequest(ctx, m.client, "PUT", endpoint, m.token, body)
+		if err != nil {
+			return err
+		}
+
+		var sent struct {
+			EventID string `json:"event_id"`
+		}
+		if err := json.Unmarshal(res, &sent); err != nil {
+			return fmt.Errorf("unexpected response from Matrix: %v", err)
+		}
+		if events[i].Thread == "" {
+			events[i].Thread = sent.EventID
+		}
+	}
+	return nil
+}
+
+func newMatrixMessage(e AlarmEvent, location *time.Location) matrixMessage {
+	m := newChatMessage(e, location)
+
+	text := fmt.Sprintf("Sensor %s: %s", m.sensorID, m.headline)
+	formatted := fmt.Sprintf(`<b><a href="%s">Sensor %s</a></b>: %s`, html.EscapeString(m.url), html.EscapeString(m.sensorID), m.headline)
+	if len(m.details) > 0 {
+		formatted += "<ul>"
+		for _, d := range m.details {
+			text += "\n- " + d
+			formatted += "<li>" + html.EscapeString(d) + "</li>"
+		}
+		formatted += "</ul>"
+	}
+	text += "\n" + m.url
+
+	return matrixMessage{
+		MsgType:       "m.notice",
+		Body:          text,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted,
+	}
+}
+
+// chatRequest sends a JSON body and returns the response body of a successful request.
+func chatRequest(ctx context.Context, client *http.Client, method, endpoint, token string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "meetjestad-monitor")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s responded with %s", req.URL.Host, res.Status)
+	}
+	return b, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlackNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	var text string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		text = body.Text
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	events := []AlarmEvent{
+		newAlarmEvent(sensorStatus{
+			sensor:  Sensor{ID: "123", Alarms: Alarm{Offline: testDate, LowVoltage: testDate}},
+			reading: Reading{SensorID: "123", Voltage: 3.1},
+		}),
+		newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "456"}}, Alarm{GpsMissing: testDate}),
+	}
+
+	s := slackNotifier{client: srv.Client()}
+	if err := s.Notify(context.Background(), Channel{Type: "slack", Target: srv.URL}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ":rotating_light: *<https://meetjestad.net/data/sensors_recent.php?sensor=123|Sensor 123>*: critical\n" +
+		"• offline since 03 Jul 19 23:12 UTC\n" +
+		"• battery low: 3.10V\n" +
+		":white_check_mark: *<https://meetjestad.net/data/sensors_recent.php?sensor=456|Sensor 456>*: working normally again"
+	if text != want {
+		t.Errorf("unexpected message:\n%s\nwant:\n%s", text, want)
+	}
+}
+
+func TestMatrixNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	var paths []string
+	var messages []matrixMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.Header.Get("Authorization") != "Bearer t0ken" {
+			t.Errorf("unexpected request %s %v", r.Method, r.Header)
+		}
+		paths = append(paths, r.URL.EscapedPath())
+		b, _ := ioutil.ReadAll(r.Body)
+		var m matrixMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Error(err)
+		}
+		messages = append(messages, m)
+		w.Write([]byte(`{"event_id":"$new"}`))
+	}))
+	defer srv.Close()
+
+	alarm := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{GpsMissing: testDate}}})
+	recovery := newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "456"}}, Alarm{Offline: testDate})
+	recovery.Thread = "$first"
+	events := []AlarmEvent{alarm, recovery}
+
+	m := matrixNotifier{client: srv.Client(), homeserver: srv.URL, token: "t0ken"}
+	if err := m.Notify(context.Background(), Channel{Type: "matrix", Target: "!room:example.org"}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if !strings.HasPrefix(paths[0], "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/") {
+		t.Errorf("unexpected path %s", paths[0])
+	}
+	if messages[0].RelatesTo != nil || events[0].Thread != "$new" {
+		t.Errorf("expected the alarm to start a thread, got %v and thread %q", messages[0].RelatesTo, events[0].Thread)
+	}
+	if messages[0].Body != "Sensor 123: info\n- no GPS fix\nhttps://meetjestad.net/data/sensors_recent.php?sensor=123" {
+		t.Errorf("unexpected body %q", messages[0].Body)
+	}
+	if r := messages[1].RelatesTo; r == nil || r.RelType != "m.thread" || r.EventID != "$first" {
+		t.Errorf("expected the recovery in the thread, got %v", r)
+	}
+	if events[1].Thread != "$first" {
+		t.Errorf("expected the thread to be kept, got %q", events[1].Thread)
+	}
+}
@@ -12,121 +12,166 @@ import (
 var nowFunc = time.Now
 
 type sensorReader interface {
-	Read(r *Reading) error
+	History(sensorID string, limit int) ([]Reading, error)
 }
 
 type httpSensorReader struct {
 	client *http.Client
 }
 
-func (h *httpSensorReader) Read(r *Reading) error {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://meetjescraper.online/?sensor=%s&limit=1", r.SensorID), nil)
+// History returns up to limit of the sensor's most recent readings, the latest first.
+func (h *httpSensorReader) History(sensorID string, limit int) ([]Reading, error) {
+	return h.fetch(sensorID, limit)
+}
+
+func (h *httpSensorReader) fetch(sensorID string, limit int) ([]Reading, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://meetjescraper.online/?sensor=%s&limit=%d", sensorID, limit), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	res, err := h.client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer res.Body.Close()
 	var data []Reading
 	d := json.NewDecoder(res.Body)
 	if err := d.Decode(&data); err != nil {
-		return err
-	}
-
-	if len(data) == 0 {
-		return nil
+		return nil, err
 	}
 
-	v := data[0]
-
-	r.Position = v.Position
-	r.Date = v.Date
-	r.Voltage = v.Voltage
-	r.Firmware = v.Firmware
-
-	return nil
+	return data, nil
 }
 
-func checkSensors(m Mailer, c sensorReader, sensors SensorIteratable) error {
+// checkSensors checks all sensors, stores their alarms and sends them to the subscribed channels.
+// The readings of a sensor are fetched once, also when it has several subscriptions, and the
+// latest is the one the alarms are based on. The status of every sensor that could be read is
+// returned for use in reports, together with the IDs of the sensors that could not be read.
+func checkSensors(d *dispatcher, c sensorReader, sensors SensorIteratable) ([]sensorStatus, []string, error) {
 	log.Printf("checking sensors")
 	ctx := context.Background()
 
 	defer sensors.Stop()
 
+	var statuses []sensorStatus
+	var unread []string
+	histories := make(map[string][]Reading)
+
 	for {
 		var s Sensor
 		if err := sensors.Next(ctx, &s); err != nil {
 			if err == ErrSensorEOF {
 				break
 			}
-			return err
+			return nil, nil, err
 		}
 
 		log.Printf("checking %v", s)
-		r := Reading{SensorID: s.ID}
-
-		if err := c.Read(&r); err != nil {
-			log.Printf("error reading sensor, unable to monitor: %v", err)
+		history, read := histories[s.ID]
+		if !read {
+			var err error
+			if history, err = c.History(s.ID, historyLimit); err != nil {
+				log.Printf("error reading sensor, unable to monitor: %v", err)
+				unread = append(unread, s.ID)
+			}
+			histories[s.ID] = history
+		}
+		if contains(unread, s.ID) {
 			continue
 		}
+		r := Reading{SensorID: s.ID}
+		if len(history) > 0 {
+			r = history[0]
+			r.SensorID = s.ID
+		}
 
-		a := compareSensorData(s, r)
+		s.Health = computeHealth(s, r, history, nowFunc())
 
-		noTime := time.Time{}
-		if a.Offline != noTime || a.LowVoltage != noTime || a.GpsMissing != noTime {
-			if err := composeAndSendAlarm(ctx, m, s, a, r); err != nil {
-				log.Print(err)
-				continue
-			}
-		}
-		s.Alarms = a
-		if err := sensors.Store(ctx, s); err != nil {
-			log.Printf("failed to store alarm for sensor %s: %v", s.ID, err)
+		previous := s.Alarms
+		s.Alarms = compareSensorData(s, r)
+		s.Raised = s.Raised.merge(s.Alarms)
+
+		statuses = append(statuses, sensorStatus{sensor: s, previous: previous, reading: r, history: history})
+	}
+
+	// the alarms are stored before they are sent, so a crash does not send them twice
+	d.queue(ctx, statuses)
+
+	for _, st := range statuses {
+		if err := sensors.Store(ctx, st.sensor); err != nil {
+			log.Printf("failed to store alarm for sensor %s: %v", st.sensor.ID, err)
 		}
 	}
 
-	return nil
+	d.deliver(ctx)
+
+	return statuses, unread, nil
 }
 
+// compareSensorData returns the alarms for the sensor's latest reading. An alarm that is
+// still valid keeps its timestamp for 24 hours so it is not raised again on every check,
+// alarms for problems that are solved are cleared. A problem that comes back within 24 hours
+// after its alarm was raised is not raised again until then, so a flapping sensor does not
+// send an alarm and a recovery every time. Snoozed alarms are not raised and acknowledged
+// ones are not raised again.
 func compareSensorData(s Sensor, r Reading) Alarm {
 	now := nowFunc()
 	log.Printf("sensor data %v at %v", r, now)
 
 	a := s.Alarms
+	keep := func(raised time.Time) bool {
+		if s.Incident.acknowledged() && !raised.IsZero() {
+			return true
+		}
+		return now.Sub(raised).Hours() <= 24
+	}
+	// held tells whether a cleared alarm was raised too recently to be raised again
+	held := func(current, raised time.Time) bool {
+		return current.IsZero() && now.Sub(raised).Hours() <= 24
+	}
 
 	var res Alarm
 
-	age := now.Sub(a.Offline)
-	if age.Hours() <= 24 {
-		res.Offline = a.Offline
-		return res
-	} else if diff := now.Sub(r.Date); diff.Hours() > 6 {
-		log.Printf("sensor is offline for %v", diff)
-		res.Offline = now
+	if diff := now.Sub(r.Date); diff.Hours() > 6 {
+		if s.snoozed(AlarmOffline, now) {
+			return res
+		}
+		if keep(a.Offline) {
+			res.Offline = a.Offline
+		} else if held(a.Offline, s.Raised.Offline) {
+			log.Printf("sensor is offline again, raised at %v", s.Raised.Offline)
+		} else {
+			log.Printf("sensor is offline for %v", diff)
+			res.Offline = now
+		}
 		return res // no need to continue since the rest of the checks will fail too
 	}
 
-	age = now.Sub(a.LowVoltage)
 	threshold := s.Threshold
 	if threshold == 0 {
 		threshold = 3.26 // default
 	}
-	if age.Hours() <= 24 {
-		res.LowVoltage = a.LowVoltage
-	} else if r.Voltage < threshold {
-		log.Printf("voltage is below threshold: %v < %v", r.Voltage, s.Threshold)
-		res.LowVoltage = now
+	if r.Voltage < threshold && !s.snoozed(AlarmVoltage, now) {
+		if keep(a.LowVoltage) {
+			res.LowVoltage = a.LowVoltage
+		} else if held(a.LowVoltage, s.Raised.LowVoltage) {
+			log.Printf("voltage is below threshold again, raised at %v", s.Raised.LowVoltage)
+		} else {
+			log.Printf("voltage is below threshold: %v < %v", r.Voltage, s.Threshold)
+			res.LowVoltage = now
+		}
 	}
 
-	age = now.Sub(a.GpsMissing)
-	if age.Hours() <= 24 {
-		res.GpsMissing = a.GpsMissing
-	} else if r.Position.Lat == 0 && r.Position.Lng == 0 {
-		log.Printf("sensor is missing GPS lock: %v", r.Position)
-		res.GpsMissing = now
+	if r.Position.Lat == 0 && r.Position.Lng == 0 && !s.snoozed(AlarmGPS, now) {
+		if keep(a.GpsMissing) {
+			res.GpsMissing = a.GpsMissing
+		} else if held(a.GpsMissing, s.Raised.GpsMissing) {
+			log.Printf("sensor is missing GPS lock again, raised at %v", s.Raised.GpsMissing)
+		} else {
+			log.Printf("sensor is missing GPS lock: %v", r.Position)
+			res.GpsMissing = now
+		}
 	}
 
 	return res
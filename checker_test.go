@@ -76,6 +76,73 @@ func TestCompareSensorData(t *testing.T) {
 			},
 			want: Alarm{LowVoltage: nowFunc().Add(tenHoursAgo), GpsMissing: nowFunc()},
 		},
+		{
+			name: "raises a persisting alarm again after a day",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Alarms: Alarm{LowVoltage: nowFunc().Add(-25 * time.Hour)}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc(), Position: okPos},
+			},
+			want: Alarm{LowVoltage: nowFunc()},
+		},
+		{
+			name: "clears solved alarms",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Alarms: Alarm{Offline: nowFunc().Add(tenHoursAgo), GpsMissing: nowFunc().Add(tenHoursAgo)}},
+				reading: Reading{Voltage: 3.3, Date: nowFunc(), Position: okPos},
+			},
+		},
+		{
+			name: "does not raise an alarm again within a day after it was cleared",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Raised: Alarm{Offline: nowFunc().Add(tenHoursAgo), LowVoltage: nowFunc().Add(-25 * time.Hour)}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc(), Position: okPos},
+			},
+			want: Alarm{LowVoltage: nowFunc()},
+		},
+		{
+			name: "holds a flapping offline alarm",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Raised: Alarm{Offline: nowFunc().Add(-time.Hour)}},
+				reading: Reading{Voltage: 3.3, Date: nowFunc().Add(tenHoursAgo), Position: okPos},
+			},
+		},
+		{
+			name: "does not raise snoozed alarms",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Snoozes: []Snooze{{Until: nowFunc().Add(time.Hour)}}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc().Add(tenHoursAgo)},
+			},
+		},
+		{
+			name: "snoozes one alarm type",
+			args: args{
+				sensor: Sensor{Threshold: 3.2, Snoozes: []Snooze{
+					{Alarm: AlarmGPS, Until: nowFunc().Add(time.Hour)},
+					{Alarm: AlarmVoltage, Until: nowFunc().Add(-time.Hour)},
+				}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc()},
+			},
+			want: Alarm{LowVoltage: nowFunc()},
+		},
+		{
+			name: "repeats unacknowledged alarms after a day",
+			args: args{
+				sensor:  Sensor{Threshold: 3.2, Alarms: Alarm{Offline: nowFunc().Add(-25 * time.Hour)}, Incident: &Incident{Started: nowFunc().Add(-25 * time.Hour)}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc().Add(-25 * time.Hour)},
+			},
+			want: Alarm{Offline: nowFunc()},
+		},
+		{
+			name: "does not repeat acknowledged alarms",
+			args: args{
+				sensor: Sensor{Threshold: 3.2, Alarms: Alarm{LowVoltage: nowFunc().Add(-25 * time.Hour)}, Incident: &Incident{
+					Started:      nowFunc().Add(-25 * time.Hour),
+					Acknowledged: nowFunc().Add(-time.Hour),
+				}},
+				reading: Reading{Voltage: 3.1, Date: nowFunc()},
+			},
+			want: Alarm{LowVoltage: nowFunc().Add(-25 * time.Hour), GpsMissing: nowFunc()},
+		},
 	}
 
 	for _, tt := range tests {
@@ -87,6 +154,61 @@ func TestCompareSensorData(t *testing.T) {
 	}
 }
 
+func TestApplyCheck(t *testing.T) {
+	started := testDate.Add(-2 * time.Hour)
+	acknowledged := testDate.Add(-time.Minute)
+	snooze := Snooze{Until: testDate.Add(time.Hour)}
+
+	// what the check read, and found out
+	checked := Sensor{
+		ID:       "1",
+		Alarms:   Alarm{Offline: testDate},
+		Raised:   Alarm{Offline: testDate},
+		Health:   Health{Score: 40},
+		Channels: []Channel{{Type: "email", Queued: Alarm{Offline: testDate}}, {Type: "telegram", Target: "7", Queued: Alarm{Offline: testDate}}},
+		Incident: &Incident{Started: started, Steps: []IncidentStep{
+			{Time: started, Action: stepRaised, Detail: AlarmOffline},
+			{Time: testDate, Action: stepEscalated, Detail: "email caretaker@example.com"},
+		}},
+		Verifications: []Verification{{Address: "owner@example.com", Sent: started}},
+		OptIn:         started,
+	}
+	// how the sensor was changed during the check
+	stored := Sensor{
+		ID:       "1",
+		Snoozes:  []Snooze{snooze},
+		Channels: []Channel{{Type: "email"}, {Type: "webhook", Target: "https://example.com/hook"}},
+		Incident: &Incident{Started: started, Acknowledged: acknowledged, Steps: []IncidentStep{
+			{Time: started, Action: stepRaised, Detail: AlarmOffline},
+			{Time: acknowledged, Action: stepAcknowledged, Detail: "owner@example.com"},
+		}},
+		Verifications: []Verification{{Address: "owner@example.com", Sent: started, Confirmed: acknowledged}},
+	}
+	stored.applyCheck(checked)
+
+	want := Sensor{
+		ID:       "1",
+		Alarms:   Alarm{Offline: testDate},
+		Raised:   Alarm{Offline: testDate},
+		Health:   Health{Score: 40},
+		Snoozes:  []Snooze{snooze},
+		Channels: []Channel{{Type: "email", Queued: Alarm{Offline: testDate}}, {Type: "webhook", Target: "https://example.com/hook"}},
+		Incident: &Incident{Started: started, Acknowledged: acknowledged, Steps: []IncidentStep{
+			{Time: started, Action: stepRaised, Detail: AlarmOffline},
+			{Time: acknowledged, Action: stepAcknowledged, Detail: "owner@example.com"},
+			{Time: testDate, Action: stepEscalated, Detail: "email caretaker@example.com"},
+		}},
+		Verifications: []Verification{{Address: "owner@example.com", Sent: started, Confirmed: acknowledged}},
+		OptIn:         started,
+	}
+	if diff := deep.Equal(stored, want); diff != nil {
+		t.Error(diff)
+	}
+	if checked.Incident.Acknowledged != (time.Time{}) || len(checked.Incident.Steps) != 2 {
+		t.Errorf("expected the checked incident to be left alone, got %+v", checked.Incident)
+	}
+}
+
 type sensorsMock struct {
 	mock.Mock
 }
@@ -117,9 +239,9 @@ type sensorReaderMock struct {
 	mock.Mock
 }
 
-func (sgm *sensorReaderMock) Read(r *Reading) error {
-	args := sgm.Called(r)
-	return args.Error(0)
+func (sgm *sensorReaderMock) History(sensorID string, limit int) ([]Reading, error) {
+	args := sgm.Called(sensorID, limit)
+	return args.Get(0).([]Reading), args.Error(1)
 }
 
 func TestCheckSensors(t *testing.T) {
@@ -128,7 +250,7 @@ func TestCheckSensors(t *testing.T) {
 	}
 
 	type args struct {
-		m       Mailer
+		n       *dispatcher
 		c       sensorReader
 		sensors *sensorsMock
 	}
@@ -141,17 +263,33 @@ func TestCheckSensors(t *testing.T) {
 		{
 			name: "sends mail",
 			args: args{
-				m: &logMailer{},
+				n: &dispatcher{
+					notifiers: map[string]Notifier{"email": &emailNotifier{tenants: &tenants{fallback: testTenant}, templates: testTemplates}},
+					outbox:    newMemoryOutbox(),
+					sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+				},
 				c: func() *sensorReaderMock {
 					s := sensorReaderMock{}
-					s.On("Read", &Reading{SensorID: "123"}).Return(nil)
+					s.On("History", "123", historyLimit).Return([]Reading{}, nil)
 					return &s
 				}(),
 				sensors: func() *sensorsMock {
 					s := sensorsMock{}
 					s.On("Next", context.Background(), &Sensor{}).Return(Sensor{ID: "123"}, nil)
 					s.On("Stop").Once().Return()
-					s.On("Store", context.Background(), Sensor{ID: "123", Alarms: Alarm{Offline: nowFunc()}}).Return(nil)
+					s.On("Store", context.Background(), Sensor{
+						ID:     "123",
+						Alarms: Alarm{Offline: nowFunc()},
+						Raised: Alarm{Offline: nowFunc()},
+						Health: computeHealth(Sensor{ID: "123"}, Reading{SensorID: "123"}, nil, nowFunc()),
+						Channels: []Channel{
+							{Type: "email", Queued: Alarm{Offline: nowFunc()}},
+						},
+						Incident: &Incident{
+							Started: nowFunc(),
+							Steps:   []IncidentStep{{Time: nowFunc(), Action: stepRaised, Detail: AlarmOffline}},
+						},
+					}).Return(nil)
 					return &s
 				}(),
 			},
@@ -159,7 +297,11 @@ func TestCheckSensors(t *testing.T) {
 		{
 			name: "fails to get next sensor",
 			args: args{
-				m: &logMailer{},
+				n: &dispatcher{
+					notifiers: map[string]Notifier{"email": &emailNotifier{tenants: &tenants{fallback: testTenant}, templates: testTemplates}},
+					outbox:    newMemoryOutbox(),
+					sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+				},
 				sensors: func() *sensorsMock {
 					s := sensorsMock{}
 					s.On("Next", context.Background(), &Sensor{}).Return(Sensor{}, errors.New("test error"))
@@ -173,7 +315,7 @@ func TestCheckSensors(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Logf("executing '%s'", tt.name)
-		err := checkSensors(tt.args.m, tt.args.c, tt.args.sensors)
+		_, _, err := checkSensors(tt.args.n, tt.args.c, tt.args.sensors)
 		if err != nil && !tt.wantErr {
 			t.Errorf("%s failed: %v", tt.name, err)
 		}
@@ -183,3 +325,59 @@ func TestCheckSensors(t *testing.T) {
 		tt.args.sensors.AssertExpectations(t)
 	}
 }
+
+// subscriptionsIterator iterates over subscriptions and keeps the ones stored.
+type subscriptionsIterator struct {
+	sensors []Sensor
+	stored  []Sensor
+}
+
+func (si *subscriptionsIterator) Next(ctx context.Context, s *Sensor) error {
+	if len(si.sensors) == 0 {
+		return ErrSensorEOF
+	}
+	*s = si.sensors[0]
+	si.sensors = si.sensors[1:]
+	return nil
+}
+
+func (si *subscriptionsIterator) Stop() {}
+
+func (si *subscriptionsIterator) Store(ctx context.Context, s Sensor) error {
+	si.stored = append(si.stored, s)
+	return nil
+}
+
+func TestCheckSensorsReadsOnce(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	latest := Reading{SensorID: "123", Date: testDate, Voltage: 3.9, Position: Position{Lat: 52.1, Lng: 5.1}}
+	c := sensorReaderMock{}
+	c.On("History", "123", historyLimit).Return([]Reading{latest, {SensorID: "123", Date: testDate.Add(-time.Hour)}}, nil).Once()
+	c.On("History", "456", historyLimit).Return([]Reading(nil), errors.New("test error")).Once()
+
+	sensors := subscriptionsIterator{sensors: []Sensor{
+		{ID: "123", DocumentID: "sub1"},
+		{ID: "456", DocumentID: "sub2"},
+		{ID: "123", DocumentID: "sub3"},
+		{ID: "456", DocumentID: "sub4"},
+	}}
+	d := dispatcher{outbox: newMemoryOutbox(), sensors: &sensorStoreMock{sensors: make(map[string]Sensor)}}
+	statuses, unread, err := checkSensors(&d, &c, &sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	if len(statuses) != 2 || statuses[0].reading != latest || statuses[1].reading != latest {
+		t.Errorf("expected both subscriptions to sensor 123 to get the latest reading, got %v", statuses)
+	}
+	if diff := deep.Equal(unread, []string{"456"}); diff != nil {
+		t.Errorf("unread failed: %v", diff)
+	}
+	if len(sensors.stored) != 2 {
+		t.Errorf("expected the two subscriptions to sensor 123 to be stored, got %v", sensors.stored)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandUsage = `usage: meetjestad-monitor [command]
+
+Without a command the monitor runs. Commands:
+
+  outbox <sensor> [n]
+      show the last n (default 20) notifications of a sensor
+  snooze <sensor> <duration> [alarm] [reason]
+      hold back the alarms of a sensor, or of one alarm type (offline, voltage or gps),
+      for a duration like 3d or 12h`
+
+// commandEnv holds the stores the commands work on.
+type commandEnv struct {
+	outbox  outbox
+	sensors sensorStore
+}
+
+// runCommand runs a command from the command line and writes its output to w.
+func runCommand(ctx context.Context, env commandEnv, w io.Writer, args []string) error {
+	switch args[0] {
+	case "outbox":
+		if len(args) < 2 {
+			return fmt.Errorf("which sensor?\n\n%s", commandUsage)
+		}
+		limit := 20
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid number of notifications %q", args[2])
+			}
+			limit = n
+		}
+		return listOutbox(ctx, env.outbox, w, args[1], limit)
+	case "snooze":
+		if len(args) < 3 {
+			return fmt.Errorf("which sensor and for how long?\n\n%s", commandUsage)
+		}
+		return snoozeSensor(ctx, env.sensors, w, args[1], args[2], args[3:])
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], commandUsage)
+	}
+}
+
+// snoozeSensor snoozes every subscription to a sensor. The first word of the reason is the alarm type when it is one.
+func snoozeSensor(ctx context.Context, sensors sensorStore, w io.Writer, sensorID, duration string, reason []string) error {
+	d, err := parseSnoozeDuration(duration)
+	if err != nil {
+		return err
+	}
+	var alarm string
+	if len(reason) > 0 && reason[0] != "" && validAlarm(reason[0]) {
+		alarm, reason = reason[0], reason[1:]
+	}
+
+	now := nowFunc()
+	until := now.Add(d)
+	subs, err := updateSubscriptions(ctx, sensors, sensorID, func(s *Sensor) {
+		s.snooze(Snooze{Alarm: alarm, Until: until, Reason: strings.Join(reason, " ")}, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	if alarm == "" {
+		alarm = "all"
+	}
+	fmt.Fprintf(w, "%s alarms of sensor %s are snoozed until %s", alarm, sensorID, until.Format(time.RFC3339))
+	if len(subs) > 1 {
+		fmt.Fprintf(w, " for its %d subscriptions", len(subs))
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+func listOutbox(ctx context.Context, o outbox, w io.Writer, sensorID string, limit int) error {
+	notifications, err := o.List(ctx, sensorID, limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tCHANNEL\tTARGET\tEVENT\tSTATUS\tATTEMPTS\tDELIVERY\tDETAILS")
+	for _, n := range notifications {
+		event := n.eventName()
+		if n.Admin {
+			event += " (admin)"
+		}
+		var details string
+		switch n.Status {
+		case statusSent:
+			details = "sent " + n.Sent.Format(time.RFC3339)
+			if n.MessageID != "" {
+				details += " as " + n.MessageID
+			}
+			if n.DeliveryDetail != "" {
+				details += ", " + n.DeliveryDetail
+			}
+		case statusPending:
+			details = "next attempt " + n.NextAttempt.Format(time.RFC3339)
+			if n.Held != "" {
+				details += ", held back by " + n.Held
+			}
+			if n.LastError != "" {
+				details += ", " + n.LastError
+			}
+		default:
+			details = n.LastError
+		}
+		delivery := "-"
+		if n.Delivery != "" {
+			delivery = n.Delivery + " " + n.DeliveryUpdated.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			n.Created.Format(time.RFC3339), n.Channel.Type, n.Channel.Target, event, n.Status, n.Attempts, delivery, details)
+	}
+	return tw.Flush()
+}
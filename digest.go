@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// digest collects the sensors that send mail to the same recipient
+// so they receive one mail per run instead of one per sensor.
+type digest struct {
+	recipient string
+	sections  []sensorStatus
+	key       string // identifies the delivery, the same for every attempt
+	// root is the Message-ID of the mail when it is the first about an incident,
+	// threads are the Message-IDs of the first mails about the incidents it is about
+	root    string
+	threads []string
+	// attachments are the readings of sensors as CSV, for the channels that want them
+	attachments []Attachment
+}
+
+// sensorStatus is what a check found out about a sensor.
+type sensorStatus struct {
+	sensor   Sensor
+	previous Alarm // the alarms before the check
+	reading  Reading
+	history  []Reading
+}
+
+// digests groups sections by recipient while keeping the order in which recipients were seen.
+type digests struct {
+	byRecipient map[string]*digest
+	order       []string
+}
+
+func (d *digests) add(st sensorStatus) {
+	d.addTo(recipient(st.sensor), st)
+}
+
+// addTo adds the section to the digest of the address.
+func (d *digests) addTo(to string, st sensorStatus) {
+	if d.byRecipient == nil {
+		d.byRecipient = make(map[string]*digest)
+	}
+	dg, ok := d.byRecipient[to]
+	if !ok {
+		dg = &digest{recipient: to}
+		d.byRecipient[to] = dg
+		d.order = append(d.order, to)
+	}
+	dg.sections = append(dg.sections, st)
+}
+
+func (d *digests) all() []digest {
+	res := make([]digest, len(d.order))
+	for i, to := range d.order {
+		res[i] = *d.byRecipient[to]
+	}
+	return res
+}
+
+// recipient returns the address alarms for the sensor are sent to.
+func recipient(s Sensor) string {
+	if s.EmailAddress != "" {
+		return s.EmailAddress
+	}
+	return s.Owner
+}
+
+// contains tells whether the list has the string.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// emailNotifier mails alarms using the templates and the mailer of the sensor's tenant.
+type emailNotifier struct {
+	tenants   *tenants
+	templates *templateSet
+	links     *linkSigner // signs the links in the mails, nil for none
+}
+
+// The first mail about an incident gets the incident's Message-ID, which is kept as the thread
+// of the channel. A mail about several new incidents starts the thread of all of them.
+func (e *emailNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	t := e.tenants.lookup(events[0].Sensor.Tenant)
+	domain := messageDomain(t.from)
+	d := digest{recipient: c.Target}
+	h := sha256.New()
+	for i, ev := range events {
+		d.sections = append(d.sections, sensorStatus{sensor: ev.Sensor, reading: ev.Reading, history: ev.History})
+		io.WriteString(h, ev.Key)
+		thread := ev.Thread
+		switch {
+		case thread != "":
+		case ev.Opens && ev.Sensor.Incident != nil:
+			if d.root == "" {
+				d.root = incidentMessageID(ev.Sensor, domain)
+			}
+			events[i].Thread = d.root
+		default:
+			thread = incidentMessageID(ev.Sensor, domain)
+		}
+		if thread != "" && thread != d.root && !contains(d.threads, thread) {
+			d.threads = append(d.threads, thread)
+		}
+		if ev.AttachReadings && !ev.Recovery && len(ev.History) > 0 {
+			data, err := readingsCSV(ev.History)
+			if err != nil {
+				return fmt.Errorf("unable to write the readings of sensor %s: %v", ev.Sensor.ID, err)
+			}
+			d.attachments = append(d.attachments, Attachment{Filename: "readings-" + ev.Sensor.ID + ".csv", ContentType: "text/csv", Data: data})
+		}
+	}
+	if events[0].Key != "" {
+		d.key = hex.EncodeToString(h.Sum(nil))[:32]
+	}
+	id, err := sendDigest(ctx, e.templates, e.links, t, d)
+	for i := range events {
+		events[i].MessageID = id
+	}
+	return err
+}
+
+// incidentMessageID is the Message-ID of the first mail about an incident of the sensor,
+// the following mails refer to it so mail clients show them as one thread.
+func incidentMessageID(s Sensor, domain string) string {
+	if s.Incident == nil {
+		return ""
+	}
+	return fmt.Sprintf("<incident.%s.%d@%s>", s.ID, s.Incident.Started.Unix(), domain)
+}
+
+// sendDigest mails the digest rendered with the templates and returns the ID the provider gave the mail.
+// Its links and reply address are signed with links, when it is set.
+func sendDigest(ctx context.Context, templates *templateSet, links *linkSigner, t *tenant, d digest) (string, error) {
+	msg, err := templates.render(d, t, links)
+	if err != nil {
+		return "", fmt.Errorf("unable to render alarm mail: %v", err)
+	}
+	m := t.message(d.recipient, msg.subject, msg.text)
+	m.HTML = msg.html
+	m.Inline = msg.inline
+	m.Attachments = d.attachments
+	// the events of the provider name the sensors, see mailgunEvents
+	var ids, documents []string
+	for _, st := range d.sections {
+		ids = append(ids, st.sensor.ID)
+		documents = append(documents, st.sensor.DocumentID)
+	}
+	m.Variables = map[string]string{"sensors": strings.Join(ids, ",")}
+	if token := links.replyToken(documents, d.recipient); token != "" && m.ReplyTo != "" {
+		m.ReplyTo = replyAddress(m.ReplyTo, token)
+	}
+	switch {
+	case d.root != "":
+		m.MessageID = d.root
+	case d.key != "":
+		m.MessageID = "<" + d.key + "@" + messageDomain(t.from) + ">"
+	}
+	m.References = d.threads
+	if len(m.References) > 0 {
+		m.InReplyTo = m.References[0]
+	}
+	if msg.unsubscribe != "" {
+		// RFC 8058 one-click unsubscribe
+		m.Headers = map[string]string{
+			"List-Unsubscribe":      "<" + msg.unsubscribe + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+	return t.mailer.Send(ctx, m)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestDigests(t *testing.T) {
+	var d digests
+	d.add(sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "a@example.com"}})
+	d.add(sensorStatus{sensor: Sensor{ID: "2", Owner: "b@example.com"}})
+	d.add(sensorStatus{sensor: Sensor{ID: "3", EmailAddress: "a@example.com"}})
+
+	want := []digest{
+		{
+			recipient: "a@example.com",
+			sections: []sensorStatus{
+				{sensor: Sensor{ID: "1", EmailAddress: "a@example.com"}},
+				{sensor: Sensor{ID: "3", EmailAddress: "a@example.com"}},
+			},
+		},
+		{
+			recipient: "b@example.com",
+			sections: []sensorStatus{
+				{sensor: Sensor{ID: "2", Owner: "b@example.com"}},
+			},
+		},
+	}
+
+	if diff := deep.Equal(d.all(), want); diff != nil {
+		t.Errorf("grouping failed: %v", diff)
+	}
+}
+
+func TestComposeDigest(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single := digest{sections: []sensorStatus{
+		{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}, reading: Reading{Date: testDate}},
+	}}
+	multiple := digest{sections: []sensorStatus{
+		{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}, reading: Reading{Date: testDate}},
+		{sensor: Sensor{ID: "456", Alarms: Alarm{LowVoltage: testDate, GpsMissing: testDate}}, reading: Reading{Date: testDate, Voltage: 3.2}},
+	}}
+
+	tests := []struct {
+		name        string
+		digest      digest
+		lang        string
+		loc         *time.Location
+		wantSubject string
+		want        string
+	}{
+		{
+			name:        "single sensor uses the regular mail",
+			digest:      single,
+			lang:        "en",
+			loc:         time.UTC,
+			wantSubject: "Issues with Meet je stad sensor 123",
+			want:        fixture("offline"),
+		},
+		{
+			name:        "multiple sensors get a section each",
+			digest:      multiple,
+			lang:        "en",
+			loc:         time.UTC,
+			wantSubject: "Issues with 2 of your Meet je stad sensors",
+			want:        fixture("digest"),
+		},
+		{
+			name:        "dutch in local time",
+			digest:      multiple,
+			lang:        "nl",
+			loc:         amsterdam,
+			wantSubject: "Problemen met 2 van je Meet je stad-sensoren",
+			want:        fixture("digest.nl"),
+		},
+	}
+
+	for _, tt := range tests {
+		msg, err := testTemplates.renderIn(tt.digest, testTenant, nil, tt.lang, tt.loc)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tt.name, err)
+		}
+		if msg.subject != tt.wantSubject {
+			t.Errorf("%s failed: subject %q != %q", tt.name, msg.subject, tt.wantSubject)
+		}
+		if diff := deep.Equal(msg.text, tt.want); diff != nil {
+			t.Errorf("%s failed: %v", tt.name, diff)
+		}
+		if !strings.Contains(msg.html, "Sensor 456") && len(tt.digest.sections) > 1 {
+			t.Errorf("%s failed: html is missing sensor section", tt.name)
+		}
+	}
+}
+
+func TestEmailThreads(t *testing.T) {
+	mailer := mailerMock{}
+	e := emailNotifier{tenants: &tenants{fallback: &tenant{mailer: &mailer, from: "alert@monitoring.meetjescraper.online"}}, templates: testTemplates}
+	events := []AlarmEvent{
+		{Sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}, Incident: &Incident{Started: testDate}}, Key: "a"},
+		{Sensor: Sensor{ID: "2", Alarms: Alarm{Offline: testDate}}, Key: "b"},
+	}
+	if err := e.Notify(context.Background(), Channel{Type: "email", Target: "owner@example.com"}, events); err != nil {
+		t.Fatal(err)
+	}
+	// a retry of the delivery is the same mail
+	if err := e.Notify(context.Background(), Channel{Type: "email", Target: "owner@example.com"}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := mailer.sent[0]
+	root := "<incident.1.1562195565@monitoring.meetjescraper.online>"
+	if msg.InReplyTo != root || len(msg.References) != 1 || msg.References[0] != root {
+		t.Errorf("expected the mail to refer to the incident, got %q and %q", msg.InReplyTo, msg.References)
+	}
+	if !strings.HasSuffix(msg.MessageID, "@monitoring.meetjescraper.online>") || msg.MessageID != mailer.sent[1].MessageID {
+		t.Errorf("expected the same Message-ID for every attempt, got %q and %q", msg.MessageID, mailer.sent[1].MessageID)
+	}
+	if events[0].MessageID != "<2@mock>" || events[1].MessageID != "<2@mock>" {
+		t.Errorf("expected the ID of the mailer on the events, got %+v", events)
+	}
+}
+
+func TestEmailThreadRoot(t *testing.T) {
+	mailer := mailerMock{}
+	e := emailNotifier{tenants: &tenants{fallback: &tenant{mailer: &mailer, from: "alert@monitoring.meetjescraper.online"}}, templates: testTemplates}
+	channel := Channel{Type: "email", Target: "owner@example.com"}
+	root := "<incident.1.1562195565@monitoring.meetjescraper.online>"
+
+	first := []AlarmEvent{
+		{Sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}, Incident: &Incident{Started: testDate}}, Key: "a", Opens: true},
+		{Sensor: Sensor{ID: "2", Alarms: Alarm{Offline: testDate}, Incident: &Incident{Started: testDate}}, Key: "b", Opens: true},
+	}
+	if err := e.Notify(context.Background(), channel, first); err != nil {
+		t.Fatal(err)
+	}
+	if msg := mailer.sent[0]; msg.MessageID != root || msg.InReplyTo != "" || len(msg.References) != 0 {
+		t.Errorf("expected the first mail to carry the incident's Message-ID, got %q, %q and %q", msg.MessageID, msg.InReplyTo, msg.References)
+	}
+	if first[0].Thread != root || first[1].Thread != root {
+		t.Errorf("expected the mail to start the thread of both incidents, got %+v", first)
+	}
+
+	recovery := []AlarmEvent{
+		{Sensor: Sensor{ID: "2", Incident: &Incident{Started: testDate, Resolved: testDate}}, Key: "c", Recovery: true, Thread: first[1].Thread},
+	}
+	if err := e.Notify(context.Background(), channel, recovery); err != nil {
+		t.Fatal(err)
+	}
+	if msg := mailer.sent[1]; msg.MessageID == root || msg.InReplyTo != root || len(msg.References) != 1 {
+		t.Errorf("expected the recovery to refer to the first mail, got %q, %q and %q", msg.MessageID, msg.InReplyTo, msg.References)
+	}
+}
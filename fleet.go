@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultOfflineDays = 7
+
+// fleetSnapshot is the state of the whole network at the time of a fleet report.
+// It is stored so the next report can show what changed.
+type fleetSnapshot struct {
+	Taken         time.Time      `firestore:"taken"`
+	Sensors       []string       `firestore:"sensors"`
+	Offline       int            `firestore:"offline"`
+	LowBattery    int            `firestore:"low_battery"`
+	AverageHealth int            `firestore:"average_health"`
+	Firmware      map[string]int `firestore:"firmware"`
+}
+
+type snapshotStore interface {
+	Load(ctx context.Context) (fleetSnapshot, error)
+	Save(ctx context.Context, s fleetSnapshot) error
+}
+
+// fleetReport is the overview of the network sent to the admins.
+type fleetReport struct {
+	current    fleetSnapshot
+	previous   fleetSnapshot
+	offline    []sensorStatus
+	lowBattery []sensorStatus
+	unread     []string // could not be read in this check
+	added      []string
+	retired    []string
+}
+
+// buildFleetReport compares the network with the previous snapshot. Sensors that could
+// not be read are kept in the snapshot, so they do not show up as retired and new again.
+func buildFleetReport(statuses []sensorStatus, unread []string, previous fleetSnapshot, offlineDays int, now time.Time) fleetReport {
+	report := fleetReport{
+		previous: previous,
+		current: fleetSnapshot{
+			Taken:    now,
+			Firmware: make(map[string]int),
+		},
+	}
+
+	var healthTotal int
+	seen := make(map[string]bool)
+	for _, st := range statuses {
+		// several subscriptions can watch the same sensor
+		if seen[st.sensor.ID] {
+			continue
+		}
+		seen[st.sensor.ID] = true
+		report.current.Sensors = append(report.current.Sensors, st.sensor.ID)
+		report.current.Firmware[orUnknown(st.reading.Firmware)]++
+		healthTotal += st.sensor.Health.Score
+
+		if now.Sub(st.reading.Date) > time.Duration(offlineDays)*24*time.Hour {
+			report.offline = append(report.offline, st)
+			continue
+		}
+		threshold := st.sensor.Threshold
+		if threshold == 0 {
+			threshold = 3.26 // default
+		}
+		if st.reading.Voltage < threshold {
+			report.lowBattery = append(report.lowBattery, st)
+		}
+	}
+
+	read := len(report.current.Sensors)
+	for _, id := range unread {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		report.unread = append(report.unread, id)
+		report.current.Sensors = append(report.current.Sensors, id)
+	}
+
+	sort.Strings(report.current.Sensors)
+	sort.Strings(report.unread)
+	report.current.Offline = len(report.offline)
+	report.current.LowBattery = len(report.lowBattery)
+	if read > 0 {
+		report.current.AverageHealth = healthTotal / read
+	}
+
+	if !previous.Taken.IsZero() {
+		report.added = difference(report.current.Sensors, previous.Sensors)
+		report.retired = difference(previous.Sensors, report.current.Sensors)
+	}
+
+	return report
+}
+
+// difference returns the elements of a that are not in b.
+func difference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	var res []string
+	for _, s := range a {
+		if !in[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// sendFleetReport mails the fleet report to the admins. The snapshot is saved once an admin
+// got the report, otherwise the next report compares to the same snapshot.
+func sendFleetReport(ctx context.Context, t *tenant, store snapshotStore, admins []string, offlineDays int, statuses []sensorStatus, unread []string) error {
+	if offlineDays == 0 {
+		offlineDays = defaultOfflineDays
+	}
+
+	previous, err := store.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to load previous fleet snapshot: %v", err)
+	}
+
+	report := buildFleetReport(statuses, unread, previous, offlineDays, nowFunc())
+	body := composeFleetReport(report, offlineDays, t)
+	sent := 0
+	for _, to := range admins {
+		if _, err := t.mailer.Send(ctx, t.message(to, "Meet je stad fleet report", body)); err != nil {
+			log.Printf("failed to send fleet report to %s: %v", to, err)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return fmt.Errorf("fleet report not sent, keeping the previous snapshot")
+	}
+
+	return store.Save(ctx, report.current)
+}
+
+func composeFleetReport(r fleetReport, offlineDays int, t *tenant) string {
+	sb := strings.Builder{}
+	sb.WriteString("Hi,\n\n")
+	sb.WriteString("This is the overview of the Meet je stad network.\n")
+	if !r.previous.Taken.IsZero() {
+		sb.WriteString(fmt.Sprintf("Changes are compared to the report of %s.\n", r.previous.Taken.Format(time.RFC822)))
+	}
+	sb.WriteString("\n")
+
+	sb.WriteString(fmt.Sprintf("Stations:       %d%s\n", len(r.current.Sensors), change(r, len(r.current.Sensors), len(r.previous.Sensors))))
+	sb.WriteString(fmt.Sprintf("Offline:        %d%s\n", r.current.Offline, change(r, r.current.Offline, r.previous.Offline)))
+	sb.WriteString(fmt.Sprintf("Low battery:    %d%s\n", r.current.LowBattery, change(r, r.current.LowBattery, r.previous.LowBattery)))
+	sb.WriteString(fmt.Sprintf("Average health: %d%s\n", r.current.AverageHealth, change(r, r.current.AverageHealth, r.previous.AverageHealth)))
+
+	sb.WriteString(fmt.Sprintf("\nOffline for more than %d days:\n", offlineDays))
+	writeList(&sb, r.offline, func(st sensorStatus) string {
+		if st.reading.Date.IsZero() {
+			return fmt.Sprintf("%s (never seen)", st.sensor.ID)
+		}
+		return fmt.Sprintf("%s (last seen %s)", st.sensor.ID, st.reading.Date.Format(time.RFC822))
+	})
+
+	if len(r.unread) > 0 {
+		sb.WriteString("\nCould not be read in this check:\n")
+		writeIDs(&sb, r.unread)
+	}
+
+	sb.WriteString("\nLow battery:\n")
+	writeList(&sb, r.lowBattery, func(st sensorStatus) string {
+		return fmt.Sprintf("%s (%.2fV)", st.sensor.ID, st.reading.Voltage)
+	})
+
+	sb.WriteString("\nFirmware:\n")
+	var versions []string
+	for v := range r.current.Firmware {
+		versions = append(versions, v)
+	}
+	for v := range r.previous.Firmware {
+		if _, ok := r.current.Firmware[v]; !ok {
+			versions = append(versions, v)
+		}
+	}
+	sort.Strings(versions)
+	for _, v := range versions {
+		sb.WriteString(fmt.Sprintf("* %s: %d%s\n", v, r.current.Firmware[v], change(r, r.current.Firmware[v], r.previous.Firmware[v])))
+	}
+
+	if !r.previous.Taken.IsZero() {
+		sb.WriteString("\nNew stations:\n")
+		writeIDs(&sb, r.added)
+		sb.WriteString("\nRetired stations:\n")
+		writeIDs(&sb, r.retired)
+	}
+
+	sb.WriteString(t.signatureBlock())
+
+	return sb.String()
+}
+
+// change formats the difference with the previous report, if there is one.
+func change(r fleetReport, current, previous int) string {
+	if r.previous.Taken.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(" (%+d)", current-previous)
+}
+
+func writeList(sb *strings.Builder, statuses []sensorStatus, line func(sensorStatus) string) {
+	if len(statuses) == 0 {
+		sb.WriteString("* none\n")
+	}
+	for _, st := range statuses {
+		sb.WriteString("* " + line(st) + "\n")
+	}
+}
+
+func writeIDs(sb *strings.Builder, ids []string) {
+	if len(ids) == 0 {
+		sb.WriteString("* none\n")
+	}
+	for _, id := range ids {
+		sb.WriteString("* " + id + "\n")
+	}
+}
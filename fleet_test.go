@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestBuildFleetReport(t *testing.T) {
+	statuses := []sensorStatus{
+		{sensor: Sensor{ID: "1", Health: Health{Score: 90}}, reading: Reading{Date: testDate, Voltage: 3.6, Firmware: "v3"}},
+		{sensor: Sensor{ID: "1", Health: Health{Score: 90}}, reading: Reading{Date: testDate, Voltage: 3.6, Firmware: "v3"}},
+		{sensor: Sensor{ID: "2", Health: Health{Score: 40}}, reading: Reading{Date: testDate, Voltage: 3.1, Firmware: "v3"}},
+		{sensor: Sensor{ID: "3", Health: Health{Score: 20}}, reading: Reading{Date: testDate.Add(-8 * 24 * time.Hour), Voltage: 3.0}},
+	}
+	previous := fleetSnapshot{
+		Taken:         testDate.Add(-7 * 24 * time.Hour),
+		Sensors:       []string{"1", "3", "4"},
+		Offline:       0,
+		LowBattery:    2,
+		AverageHealth: 60,
+		Firmware:      map[string]int{"v2": 2, "v3": 1},
+	}
+
+	report := buildFleetReport(statuses, nil, previous, 7, testDate)
+
+	want := fleetSnapshot{
+		Taken:         testDate,
+		Sensors:       []string{"1", "2", "3"},
+		Offline:       1,
+		LowBattery:    1,
+		AverageHealth: 50,
+		Firmware:      map[string]int{"v3": 2, "unknown": 1},
+	}
+	if diff := deep.Equal(report.current, want); diff != nil {
+		t.Errorf("snapshot failed: %v", diff)
+	}
+	if diff := deep.Equal(report.added, []string{"2"}); diff != nil {
+		t.Errorf("new stations failed: %v", diff)
+	}
+	if diff := deep.Equal(report.retired, []string{"4"}); diff != nil {
+		t.Errorf("retired stations failed: %v", diff)
+	}
+
+	if diff := deep.Equal(composeFleetReport(report, 7, testTenant), fixture("fleet-report")); diff != nil {
+		t.Errorf("compose failed: %v", diff)
+	}
+}
+
+func TestBuildFleetReportUnread(t *testing.T) {
+	statuses := []sensorStatus{
+		{sensor: Sensor{ID: "1", Health: Health{Score: 90}}, reading: Reading{Date: testDate, Voltage: 3.6, Firmware: "v3"}},
+	}
+	previous := fleetSnapshot{Taken: testDate.Add(-7 * 24 * time.Hour), Sensors: []string{"1", "2"}}
+
+	report := buildFleetReport(statuses, []string{"2"}, previous, 7, testDate)
+
+	if diff := deep.Equal(report.current.Sensors, []string{"1", "2"}); diff != nil {
+		t.Errorf("expected the unread sensor to stay in the snapshot: %v", diff)
+	}
+	if report.retired != nil || report.added != nil || report.current.AverageHealth != 90 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if diff := deep.Equal(report.unread, []string{"2"}); diff != nil {
+		t.Errorf("unread failed: %v", diff)
+	}
+}
+
+// snapshotMock keeps the saved snapshot in memory.
+type snapshotMock struct {
+	saved *fleetSnapshot
+}
+
+func (s *snapshotMock) Load(ctx context.Context) (fleetSnapshot, error) {
+	return fleetSnapshot{}, nil
+}
+
+func (s *snapshotMock) Save(ctx context.Context, snapshot fleetSnapshot) error {
+	s.saved = &snapshot
+	return nil
+}
+
+func TestSendFleetReport(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+	statuses := []sensorStatus{
+		{sensor: Sensor{ID: "1"}, reading: Reading{Date: testDate, Voltage: 3.6}},
+	}
+
+	tests := []struct {
+		name     string
+		mailErr  error
+		wantErr  bool
+		wantSave bool
+	}{
+		{name: "saves the snapshot after sending", wantSave: true},
+		{name: "keeps the previous snapshot when nothing was sent", mailErr: errors.New("test error"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		store := &snapshotMock{}
+		tn := &tenant{mailer: &mailerMock{err: tt.mailErr}, from: "alert@monitoring.meetjescraper.online"}
+		err := sendFleetReport(context.Background(), tn, store, []string{"admin@example.com"}, 7, statuses, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if (store.saved != nil) != tt.wantSave {
+			t.Errorf("%s: saved %v", tt.name, store.saved)
+		}
+	}
+}
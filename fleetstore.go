@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SnapshotDocument stores the latest fleet snapshot in a single Firestore document.
+type SnapshotDocument struct {
+	doc *firestore.DocumentRef
+}
+
+func (s *SnapshotDocument) Load(ctx context.Context) (fleetSnapshot, error) {
+	var snapshot fleetSnapshot
+	doc, err := s.doc.Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return snapshot, nil
+		}
+		return snapshot, err
+	}
+	if err := doc.DataTo(&snapshot); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+func (s *SnapshotDocument) Save(ctx context.Context, snapshot fleetSnapshot) error {
+	_, err := s.doc.Set(ctx, snapshot)
+	return err
+}
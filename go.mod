@@ -5,7 +5,7 @@ go 1.12
 require (
 	cloud.google.com/go v0.40.0
 	firebase.google.com/go v3.8.1+incompatible
-	github.com/go-chi/chi v4.0.2+incompatible // indirect
+	github.com/go-chi/chi v4.0.2+incompatible
 	github.com/go-test/deep v1.0.1
 	github.com/golang/mock v1.3.1 // indirect
 	github.com/google/btree v1.0.0 // indirect
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// historyLimit is the number of readings fetched to judge a sensor's health.
+	historyLimit = 200
+	// healthWindow is how far back readings are taken into account.
+	healthWindow = 24 * time.Hour
+	// voltageMargin is the margin above the threshold that gives a full voltage score.
+	voltageMargin = 0.5
+)
+
+// Health is a score from 0 to 100 summarising how well a sensor is doing.
+// The components are kept so the score can be explained to the owner.
+type Health struct {
+	Score      int              `firestore:"score"`
+	Components HealthComponents `firestore:"components"`
+	Computed   time.Time        `firestore:"computed"`
+}
+
+// HealthComponents holds the individual scores, each 0-100, that make up the health score.
+// Link is -1 when the readings carry no radio metadata, it is then left out of the score.
+type HealthComponents struct {
+	Voltage int `firestore:"voltage"`
+	Uptime  int `firestore:"uptime"`
+	GPS     int `firestore:"gps"`
+	Link    int `firestore:"link"`
+	Sanity  int `firestore:"sanity"`
+}
+
+// healthWeights decide how much each component counts towards the total score.
+var healthWeights = HealthComponents{
+	Voltage: 30,
+	Uptime:  30,
+	GPS:     15,
+	Link:    15,
+	Sanity:  10,
+}
+
+func computeHealth(s Sensor, r Reading, history []Reading, now time.Time) Health {
+	var recent []Reading
+	for _, h := range history {
+		if now.Sub(h.Date) <= healthWindow {
+			recent = append(recent, h)
+		}
+	}
+
+	c := HealthComponents{
+		Voltage: voltageScore(s, r),
+		Uptime:  uptimeScore(recent, now),
+		GPS:     gpsScore(recent),
+		Link:    linkScore(recent),
+		Sanity:  sanityScore(recent, now),
+	}
+
+	total := c.Voltage*healthWeights.Voltage +
+		c.Uptime*healthWeights.Uptime +
+		c.GPS*healthWeights.GPS +
+		c.Sanity*healthWeights.Sanity
+	weights := healthWeights.Voltage + healthWeights.Uptime + healthWeights.GPS + healthWeights.Sanity
+	if c.Link >= 0 {
+		total += c.Link * healthWeights.Link
+		weights += healthWeights.Link
+	}
+
+	return Health{
+		Score:      (total + weights/2) / weights,
+		Components: c,
+		Computed:   now,
+	}
+}
+
+func voltageScore(s Sensor, r Reading) int {
+	if r.Date.IsZero() {
+		return 0
+	}
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = 3.26 // default
+	}
+	margin := float64(r.Voltage - threshold)
+	return percentage(margin / voltageMargin)
+}
+
+// uptimeScore is the share of hours in the window in which the sensor sent at least one message.
+func uptimeScore(readings []Reading, now time.Time) int {
+	return uptime(readings, now.Add(-healthWindow), now)
+}
+
+// uptime is the share of hours between start and end in which the sensor sent at least one message.
+func uptime(readings []Reading, start, end time.Time) int {
+	hours := int(end.Sub(start).Hours())
+	if hours <= 0 {
+		return 0
+	}
+	seen := make(map[int]bool, hours)
+	for _, r := range readings {
+		h := int(end.Sub(r.Date).Hours())
+		if h >= 0 && h < hours {
+			seen[h] = true
+		}
+	}
+	return percentage(float64(len(seen)) / float64(hours))
+}
+
+func gpsScore(readings []Reading) int {
+	if len(readings) == 0 {
+		return 0
+	}
+	var fixes int
+	for _, r := range readings {
+		if r.Position.Lat != 0 || r.Position.Lng != 0 {
+			fixes++
+		}
+	}
+	return percentage(float64(fixes) / float64(len(readings)))
+}
+
+// linkScore maps the average RSSI onto a score, -120 dBm being unusable and -70 dBm excellent.
+func linkScore(readings []Reading) int {
+	var sum float64
+	var n int
+	for _, r := range readings {
+		if r.RSSI != 0 {
+			sum += float64(r.RSSI)
+			n++
+		}
+	}
+	if n == 0 {
+		return -1
+	}
+	return percentage((sum/float64(n) + 120) / 50)
+}
+
+func sanityScore(readings []Reading, now time.Time) int {
+	if len(readings) == 0 {
+		return 0
+	}
+	var sane int
+	for _, r := range readings {
+		if plausible(r, now) {
+			sane++
+		}
+	}
+	return percentage(float64(sane) / float64(len(readings)))
+}
+
+func plausible(r Reading, now time.Time) bool {
+	if r.Voltage < 2.5 || r.Voltage > 5 {
+		return false
+	}
+	if r.Date.IsZero() || r.Date.After(now.Add(10*time.Minute)) {
+		return false
+	}
+	if r.Position.Lat < -90 || r.Position.Lat > 90 || r.Position.Lng < -180 || r.Position.Lng > 180 {
+		return false
+	}
+	return true
+}
+
+func percentage(f float64) int {
+	if f <= 0 {
+		return 0
+	}
+	if f >= 1 {
+		return 100
+	}
+	return int(f*100 + 0.5)
+}
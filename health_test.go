@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestComputeHealth(t *testing.T) {
+	now := time.Date(2019, 7, 3, 23, 12, 45, 123, time.UTC)
+	okPos := Position{Lat: 52.1, Lng: 5.1}
+
+	hourly := func(n int, r Reading) []Reading {
+		res := make([]Reading, n)
+		for i := range res {
+			res[i] = r
+			res[i].Date = now.Add(-time.Duration(i) * time.Hour)
+		}
+		return res
+	}
+
+	type args struct {
+		sensor  Sensor
+		reading Reading
+		history []Reading
+	}
+
+	tests := []struct {
+		name string
+		args args
+		want Health
+	}{
+		{
+			name: "no data gives zero score",
+			args: args{sensor: Sensor{Threshold: 3}},
+			want: Health{
+				Components: HealthComponents{Link: -1},
+				Computed:   now,
+			},
+		},
+		{
+			name: "healthy sensor without radio metadata",
+			args: args{
+				sensor:  Sensor{Threshold: 3},
+				reading: Reading{Date: now, Voltage: 3.6, Position: okPos},
+				history: hourly(24, Reading{Voltage: 3.6, Position: okPos}),
+			},
+			want: Health{
+				Score:      100,
+				Components: HealthComponents{Voltage: 100, Uptime: 100, GPS: 100, Link: -1, Sanity: 100},
+				Computed:   now,
+			},
+		},
+		{
+			name: "half the day offline without gps",
+			args: args{
+				sensor:  Sensor{Threshold: 3},
+				reading: Reading{Date: now, Voltage: 3.25},
+				history: hourly(12, Reading{Voltage: 3.25, RSSI: -95}),
+			},
+			want: Health{
+				Score:      48,
+				Components: HealthComponents{Voltage: 50, Uptime: 50, GPS: 0, Link: 50, Sanity: 100},
+				Computed:   now,
+			},
+		},
+		{
+			name: "ignores readings outside the window",
+			args: args{
+				sensor:  Sensor{Threshold: 3},
+				reading: Reading{Date: now, Voltage: 2.9, Position: okPos},
+				history: hourly(48, Reading{Voltage: 2.9, Position: okPos}),
+			},
+			want: Health{
+				Score:      65,
+				Components: HealthComponents{Voltage: 0, Uptime: 100, GPS: 100, Link: -1, Sanity: 100},
+				Computed:   now,
+			},
+		},
+		{
+			name: "implausible voltages lower sanity",
+			args: args{
+				sensor:  Sensor{Threshold: 3},
+				reading: Reading{Date: now, Voltage: 3.5, Position: okPos},
+				history: append(hourly(12, Reading{Voltage: 3.5, Position: okPos}), hourly(12, Reading{Voltage: 0.1, Position: okPos})...),
+			},
+			want: Health{
+				Score:      76,
+				Components: HealthComponents{Voltage: 100, Uptime: 50, GPS: 100, Link: -1, Sanity: 50},
+				Computed:   now,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		res := computeHealth(tt.args.sensor, tt.args.reading, tt.args.history, now)
+		if diff := deep.Equal(res, tt.want); diff != nil {
+			t.Errorf("%s failed: %v", tt.name, diff)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Steps of an incident.
+const (
+	stepRaised       = "raised"
+	stepAcknowledged = "acknowledged"
+	stepEscalated    = "escalated"
+	stepResolved     = "resolved"
+)
+
+var (
+	errNoIncident   = errors.New("the sensor has no alarms")
+	errAcknowledged = errors.New("the alarms are acknowledged already")
+)
+
+// open tells whether the incident has not been resolved.
+func (i *Incident) open() bool {
+	return i != nil && i.Resolved.IsZero()
+}
+
+// acknowledged tells whether the alarms of an open incident are acknowledged.
+func (i *Incident) acknowledged() bool {
+	return i.open() && !i.Acknowledged.IsZero()
+}
+
+func (i *Incident) record(step, detail string, now time.Time) {
+	i.Steps = append(i.Steps, IncidentStep{Time: now, Action: step, Detail: detail})
+}
+
+// trackIncident starts an incident when the sensor gets alarms and resolves it when they are gone.
+func (s *Sensor) trackIncident(now time.Time) {
+	alarms := findings(s.Alarms)
+	switch {
+	case len(alarms) > 0 && !s.Incident.open():
+		var types []string
+		for _, f := range alarms {
+			types = append(types, f.Type)
+		}
+		s.Incident = &Incident{Started: now}
+		s.Incident.record(stepRaised, strings.Join(types, ", "), now)
+	case len(alarms) == 0 && s.Incident.open():
+		s.Incident.Resolved = now
+		s.Incident.record(stepResolved, "", now)
+	}
+}
+
+// acknowledge acknowledges the alarms of the open incident. A started time other than
+// zero has to match the incident's to the second, so an old link does not acknowledge a new incident.
+func (s *Sensor) acknowledge(started time.Time, by string, now time.Time) error {
+	if !s.Incident.open() || (!started.IsZero() && started.Unix() != s.Incident.Started.Unix()) {
+		return errNoIncident
+	}
+	if s.Incident.acknowledged() {
+		return errAcknowledged
+	}
+	s.Incident.Acknowledged = now
+	s.Incident.record(stepAcknowledged, by, now)
+	return nil
+}
+
+// escalationDue tells whether the alarms of the sensor went unacknowledged for too long
+// and should go to its escalation channels.
+func (s Sensor) escalationDue(after time.Duration, now time.Time) bool {
+	return after > 0 && len(s.Escalation) > 0 && s.Incident.open() &&
+		s.Incident.Acknowledged.IsZero() && s.Incident.Escalated.IsZero() &&
+		now.Sub(s.Incident.Started) >= after
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestTrackIncident(t *testing.T) {
+	earlier := testDate.Add(-time.Hour)
+	open := &Incident{Started: earlier, Steps: []IncidentStep{{Time: earlier, Action: stepRaised, Detail: AlarmOffline}}}
+
+	tests := []struct {
+		name     string
+		alarms   Alarm
+		incident *Incident
+		want     *Incident
+	}{
+		{
+			name:   "starts an incident",
+			alarms: Alarm{Offline: testDate, GpsMissing: testDate},
+			want:   &Incident{Started: testDate, Steps: []IncidentStep{{Time: testDate, Action: stepRaised, Detail: "offline, gps"}}},
+		},
+		{
+			name:     "keeps the open incident",
+			alarms:   Alarm{LowVoltage: testDate},
+			incident: open,
+			want:     open,
+		},
+		{
+			name:     "resolves the incident",
+			incident: open,
+			want: &Incident{Started: earlier, Resolved: testDate, Steps: []IncidentStep{
+				{Time: earlier, Action: stepRaised, Detail: AlarmOffline},
+				{Time: testDate, Action: stepResolved},
+			}},
+		},
+		{
+			name:     "starts a new incident after one is resolved",
+			alarms:   Alarm{Offline: testDate},
+			incident: &Incident{Started: earlier, Resolved: earlier},
+			want:     &Incident{Started: testDate, Steps: []IncidentStep{{Time: testDate, Action: stepRaised, Detail: AlarmOffline}}},
+		},
+		{
+			name: "no alarms, no incident",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Sensor{Alarms: tt.alarms}
+			if tt.incident != nil {
+				incident := *tt.incident
+				incident.Steps = append([]IncidentStep(nil), tt.incident.Steps...)
+				s.Incident = &incident
+			}
+			s.trackIncident(testDate)
+			if diff := deep.Equal(s.Incident, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	started := testDate.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		incident *Incident
+		started  time.Time
+		wantErr  error
+	}{
+		{name: "acknowledges", incident: &Incident{Started: started}},
+		{name: "acknowledges the incident of the link", incident: &Incident{Started: started}, started: time.Unix(started.Unix(), 0)},
+		{name: "link for another incident", incident: &Incident{Started: started}, started: started.Add(-time.Hour), wantErr: errNoIncident},
+		{name: "no incident", wantErr: errNoIncident},
+		{name: "resolved", incident: &Incident{Started: started, Resolved: testDate}, wantErr: errNoIncident},
+		{name: "twice", incident: &Incident{Started: started, Acknowledged: started}, wantErr: errAcknowledged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Sensor{Incident: tt.incident}
+			if err := s.acknowledge(tt.started, "owner", testDate); err != tt.wantErr {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			want := []IncidentStep{{Time: testDate, Action: stepAcknowledged, Detail: "owner"}}
+			if diff := deep.Equal(s.Incident.Steps, want); diff != nil || !s.Incident.Acknowledged.Equal(testDate) {
+				t.Errorf("expected the acknowledgement to be recorded, got %+v", s.Incident)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const limitWindow = 24 * time.Hour
+
+// Reasons for holding back a notification.
+const (
+	heldQuietHours = "quiet hours"
+	heldRateLimit  = "rate limit"
+)
+
+// sendLog holds when messages were sent in the last day, per target and per channel of a subscription.
+type sendLog struct {
+	sent map[string][]time.Time
+}
+
+func newSendLog(ctx context.Context, o outbox, now time.Time) (*sendLog, error) {
+	l := sendLog{sent: make(map[string][]time.Time)}
+	notifications, err := o.SentSince(ctx, now.Add(-limitWindow))
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notifications {
+		if n.Admin {
+			continue
+		}
+		// notifications sent together went out in one message
+		key := channelKey(n.Channel)
+		l.record(key, n.Sent)
+		l.record(n.Document+"\x00"+key, n.Sent)
+	}
+	return &l, nil
+}
+
+func (l *sendLog) record(key string, t time.Time) {
+	if l.sent == nil {
+		l.sent = make(map[string][]time.Time)
+	}
+	for _, s := range l.sent[key] {
+		if s.Equal(t) {
+			return
+		}
+	}
+	l.sent[key] = append(l.sent[key], t)
+}
+
+// limited tells whether max messages were sent for the key in the last day,
+// and if so when the next one may be sent.
+func (l *sendLog) limited(key string, max int, now time.Time) (time.Time, bool) {
+	if max <= 0 {
+		return time.Time{}, false
+	}
+	var count int
+	var oldest time.Time
+	for _, t := range l.sent[key] {
+		if now.Sub(t) >= limitWindow {
+			continue
+		}
+		count++
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if count < max {
+		return time.Time{}, false
+	}
+	return oldest.Add(limitWindow), true
+}
+
+// holdBack tells whether a notification for a sensor's channel has to wait, why and until when.
+// Non-critical alarms and recoveries wait for the end of the quiet hours of the sensor.
+// Notifications for channels that reached their daily limit wait until a message may be sent.
+// The quiet hours of sensors without a time zone are in the given location.
+func holdBack(n *notification, s *Sensor, l *sendLog, location *time.Location, now time.Time) (string, time.Time) {
+	if n.Admin || s == nil {
+		return "", time.Time{}
+	}
+	if n.Event.Recovery || n.Event.Severity < SeverityCritical {
+		if end, ok := s.QuietHours.end(now, sensorLocation(*s, location)); ok {
+			return heldQuietHours, end
+		}
+	}
+	key := channelKey(n.Channel)
+	if j := findChannel(*s, key); j >= 0 {
+		if until, ok := l.limited(n.Document+"\x00"+key, s.Channels[j].MaxPerDay, now); ok {
+			return heldRateLimit, until
+		}
+	}
+	return "", time.Time{}
+}
+
+// end returns the end of the quiet hours when the moment is within them.
+func (q QuietHours) end(now time.Time, loc *time.Location) (time.Time, bool) {
+	if q.Start == "" || q.End == "" {
+		return time.Time{}, false
+	}
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err1 != nil || err2 != nil || start == end {
+		return time.Time{}, false
+	}
+
+	local := now.In(loc)
+	clock := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	at := func(days int) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+days, int(end/time.Hour), int(end%time.Hour/time.Minute), 0, 0, loc)
+	}
+	switch {
+	case start < end && clock >= start && clock < end:
+		return at(0), true
+	case start > end && clock >= start: // the quiet hours continue tomorrow
+		return at(1), true
+	case start > end && clock < end:
+		return at(0), true
+	}
+	return time.Time{}, false
+}
+
+// parseClock parses a time of day like 22:30.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursEnd(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		quiet  QuietHours
+		now    time.Time
+		loc    *time.Location
+		end    time.Time
+		within bool
+	}{
+		{
+			name:  "none",
+			quiet: QuietHours{},
+			now:   time.Date(2019, 7, 3, 23, 0, 0, 0, time.UTC),
+			loc:   time.UTC,
+		},
+		{
+			name:   "same day",
+			quiet:  QuietHours{Start: "12:00", End: "14:00"},
+			now:    time.Date(2019, 7, 3, 13, 0, 0, 0, time.UTC),
+			loc:    time.UTC,
+			end:    time.Date(2019, 7, 3, 14, 0, 0, 0, time.UTC),
+			within: true,
+		},
+		{
+			name:  "after the same day",
+			quiet: QuietHours{Start: "12:00", End: "14:00"},
+			now:   time.Date(2019, 7, 3, 14, 0, 0, 0, time.UTC),
+			loc:   time.UTC,
+		},
+		{
+			name:   "before midnight",
+			quiet:  QuietHours{Start: "22:00", End: "07:00"},
+			now:    time.Date(2019, 7, 3, 23, 12, 0, 0, time.UTC),
+			loc:    time.UTC,
+			end:    time.Date(2019, 7, 4, 7, 0, 0, 0, time.UTC),
+			within: true,
+		},
+		{
+			name:   "after midnight",
+			quiet:  QuietHours{Start: "22:00", End: "07:00"},
+			now:    time.Date(2019, 7, 4, 6, 59, 0, 0, time.UTC),
+			loc:    time.UTC,
+			end:    time.Date(2019, 7, 4, 7, 0, 0, 0, time.UTC),
+			within: true,
+		},
+		{
+			name:  "daytime",
+			quiet: QuietHours{Start: "22:00", End: "07:00"},
+			now:   time.Date(2019, 7, 3, 12, 0, 0, 0, time.UTC),
+			loc:   time.UTC,
+		},
+		{
+			name:   "time zone",
+			quiet:  QuietHours{Start: "22:00", End: "07:00"},
+			now:    time.Date(2019, 7, 3, 20, 30, 0, 0, time.UTC),
+			loc:    amsterdam,
+			end:    time.Date(2019, 7, 4, 5, 0, 0, 0, time.UTC),
+			within: true,
+		},
+		{
+			name:  "invalid",
+			quiet: QuietHours{Start: "late", End: "07:00"},
+			now:   time.Date(2019, 7, 3, 23, 0, 0, 0, time.UTC),
+			loc:   time.UTC,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end, within := tt.quiet.end(tt.now, tt.loc)
+			if within != tt.within || !end.Equal(tt.end) {
+				t.Errorf("expected %v %v, got %v %v", tt.end, tt.within, end, within)
+			}
+		})
+	}
+}
+
+func TestSendLogLimited(t *testing.T) {
+	now := testDate
+	l := sendLog{}
+	l.record("a", now.Add(-25*time.Hour))
+	l.record("a", now.Add(-3*time.Hour))
+	l.record("a", now.Add(-time.Hour))
+	l.record("a", now.Add(-time.Hour)) // sent in the same message
+
+	tests := []struct {
+		name    string
+		key     string
+		max     int
+		until   time.Time
+		limited bool
+	}{
+		{name: "no limit", key: "a", max: 0},
+		{name: "below", key: "a", max: 3},
+		{name: "reached", key: "a", max: 2, until: now.Add(21 * time.Hour), limited: true},
+		{name: "other key", key: "b", max: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until, limited := l.limited(tt.key, tt.max, now)
+			if limited != tt.limited || !until.Equal(tt.until) {
+				t.Errorf("expected %v %v, got %v %v", tt.until, tt.limited, until, limited)
+			}
+		})
+	}
+}
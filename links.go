@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	linkExpiry        = 30 * 24 * time.Hour  // how long the links in a mail work
+	unsubscribeExpiry = 365 * 24 * time.Hour // mail clients may keep the List-Unsubscribe link long
+)
+
+// Actions of signed links.
+const (
+	actionSnooze      = "snooze"
+	actionAck         = "ack"
+	actionUnsubscribe = "unsubscribe"
+	actionVerify      = "verify"
+)
+
+// telegramTokenLength is the longest start parameter of a Telegram deep link.
+const telegramTokenLength = 64
+
+var (
+	errInvalidLink  = errors.New("the link is invalid")
+	errExpiredLink  = errors.New("the link has expired")
+	errInvalidReply = errors.New("the reply address is invalid")
+)
+
+// linkClaims is what a signed link allows to do.
+type linkClaims struct {
+	Action   string   `json:"a"`
+	Sensor   string   `json:"s"`
+	Alarm    string   `json:"t,omitempty"`
+	Incident int64    `json:"i,omitempty"` // start of the incident the link is for, in Unix time
+	Target   string   `json:"r,omitempty"` // address of the subscription
+	Sensors  []string `json:"ss,omitempty"`
+	Expires  int64    `json:"e"`
+	// Document is the document ID of the subscription to Sensor, Documents those of the
+	// subscriptions to Sensors. Links made before they were added change every subscription.
+	Document  string   `json:"d,omitempty"`
+	Documents []string `json:"ds,omitempty"`
+}
+
+// linkSigner signs the claims of links with HMAC-SHA256. A token is the
+// base64 encoded JSON of the claims and the signature, separated by a dot.
+// A nil signer makes no links, for when the links are not configured.
+type linkSigner struct {
+	base   string
+	secret []byte
+}
+
+func newLinkSigner(c HTTPConfig) (*linkSigner, error) {
+	if c.BaseURL == "" || c.SecretPath == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(c.SecretPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read link secret file: %v", err)
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("the link secret is too short, use at least 16 characters")
+	}
+	return &linkSigner{base: strings.TrimSuffix(c.BaseURL, "/"), secret: secret}, nil
+}
+
+// url returns a link to a page of the server with a token for the claims,
+// or nothing when there is no signer. Claims without an expiry expire after linkExpiry.
+func (l *linkSigner) url(path string, c linkClaims, now time.Time) string {
+	if l == nil {
+		return ""
+	}
+	if c.Expires == 0 {
+		c.Expires = now.Add(linkExpiry).Unix()
+	}
+	return l.base + path + "?t=" + l.token(c)
+}
+
+func (l *linkSigner) token(c linkClaims) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(l.sign(payload))
+}
+
+func (l *linkSigner) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	io.WriteString(mac, payload)
+	return mac.Sum(nil)
+}
+
+// verify checks that a token is signed, meant for the action and not expired, and returns its claims.
+func (l *linkSigner) verify(token, action string, now time.Time) (linkClaims, error) {
+	var c linkClaims
+	i := strings.IndexByte(token, '.')
+	if l == nil || i < 0 {
+		return c, errInvalidLink
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, l.sign(token[:i])) {
+		return c, errInvalidLink
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Action != action {
+		return linkClaims{}, errInvalidLink
+	}
+	if now.Unix() > c.Expires {
+		return c, errExpiredLink
+	}
+	return c, nil
+}
+
+// replyEncoding encodes the document IDs and the signature in reply tokens, which have to fit
+// in the local part of an address. It is lower case, as mail servers may change the case of
+// addresses, and document IDs are not.
+var replyEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// replyToken returns the token in the reply address of a mail about the subscriptions, by
+// their document IDs, to an address. It is only valid in replies from the address.
+func (l *linkSigner) replyToken(documents []string, address string) string {
+	if l == nil {
+		return ""
+	}
+	ids := replyEncoding.EncodeToString([]byte(strings.Join(documents, ",")))
+	return ids + "-" + replyEncoding.EncodeToString(l.sign("reply\x00" + ids + "\x00" + strings.ToLower(address))[:10])
+}
+
+// verifyReply checks the token of a reply from the address and returns the document IDs
+// of the subscriptions of the mail.
+func (l *linkSigner) verifyReply(token, address string) ([]string, error) {
+	token = strings.ToLower(token)
+	i := strings.IndexByte(token, '-')
+	if l == nil || i < 0 {
+		return nil, errInvalidReply
+	}
+	sig, err := replyEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, l.sign("reply\x00" + token[:i] + "\x00" + strings.ToLower(address))[:10]) {
+		return nil, errInvalidReply
+	}
+	ids, err := replyEncoding.DecodeString(token[:i])
+	if err != nil || len(ids) == 0 {
+		return nil, errInvalidReply
+	}
+	return strings.Split(string(ids), ","), nil
+}
+
+// telegramToken returns the token of the Telegram link that lets a chat get the alarms of the
+// subscription with the document ID. It fits the start parameter of a deep link to the bot,
+// which allows letters, digits, _ and - only, and expires after linkExpiry. It is empty when
+// there is no signer or the document ID does not fit.
+func (l *linkSigner) telegramToken(document string, now time.Time) string {
+	if l == nil || document == "" || strings.IndexFunc(document, notAlphanumeric) >= 0 {
+		return ""
+	}
+	payload := document + "-" + strconv.FormatInt(now.Add(linkExpiry).Unix(), 36)
+	token := payload + "-" + hex.EncodeToString(l.sign("telegram\x00" + payload)[:10])
+	if len(token) > telegramTokenLength {
+		return ""
+	}
+	return token
+}
+
+// verifyTelegram checks the token of a Telegram link and returns the document ID of the
+// subscription it is for.
+func (l *linkSigner) verifyTelegram(token string, now time.Time) (string, error) {
+	i := strings.LastIndexByte(token, '-')
+	if l == nil || i < 0 {
+		return "", errInvalidLink
+	}
+	payload := token[:i]
+	sig, err := hex.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, l.sign("telegram\x00" + payload)[:10]) {
+		return "", errInvalidLink
+	}
+	parts := strings.Split(payload, "-")
+	if len(parts) != 2 {
+		return "", errInvalidLink
+	}
+	expires, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return "", errInvalidLink
+	}
+	if now.Unix() > expires {
+		return "", errExpiredLink
+	}
+	if parts[0] == "" {
+		return "", errInvalidLink
+	}
+	return parts[0], nil
+}
+
+func notAlphanumeric(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestLinkSigner(t *testing.T) {
+	l := &linkSigner{base: "https://monitor.example.com", secret: []byte("0123456789abcdef")}
+	claims := linkClaims{Action: actionSnooze, Sensor: "123", Expires: testDate.Add(time.Hour).Unix()}
+	token := l.token(claims)
+	other := &linkSigner{secret: []byte("fedcba9876543210")}
+	changed := l.token(linkClaims{Action: actionSnooze, Sensor: "124", Expires: claims.Expires})
+	tampered := changed[:strings.Index(changed, ".")] + token[strings.Index(token, "."):]
+
+	tests := []struct {
+		name    string
+		signer  *linkSigner
+		token   string
+		action  string
+		now     time.Time
+		wantErr error
+	}{
+		{name: "valid", signer: l, token: token, action: actionSnooze, now: testDate},
+		{name: "expired", signer: l, token: token, action: actionSnooze, now: testDate.Add(2 * time.Hour), wantErr: errExpiredLink},
+		{name: "other action", signer: l, token: token, action: "unsubscribe", now: testDate, wantErr: errInvalidLink},
+		{name: "other secret", signer: other, token: token, action: actionSnooze, now: testDate, wantErr: errInvalidLink},
+		{name: "changed claims", signer: l, token: tampered, action: actionSnooze, now: testDate, wantErr: errInvalidLink},
+		{name: "garbage", signer: l, token: "nothing", action: actionSnooze, now: testDate, wantErr: errInvalidLink},
+		{name: "no signer", signer: nil, token: token, action: actionSnooze, now: testDate, wantErr: errInvalidLink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tt.signer.verify(tt.token, tt.action, tt.now)
+			if err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if diff := deep.Equal(c, claims); err == nil && diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+
+	if u := l.url("/snooze", claims, testDate); !strings.HasPrefix(u, "https://monitor.example.com/snooze?t=") {
+		t.Errorf("unexpected link %s", u)
+	}
+	if u := (*linkSigner)(nil).url("/snooze", claims, testDate); u != "" {
+		t.Errorf("expected no link without a signer, got %s", u)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -11,20 +12,71 @@ import (
 	"github.com/mailgun/mailgun-go/v3"
 )
 
-const (
-	domain = "monitoring.meetjescraper.online"
-)
-
+// Mailer sends mails. It returns the ID the provider gave the message, if any.
 type Mailer interface {
-	Send(ctx context.Context, to, from, subject, body string) error
+	Send(ctx context.Context, msg Message) (string, error)
+}
+
+// Message is a mail with a plain text body and optionally an HTML alternative.
+type Message struct {
+	To          string
+	From        string
+	ReplyTo     string
+	Subject     string
+	Text        string
+	HTML        string
+	Inline      []Attachment // referenced from the HTML as cid:<Filename>
+	Attachments []Attachment
+	Headers     map[string]string // extra headers, like List-Unsubscribe
+	// MessageID is the Message-ID header, one is generated when it is empty.
+	// Mails in a thread refer to the earlier ones with InReplyTo and References.
+	MessageID  string
+	InReplyTo  string
+	References []string
+	// Variables are passed to the provider, which returns them in its events
+	Variables map[string]string
+}
+
+// Attachment is a file sent along with a message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 type liveMailer struct {
 	mg mailgun.Mailgun
 }
 
-func (l *liveMailer) Send(ctx context.Context, to, from, subject, body string) error {
-	message := l.mg.NewMessage(from, subject, body, to)
+func (l *liveMailer) Send(ctx context.Context, msg Message) (string, error) {
+	message := l.mg.NewMessage(msg.From, msg.Subject, msg.Text, msg.To)
+	if msg.ReplyTo != "" {
+		message.SetReplyTo(msg.ReplyTo)
+	}
+	if msg.HTML != "" {
+		message.SetHtml(msg.HTML)
+	}
+	for k, v := range msg.Headers {
+		message.AddHeader(k, v)
+	}
+	if msg.MessageID != "" {
+		message.AddHeader("Message-Id", msg.MessageID)
+	}
+	if msg.InReplyTo != "" {
+		message.AddHeader("In-Reply-To", msg.InReplyTo)
+	}
+	if len(msg.References) > 0 {
+		message.AddHeader("References", strings.Join(msg.References, " "))
+	}
+	for k, v := range msg.Variables {
+		message.AddVariable(k, v)
+	}
+	for _, a := range msg.Inline {
+		message.AddReaderInline(a.Filename, ioutil.NopCloser(bytes.NewReader(a.Data)))
+	}
+	for _, a := range msg.Attachments {
+		message.AddBufferAttachment(a.Filename, a.Data)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
@@ -32,37 +84,50 @@ func (l *liveMailer) Send(ctx context.Context, to, from, subject, body string) e
 	resp, id, err := l.mg.Send(ctx, message)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	log.Printf("mail sent: ID: %s Resp: %s\n", id, resp)
 
-	return nil
+	return id, nil
 }
 
 type logMailer struct {
 	mg mailgun.Mailgun
 }
 
-func (l *logMailer) Send(ctx context.Context, to, from, subject, body string) error {
-	log.Printf("sending dummy mail to=%s from=%s subject=%s", to, from, subject)
-	return nil
+func (l *logMailer) Send(ctx context.Context, msg Message) (string, error) {
+	log.Printf("sending dummy mail to=%s from=%s subject=%s", msg.To, msg.From, msg.Subject)
+	return msg.MessageID, nil
 }
 
-func newMailer(path string) (Mailer, error) {
-	if path == "" {
+func newMailer(c MailerConfig) (Mailer, error) {
+	switch c.Backend {
+	case "", "mailgun":
+		return newMailgunMailer(c)
+	case "smtp":
+		return newSMTPMailer(c.SMTP)
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", c.Backend)
+	}
+}
+
+func newMailgunMailer(c MailerConfig) (Mailer, error) {
+	if c.SecretPath == "" {
 		return newDummyMailer()
 	}
 
 	var mg mailgun.Mailgun
 
-	b, err := ioutil.ReadFile(path)
+	b, err := ioutil.ReadFile(c.SecretPath)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read Mailgun secrets file: %v", err)
 	}
-	apiKey := string(b)
-	mg = mailgun.NewMailgun(domain, apiKey)
-	mg.SetAPIBase("https://api.eu.mailgun.net/v3")
+	apiKey := strings.TrimSpace(string(b))
+	mg = mailgun.NewMailgun(c.Domain, apiKey)
+	if c.APIBase != "" {
+		mg.SetAPIBase(c.APIBase)
+	}
 
 	return &liveMailer{mg: mg}, nil
 }
@@ -71,35 +136,3 @@ func newDummyMailer() (*logMailer, error) {
 	log.Println("using dummy mailer: printing mails to log")
 	return &logMailer{}, nil
 }
-
-func composeAndSendAlarm(ctx context.Context, m Mailer, sensor Sensor, a Alarm, r Reading) error {
-	sender := "alert@monitoring.meetjescraper.online"
-	subject := "Issues with Meet je stad sensor " + sensor.ID
-	body := compose(a, r)
-
-	return m.Send(ctx, sensor.EmailAddress, sender, subject, body)
-}
-
-func compose(a Alarm, r Reading) string {
-	var t time.Time
-
-	sb := strings.Builder{}
-	sb.WriteString("Hi,\n\n")
-	sb.WriteString("This is an automated message to tell you that there is one or more problems with your Meet je stad weather sensor.\n\n")
-	sb.WriteString("The problems are:\n\n")
-
-	if a.Offline != t {
-		formattedDate := r.Date.Format(time.RFC822)
-		sb.WriteString(fmt.Sprintf("* The sensor has been offline since %s\n", formattedDate))
-	}
-	if a.LowVoltage != t {
-		sb.WriteString(fmt.Sprintf("* The battery seems to be low: %.2fV\n", r.Voltage))
-	}
-	if a.GpsMissing != t {
-		sb.WriteString("* The sensor has lost GPS fix\n")
-	}
-
-	sb.WriteString("\n-- \nRegards,\n\nThe Meet je stad monitoring robot")
-
-	return sb.String()
-}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -12,6 +13,34 @@ import (
 
 var testDate = time.Date(2019, 7, 3, 23, 12, 45, 123, time.UTC)
 
+var testTenant = &tenant{mailer: &logMailer{}, from: "alert@monitoring.meetjescraper.online"}
+
+// testLinks signs the links of the tests.
+var testLinks = &linkSigner{base: "https://monitor.example.com", secret: []byte("0123456789abcdef")}
+
+// testTemplates are the built-in templates, with English and UTC for sensors that have none set.
+var testTemplates = func() *templateSet {
+	ts, err := newTemplateSet(defaultTemplateSources, "en", time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}()
+
+// mailerMock keeps the messages it sends, or fails with err when it is set.
+type mailerMock struct {
+	sent []Message
+	err  error
+}
+
+func (m *mailerMock) Send(ctx context.Context, msg Message) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	m.sent = append(m.sent, msg)
+	return fmt.Sprintf("<%d@mock>", len(m.sent)), nil
+}
+
 func TestCompose(t *testing.T) {
 	type args struct {
 		a Alarm
@@ -66,7 +95,12 @@ func TestCompose(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		res := compose(tt.args.a, tt.args.r)
+		d := digest{sections: []sensorStatus{{sensor: Sensor{ID: "123", Alarms: tt.args.a}, reading: tt.args.r}}}
+		msg, err := testTemplates.renderIn(d, testTenant, nil, "en", time.UTC)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tt.name, err)
+		}
+		res := msg.text
 		if diff := deep.Equal(res, tt.want); diff != nil {
 			fmt.Printf("res : %v\n", []byte(res))
 			fmt.Printf("want: %v\n", []byte(tt.want))
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	firebase "firebase.google.com/go"
@@ -32,28 +33,153 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	sc := SensorCollection{collection: fs.Collection("sensors")}
+	sc := SensorCollection{client: fs, collection: fs.Collection("sensors")}
+	ob := OutboxCollection{collection: fs.Collection("outbox")}
+
+	if len(os.Args) > 1 {
+		env := commandEnv{outbox: &ob, sensors: &SensorCollection{client: fs, collection: sc.collection}}
+		if err := runCommand(ctx, env, os.Stdout, os.Args[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	snapshots := SnapshotDocument{doc: fs.Collection("reports").Doc("fleet")}
 	sr := httpSensorReader{client: http.DefaultClient}
 
-	m, err := newMailer(config.Mailer.SecretPath)
+	templates, err := loadTemplates(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	links, err := newLinkSigner(config.HTTP)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ts, err := newTenants(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	matrix, err := newMatrixNotifier(http.DefaultClient, config.Matrix, templates.location)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	telegram, err := newTelegramAPI(&http.Client{Timeout: telegramClientTimeout}, config.Telegram)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fcm, err := app.Messaging(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ntfy, err := newNtfyNotifier(http.DefaultClient, config.Ntfy, templates.location)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	pushover, err := newPushoverNotifier(http.DefaultClient, config.Pushover, templates.location)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	n := &dispatcher{
+		notifiers: map[string]Notifier{
+			"email":    &emailNotifier{tenants: ts, templates: templates, links: links},
+			"webhook":  &webhookNotifier{client: http.DefaultClient},
+			"slack":    &slackNotifier{client: http.DefaultClient, location: templates.location},
+			"matrix":   matrix,
+			"telegram": &telegramNotifier{api: telegram, location: templates.location},
+			"push":     &pushNotifier{client: fcm, location: templates.location},
+			"ntfy":     ntfy,
+			"pushover": pushover,
+		},
+		admin:         config.AdminChannels,
+		outbox:        &ob,
+		sensors:       &SensorCollection{client: fs, collection: sc.collection},
+		limits:        config.Limits,
+		escalateAfter: config.EscalateAfter,
+		location:      templates.location,
+	}
+	if config.VerifyWithin > 0 {
+		if links == nil {
+			log.Fatalln("verifying addresses needs the baseURL and secretPath of the http config")
+		}
+		n.verify = &verifier{tenants: ts, within: config.VerifyWithin, since: config.VerifySince, location: templates.location, links: links}
+	}
+
+	owners := ownerReporter{tenants: ts, readings: &sr, links: links, verify: n.verify != nil}
+	ownerReports, err := parseSchedule(config.Reports.Owner)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fleetReports, err := parseSchedule(config.Reports.Fleet)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	// check all sensors at start, otherwise it will wait until the first tick
-	if err := checkSensors(m, &sr, &sc); err != nil {
+	if _, _, err := checkSensors(n, &sr, &sc); err != nil {
 		panic(err)
 	}
+	ownerReports.due(nowFunc())
+	fleetReports.due(nowFunc())
+
+	// commands are handled between the checks so they do not race with storing the alarms
+	bot := telegramBot{api: telegram, sensors: &SensorCollection{client: fs, collection: sc.collection}, links: links, location: templates.location}
+	var updates chan telegramUpdate
+	if telegram.token != "" {
+		updates = make(chan telegramUpdate)
+		go bot.poll(ctx, updates)
+	}
+
+	// changes through the API are made between the checks as well
+	var requests chan func()
+	if config.HTTP.Listen != "" {
+		api, err := newAPIServer(config.HTTP, &SensorCollection{client: fs, collection: sc.collection}, links)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(config.Reports.Admins) > 0 {
+			api.alerts = &adminAlerts{tenant: ts.fallback, to: config.Reports.Admins}
+		}
+		api.tenants = ts
+		api.outbox = &ob
+		api.location = templates.location
+		requests = make(chan func())
+		api.requests = requests
+		go func() {
+			log.Fatalln(http.ListenAndServe(config.HTTP.Listen, api.routes()))
+		}()
+	}
 
 	ticker := time.NewTicker(config.Frequency)
+	retries := time.NewTicker(outboxBackoff)
+	prunes := time.NewTicker(24 * time.Hour)
 
 	// listen to the tick and check the sensors
 	log.Printf("starting job every %v seconds", config.Frequency)
 	for {
 		select {
+		case u := <-updates:
+			bot.handle(ctx, u)
+		case f := <-requests:
+			f()
+		case <-retries.C:
+			n.deliver(ctx)
+		case <-prunes.C:
+			pruneOutbox(ctx, &ob, nowFunc())
 		case <-ticker.C:
-			if err := checkSensors(m, &sr, &sc); err != nil {
+			statuses, unread, err := checkSensors(n, &sr, &sc)
+			if err != nil {
 				log.Println(err)
+				continue
+			}
+			if now := nowFunc(); ownerReports.due(now) {
+				owners.send(ctx, statuses, ownerReports.start(now), now)
+			}
+			if fleetReports.due(nowFunc()) {
+				if err := sendFleetReport(ctx, ts.fallback, &snapshots, config.Reports.Admins, config.Reports.OfflineDays, statuses, unread); err != nil {
+					log.Println(err)
+				}
 			}
 		}
 	}
@@ -76,6 +202,15 @@ func readConfig() (Config, error) {
 	if c.Mailer.Domain == "" {
 		c.Mailer.Domain = defaultConfig.Mailer.Domain
 	}
+	if c.Mailer.APIBase == "" {
+		c.Mailer.APIBase = defaultConfig.Mailer.APIBase
+	}
+	if c.Language == "" {
+		c.Language = defaultConfig.Language
+	}
+	if c.Timezone == "" {
+		c.Timezone = defaultConfig.Timezone
+	}
 
 	return c, nil
 }
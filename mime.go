@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// buildMIME encodes a message as a MIME mail. Messages with HTML become
+// multipart/alternative, wrapped in multipart/related if there are inline images,
+// and messages with attachments multipart/mixed.
+func buildMIME(msg Message, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writeHeader(&buf, "From", msg.From)
+	writeHeader(&buf, "To", msg.To)
+	if msg.ReplyTo != "" {
+		writeHeader(&buf, "Reply-To", msg.ReplyTo)
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	var extra []string
+	for k := range msg.Headers {
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		writeHeader(&buf, k, msg.Headers[k])
+	}
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	id := msg.MessageID
+	if id == "" {
+		id = newMessageID(msg.From)
+	}
+	writeHeader(&buf, "Message-ID", id)
+	if msg.InReplyTo != "" {
+		writeHeader(&buf, "In-Reply-To", msg.InReplyTo)
+	}
+	if len(msg.References) > 0 {
+		writeHeader(&buf, "References", strings.Join(msg.References, " "))
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	header, body, err := mimeBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Attachments) == 0 {
+		writeHeader(&buf, "Content-Type", header.Get("Content-Type"))
+		if cte := header.Get("Content-Transfer-Encoding"); cte != "" {
+			writeHeader(&buf, "Content-Transfer-Encoding", cte)
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	writeHeader(&buf, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+	w, err := mixed.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(w, a.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mimeBody encodes the text of a message with its inline images and returns the
+// headers of the body. Attachments are added around it.
+func mimeBody(msg Message) (textproto.MIMEHeader, []byte, error) {
+	var buf bytes.Buffer
+	if msg.HTML == "" {
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, nil, err
+		}
+		return textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}, buf.Bytes(), nil
+	}
+
+	if len(msg.Inline) == 0 {
+		alt := multipart.NewWriter(&buf)
+		if err := writeAlternatives(alt, msg); err != nil {
+			return nil, nil, err
+		}
+		return textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=" + alt.Boundary()}}, buf.Bytes(), nil
+	}
+
+	related := multipart.NewWriter(&buf)
+
+	var altBuf bytes.Buffer
+	alt := multipart.NewWriter(&altBuf)
+	if err := writeAlternatives(alt, msg); err != nil {
+		return nil, nil, err
+	}
+	w, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alt.Boundary()},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.Write(altBuf.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	for _, a := range msg.Inline {
+		w, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("inline; filename=%q", a.Filename)},
+			"Content-Id":                {"<" + a.Filename + ">"},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := writeBase64(w, a.Data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := related.Close(); err != nil {
+		return nil, nil, err
+	}
+	return textproto.MIMEHeader{
+		"Content-Type": {"multipart/related; type=\"multipart/alternative\"; boundary=" + related.Boundary()},
+	}, buf.Bytes(), nil
+}
+
+func writeAlternatives(alt *multipart.Writer, msg Message) error {
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := alt.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return err
+		}
+	}
+	return alt.Close()
+}
+
+func writeHeader(w io.Writer, key, value string) {
+	fmt.Fprintf(w, "%s: %s\r\n", key, value)
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(strings.Replace(s, "\n", "\r\n", -1))); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64 writes base64 encoded data in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := 76
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+// newMessageID creates a unique Message-ID in the domain of the sender.
+func newMessageID(from string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return fmt.Sprintf("<%x.%d@%s>", b, time.Now().UnixNano(), messageDomain(from))
+}
+
+// messageDomain is the domain of the sender, used in the Message-IDs of its mails.
+func messageDomain(from string) string {
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		return strings.TrimSuffix(from[i+1:], ">")
+	}
+	return "localhost"
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Severity tells how urgent an alarm is.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityCritical:
+		return "critical"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "info"
+	}
+}
+
+// Alarm types as used in findings and channel settings.
+const (
+	AlarmOffline = "offline"
+	AlarmVoltage = "voltage"
+	AlarmGPS     = "gps"
+)
+
+// Finding is one problem found with a sensor.
+type Finding struct {
+	Type     string    `firestore:"type"`
+	Since    time.Time `firestore:"since"`
+	Severity Severity  `firestore:"severity"`
+}
+
+// AlarmEvent is everything a notifier gets to know about an alarm for one sensor.
+// For a recovery the findings are the problems that were solved.
+type AlarmEvent struct {
+	Sensor   Sensor    `firestore:"sensor"`
+	Findings []Finding `firestore:"findings"`
+	Reading  Reading   `firestore:"reading"`
+	History  []Reading `firestore:"history"`
+	Severity Severity  `firestore:"severity"`
+	Recovery bool      `firestore:"recovery"`
+	Opens    bool      `firestore:"opens"` // the first event about the incident on the channel
+	Thread   string    `firestore:"-"`     // platform ID of the incident's first message on this channel, if any
+	Key      string    `firestore:"-"`     // idempotency key, the same for every attempt to deliver the event
+	// MessageID is the ID the provider gave the message with the event, if the notifier knows it
+	MessageID string `firestore:"-"`
+	// AttachReadings is set when the channel wants the history as CSV, for mails
+	AttachReadings bool `firestore:"attach_readings"`
+}
+
+// Notifier delivers alarm events through one type of channel.
+// A channel target gets all events for it in one call so they can be combined in one message.
+// The channel's target is resolved before it is passed on.
+// Notifiers for platforms with threads set Thread on the events they started a thread for.
+type Notifier interface {
+	Notify(ctx context.Context, c Channel, events []AlarmEvent) error
+}
+
+// notifyTimeout limits how long a notifier may take for the events of one channel target,
+// so a target that never answers does not hold up the checks.
+const notifyTimeout = 30 * time.Second
+
+// invalidTargetError tells the dispatcher that a channel's target does not exist anymore.
+type invalidTargetError struct {
+	err error
+}
+
+func (e *invalidTargetError) Error() string {
+	return "invalid target: " + e.err.Error()
+}
+
+// dispatcher sends alarms to the channels of the subscriptions and to the admin channels,
+// through the outbox.
+type dispatcher struct {
+	notifiers     map[string]Notifier // by channel type
+	admin         []Channel
+	outbox        outbox
+	sensors       sensorStore
+	limits        LimitsConfig
+	escalateAfter time.Duration  // how long alarms can go unacknowledged before they are escalated
+	verify        *verifier      // double opt-in of new addresses, nil to mail them without asking
+	location      *time.Location // time zone for the quiet hours of sensors that have none set
+}
+
+// findings lists the problems in an alarm.
+func findings(a Alarm) []Finding {
+	var res []Finding
+	if !a.Offline.IsZero() {
+		res = append(res, Finding{Type: AlarmOffline, Since: a.Offline, Severity: SeverityCritical})
+	}
+	if !a.LowVoltage.IsZero() {
+		res = append(res, Finding{Type: AlarmVoltage, Since: a.LowVoltage, Severity: SeverityWarning})
+	}
+	if !a.GpsMissing.IsZero() {
+		res = append(res, Finding{Type: AlarmGPS, Since: a.GpsMissing, Severity: SeverityInfo})
+	}
+	return res
+}
+
+func newAlarmEvent(st sensorStatus) AlarmEvent {
+	e := AlarmEvent{
+		Sensor:   st.sensor,
+		Findings: findings(st.sensor.Alarms),
+		Reading:  st.reading,
+		History:  st.history,
+	}
+	for _, f := range e.Findings {
+		if f.Severity > e.Severity {
+			e.Severity = f.Severity
+		}
+	}
+	return e
+}
+
+// newRecoveryEvent creates the event telling that the delivered alarm is solved.
+func newRecoveryEvent(st sensorStatus, delivered Alarm) AlarmEvent {
+	return AlarmEvent{
+		Sensor:   st.sensor,
+		Findings: findings(delivered),
+		Reading:  st.reading,
+		History:  st.history,
+		Severity: SeverityInfo,
+		Recovery: true,
+	}
+}
+
+// subscriptionChannels returns the channels of a sensor. Sensors without channels get
+// an e-mail channel to their address, as before channels existed.
+func subscriptionChannels(s Sensor) []Channel {
+	if len(s.Channels) == 0 {
+		return []Channel{{Type: "email"}}
+	}
+	return s.Channels
+}
+
+// channelTarget resolves where a channel delivers to. E-mail channels without
+// a target use the sensor's address.
+func channelTarget(s Sensor, c Channel) string {
+	if c.Type == "email" && c.Target == "" {
+		return recipient(s)
+	}
+	return c.Target
+}
+
+// channelKey identifies a channel target. It leaves out the secret, which is not kept in the outbox.
+func channelKey(c Channel) string {
+	return c.Type + "\x00" + c.Target + "\x00" + c.Format
+}
+
+// findChannel returns the index of the sensor's channel with the key, or -1.
+func findChannel(s Sensor, key string) int {
+	for i, c := range s.Channels {
+		c.Target = channelTarget(s, c)
+		if channelKey(c) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// batch holds the notifications for one channel target.
+type batch struct {
+	channel       Channel
+	notifications []*notification
+}
+
+type batches struct {
+	byKey map[string]*batch
+	order []*batch
+}
+
+func (bs *batches) add(n *notification) {
+	if bs.byKey == nil {
+		bs.byKey = make(map[string]*batch)
+	}
+	key := channelKey(n.Channel)
+	b, ok := bs.byKey[key]
+	if !ok {
+		b = &batch{channel: n.Channel}
+		bs.byKey[key] = b
+		bs.order = append(bs.order, b)
+	}
+	b.notifications = append(b.notifications, n)
+}
+
+// queue adds the alarms of the sensors to the outbox for all of their channels. Each
+// channel keeps track of the alarm it last queued, so an alarm is queued once.
+// Once the problems are solved the channels that got the alarm get a recovery.
+// Admin channels get every change in the alarms. A new notification for a channel
+// replaces the pending ones for the same subscription. When the alarms of a channel
+// are back to what was delivered to it, the pending ones are dropped, so a recovery
+// of an alarm that never went out is not sent either.
+func (d *dispatcher) queue(ctx context.Context, statuses []sensorStatus) {
+	pending, err := d.outbox.Pending(ctx)
+	if err != nil {
+		log.Printf("unable to read the outbox, pending notifications are not replaced: %v", err)
+	}
+	now := nowFunc()
+
+	// supersede replaces the pending notifications for the subscription on the channel
+	// but the one with the ID
+	supersede := func(document string, c Channel, id string) {
+		for i := range pending {
+			p := &pending[i]
+			if p.Status != statusPending || p.ID == id || p.Document != document || channelKey(p.Channel) != channelKey(c) {
+				continue
+			}
+			p.Status = statusSuperseded
+			if err := d.outbox.Update(ctx, *p); err != nil {
+				log.Printf("unable to replace notification %s: %v", p.ID, err)
+			}
+		}
+	}
+	add := func(c Channel, admin bool, e AlarmEvent) bool {
+		e.AttachReadings = c.AttachReadings
+		n := newNotification(c, admin, e, now)
+		if err := d.outbox.Add(ctx, n); err != nil {
+			log.Printf("unable to queue notification for sensor %s on %s %s: %v", n.SensorID, c.Type, c.Target, err)
+			return false
+		}
+		supersede(n.Document, n.Channel, n.ID)
+		return true
+	}
+
+	for i := range statuses {
+		st := &statuses[i]
+		st.sensor.Channels = subscriptionChannels(st.sensor)
+		st.sensor.trackIncident(now)
+		if d.verify != nil {
+			d.verify.check(ctx, st, now)
+		}
+		alarmed := len(findings(st.sensor.Alarms)) > 0
+
+		for j := range st.sensor.Channels {
+			c := &st.sensor.Channels[j]
+			alarms := c.alarms(st.sensor.Alarms)
+			if c.Disabled || !c.Undeliverable.IsZero() || c.Queued == alarms {
+				continue
+			}
+			if d.verify != nil && !st.sensor.verified(*c) {
+				continue // held back until the address is confirmed
+			}
+			target := *c
+			target.Target = channelTarget(st.sensor, *c)
+			var e AlarmEvent
+			switch {
+			case alarms == c.Delivered:
+				// what was queued since did not go out and is no longer true
+				supersede(st.sensor.DocumentID, target, "")
+				c.Queued = alarms
+				continue
+			case len(findings(alarms)) > 0:
+				muted := *st
+				muted.sensor.Alarms = alarms
+				e = newAlarmEvent(muted)
+			case len(findings(c.Delivered)) > 0:
+				e = newRecoveryEvent(*st, c.Delivered)
+			default:
+				continue
+			}
+			e.Opens = !e.Recovery && c.Thread == ""
+			if add(target, false, e) {
+				c.Queued = alarms
+			}
+		}
+
+		if st.previous != st.sensor.Alarms {
+			for _, c := range d.admin {
+				e := newAlarmEvent(*st)
+				e.Opens = alarmed && st.sensor.Incident.Started.Equal(now)
+				if !alarmed {
+					e = newRecoveryEvent(*st, st.previous)
+				}
+				add(c, true, e)
+			}
+		}
+
+		d.escalate(st, add, now)
+	}
+}
+
+// escalate sends alarms that went unacknowledged for too long to the escalation channels
+// of the sensor. When an escalated incident is resolved they get the recovery.
+func (d *dispatcher) escalate(st *sensorStatus, add func(c Channel, admin bool, e AlarmEvent) bool, now time.Time) {
+	s := &st.sensor
+	switch {
+	case s.escalationDue(d.escalateAfter, now):
+		e := newAlarmEvent(*st)
+		e.Opens = true // the escalation channels did not hear about the incident before
+		var targets []string
+		for _, c := range s.Escalation {
+			if d.verify != nil && !s.verified(c) {
+				continue
+			}
+			if add(c, false, e) {
+				targets = append(targets, c.Type+" "+c.Target)
+			}
+		}
+		if len(targets) > 0 {
+			s.Incident.Escalated = now
+			s.Incident.record(stepEscalated, strings.Join(targets, ", "), now)
+		}
+	case s.Incident != nil && s.Incident.Resolved.Equal(now) && !s.Incident.Escalated.IsZero():
+		e := newRecoveryEvent(*st, st.previous)
+		for _, c := range s.Escalation {
+			if d.verify != nil && !s.verified(c) {
+				continue
+			}
+			add(c, false, e)
+		}
+	}
+}
+
+// deliver sends the notifications in the outbox that are due, combined per channel target.
+// Notifications are held back during the quiet hours of the sensor and when a target
+// or channel reached its daily limit; they go out with the next message to the target.
+// Failed notifications are retried with an increasing delay until the last attempt.
+// The channels of the sensors keep the outcome of the last attempt and the thread of
+// the incident. Channels with a target that does not exist anymore are removed.
+func (d *dispatcher) deliver(ctx context.Context) {
+	pending, err := d.outbox.Pending(ctx)
+	if err != nil {
+		log.Printf("unable to read the outbox: %v", err)
+		return
+	}
+	now := nowFunc()
+
+	var bs batches
+	for i := range pending {
+		if !pending[i].NextAttempt.After(now) {
+			bs.add(&pending[i])
+		}
+	}
+	if len(bs.order) == 0 {
+		return
+	}
+
+	// the sensors are read to hold notifications back, the deliveries are recorded on them afterwards
+	sensors := make(map[string]*Sensor)
+	deliveries := make(map[string][]func(s *Sensor))
+	sensor := func(id string) *Sensor {
+		s, ok := sensors[id]
+		if !ok {
+			found, err := d.sensors.Find(ctx, id)
+			if err != nil {
+				log.Printf("unable to find subscription %s to record the delivery: %v", id, err)
+			} else {
+				s = &found
+			}
+			sensors[id] = s
+		}
+		return s
+	}
+
+	sent, err := newSendLog(ctx, d.outbox, now)
+	if err != nil {
+		log.Printf("unable to read the sent notifications, they are not limited: %v", err)
+		sent = &sendLog{}
+	}
+	hold := func(n *notification, reason string, until time.Time) {
+		n.Held = reason
+		n.NextAttempt = until
+		if err := d.outbox.Update(ctx, *n); err != nil {
+			log.Printf("unable to update notification %s: %v", n.ID, err)
+		}
+	}
+
+	for _, b := range bs.order {
+		key := channelKey(b.channel)
+
+		var due []*notification
+		for _, n := range b.notifications {
+			if reason, until := holdBack(n, sensor(n.Document), sent, d.location, now); reason != "" {
+				hold(n, reason, until)
+				continue
+			}
+			due = append(due, n)
+		}
+		if len(due) > 0 && !due[0].Admin {
+			if until, ok := sent.limited(key, d.limits.PerRecipient, now); ok {
+				for _, n := range due {
+					hold(n, heldRateLimit, until)
+				}
+				due = nil
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		b.notifications = due
+
+		events := make([]AlarmEvent, len(b.notifications))
+		for i, n := range b.notifications {
+			events[i] = n.Event
+			events[i].Key = n.ID
+			if s := sensor(n.Document); s != nil && !n.Admin {
+				if j := findChannel(*s, key); j >= 0 {
+					events[i].Thread = s.Channels[j].Thread
+				}
+			}
+		}
+
+		channel := b.channel
+		channel.Secret = d.channelSecret(b.notifications[0], sensor(b.notifications[0].Document), key)
+
+		var err error
+		if notifier, ok := d.notifiers[b.channel.Type]; ok {
+			notifyCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			err = notifier.Notify(notifyCtx, channel, events)
+			cancel()
+		} else {
+			err = fmt.Errorf("no notifier for channel type %q", b.channel.Type)
+		}
+		if err != nil {
+			log.Printf("failed to notify %s %s: %v", b.channel.Type, b.channel.Target, err)
+		}
+		_, targetGone := err.(*invalidTargetError)
+		if err == nil {
+			sent.record(key, now)
+		}
+
+		for i, n := range b.notifications {
+			switch {
+			case err == nil:
+				n.Attempts++
+				n.Status = statusSent
+				n.Sent = now
+				n.LastError = ""
+				n.Held = ""
+				n.MessageID = events[i].MessageID
+				sent.record(n.Document+"\x00"+key, now)
+			case targetGone:
+				n.Attempts++
+				n.Status = statusFailed
+				n.LastError = err.Error()
+			default:
+				n.failed(err, now)
+			}
+			if err := d.outbox.Update(ctx, *n); err != nil {
+				log.Printf("unable to update notification %s: %v", n.ID, err)
+			}
+
+			if n.Admin || sensor(n.Document) == nil {
+				continue
+			}
+			if targetGone {
+				log.Printf("removing %s channel with an invalid target from sensor %s", b.channel.Type, n.SensorID)
+			}
+			thread := events[i].Thread
+			if events[i].Recovery {
+				thread = "" // the incident is over
+			}
+			alarms := eventAlarms(n.Event)
+			deliveries[n.Document] = append(deliveries[n.Document], func(s *Sensor) {
+				recordDelivery(s, key, alarms, err, thread, now)
+			})
+		}
+	}
+
+	// the sensors may have changed while the notifications were sent
+	for id, changes := range deliveries {
+		_, err := d.sensors.Update(ctx, id, func(s *Sensor) {
+			for _, change := range changes {
+				change(s)
+			}
+		})
+		if err != nil {
+			log.Printf("failed to store deliveries of subscription %s: %v", id, err)
+		}
+	}
+}
+
+// channelSecret looks up the secret of the channel with the key a notification is for, as
+// the outbox does not keep it: admin channels have it in the config, the others on the
+// subscription, which is nil when it is gone.
+func (d *dispatcher) channelSecret(n *notification, s *Sensor, key string) string {
+	channels := d.admin
+	if !n.Admin {
+		if s == nil {
+			return ""
+		}
+		channels = append(append([]Channel(nil), s.Channels...), s.Escalation...)
+	}
+	for _, c := range channels {
+		if channelKey(c) == key {
+			return c.Secret
+		}
+	}
+	return ""
+}
+
+// recordDelivery records on the channel of the sensor with the key how the delivery of the
+// alarms went. A channel whose target is gone is removed.
+func recordDelivery(s *Sensor, key string, alarms Alarm, err error, thread string, now time.Time) {
+	j := findChannel(*s, key)
+	if j < 0 {
+		return // unsubscribed in the meantime
+	}
+	if _, gone := err.(*invalidTargetError); gone {
+		s.Channels = append(s.Channels[:j:j], s.Channels[j+1:]...)
+		return
+	}
+	c := &s.Channels[j]
+	c.LastAttempt = now
+	if err != nil {
+		c.LastError = err.Error()
+		return
+	}
+	c.LastError = ""
+	c.Thread = thread
+	c.Delivered = alarms
+}
+
+// eventAlarms returns the alarms an event tells about, none for a recovery.
+func eventAlarms(e AlarmEvent) Alarm {
+	var a Alarm
+	if e.Recovery {
+		return a
+	}
+	for _, f := range e.Findings {
+		switch f.Type {
+		case AlarmOffline:
+			a.Offline = f.Since
+		case AlarmVoltage:
+			a.LowVoltage = f.Since
+		case AlarmGPS:
+			a.GpsMissing = f.Since
+		}
+	}
+	return a
+}
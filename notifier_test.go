@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/stretchr/testify/mock"
+)
+
+type notifierMock struct {
+	mock.Mock
+}
+
+func (nm *notifierMock) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	args := nm.Called(c.Target, events)
+	return args.Error(0)
+}
+
+// dispatch runs the dispatcher like checkSensors does, with the sensors in the store.
+// Sensors without a document ID get their sensor ID as one.
+func dispatch(d *dispatcher, statuses []sensorStatus) {
+	ctx := context.Background()
+	for i := range statuses {
+		if statuses[i].sensor.DocumentID == "" {
+			statuses[i].sensor.DocumentID = statuses[i].sensor.ID
+		}
+	}
+	d.queue(ctx, statuses)
+	sensors := d.sensors.(*sensorStoreMock)
+	for _, st := range statuses {
+		sensors.Store(ctx, st.sensor)
+	}
+	d.deliver(ctx)
+}
+
+// deadlineNotifier keeps the deadline of the context it was called with.
+type deadlineNotifier struct {
+	deadline time.Time
+}
+
+func (dn *deadlineNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	dn.deadline, _ = ctx.Deadline()
+	return nil
+}
+
+// secretNotifier keeps the secrets of the channels it was called for, by target.
+type secretNotifier struct {
+	secrets map[string]string
+}
+
+func (sn *secretNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	sn.secrets[c.Target] = c.Secret
+	return nil
+}
+
+func TestDeliverSecrets(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	started := testDate.Add(-3 * time.Hour)
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:         "1",
+				Alarms:     Alarm{Offline: started},
+				Channels:   []Channel{{Type: "webhook", Target: "https://example.com/owner", Secret: "owner-secret"}},
+				Escalation: []Channel{{Type: "webhook", Target: "https://example.com/caretaker", Secret: "caretaker-secret"}},
+				Fallback:   []Channel{{Type: "webhook", Target: "https://example.com/backup", Secret: "backup-secret"}},
+				Incident:   &Incident{Started: started},
+			},
+		},
+	}
+
+	webhook := secretNotifier{secrets: make(map[string]string)}
+	ob := newMemoryOutbox()
+	d := dispatcher{
+		notifiers:     map[string]Notifier{"webhook": &webhook},
+		admin:         []Channel{{Type: "webhook", Target: "https://example.com/admin", Secret: "admin-secret"}},
+		outbox:        ob,
+		sensors:       &sensorStoreMock{sensors: make(map[string]Sensor)},
+		escalateAfter: time.Hour,
+	}
+	dispatch(&d, statuses)
+
+	want := map[string]string{
+		"https://example.com/owner":     "owner-secret",
+		"https://example.com/caretaker": "caretaker-secret",
+		"https://example.com/admin":     "admin-secret",
+	}
+	if diff := deep.Equal(webhook.secrets, want); diff != nil {
+		t.Errorf("secrets failed: %v", diff)
+	}
+	for _, n := range ob.notifications {
+		channels := append([]Channel{n.Channel}, n.Event.Sensor.Escalation...)
+		for _, c := range append(channels, n.Event.Sensor.Fallback...) {
+			if c.Secret != "" {
+				t.Errorf("expected no secrets in the outbox, got %+v", n)
+			}
+		}
+	}
+}
+
+func TestDeliverTimeout(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	// a target that never answers would hold up the checks without a deadline
+	hook := deadlineNotifier{}
+	ob := newMemoryOutbox()
+	d := dispatcher{
+		notifiers: map[string]Notifier{"webhook": &hook},
+		outbox:    ob,
+		sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+	}
+	st := sensorStatus{sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}}}
+	ob.Add(context.Background(), newNotification(Channel{Type: "webhook", Target: "https://example.com/hook"}, false, newAlarmEvent(st), testDate))
+
+	d.deliver(context.Background())
+	if hook.deadline.IsZero() || time.Until(hook.deadline) > notifyTimeout {
+		t.Errorf("expected a deadline within %v, got %v", notifyTimeout, hook.deadline)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	alarm := Alarm{Offline: testDate}
+	okReading := Reading{SensorID: "1", Date: testDate}
+
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:           "1",
+				EmailAddress: "owner@example.com",
+				Alarms:       alarm,
+				Channels: []Channel{
+					{Type: "email"},
+					{Type: "webhook", Target: "https://example.com/hook"},
+				},
+			},
+			reading: okReading,
+		},
+		{
+			sensor: Sensor{ID: "2", EmailAddress: "owner@example.com", Alarms: alarm},
+		},
+		{
+			sensor: Sensor{
+				ID:       "3",
+				Alarms:   alarm,
+				Channels: []Channel{{Type: "email", Target: "other@example.com", Queued: alarm, Delivered: alarm}},
+			},
+		},
+		{
+			sensor: Sensor{ID: "4", EmailAddress: "owner@example.com"},
+		},
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	webhook := notifierMock{}
+	webhook.On("Notify", "https://example.com/hook", mock.AnythingOfType("[]main.AlarmEvent")).Return(errors.New("connection refused"))
+
+	ob := newMemoryOutbox()
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email, "webhook": &webhook},
+		outbox:    ob,
+		sensors:   &store,
+	}
+	dispatch(&d, statuses)
+
+	email.AssertNumberOfCalls(t, "Notify", 1)
+	webhook.AssertNumberOfCalls(t, "Notify", 1)
+
+	events := email.Calls[0].Arguments.Get(1).([]AlarmEvent)
+	if len(events) != 2 || events[0].Sensor.ID != "1" || events[1].Sensor.ID != "2" {
+		t.Errorf("expected sensors 1 and 2 to be combined, got %v", events)
+	}
+	if diff := deep.Equal(events[0].Findings, []Finding{{Type: AlarmOffline, Since: testDate, Severity: SeverityCritical}}); diff != nil {
+		t.Errorf("findings failed: %v", diff)
+	}
+	if events[0].Severity != SeverityCritical || events[0].Key == "" {
+		t.Errorf("unexpected severity %v or key %q", events[0].Severity, events[0].Key)
+	}
+	if !events[0].Opens || !events[1].Opens {
+		t.Errorf("expected the first events about the incidents, got %v", events)
+	}
+
+	want := map[string][]Channel{
+		"1": {
+			{Type: "email", Queued: alarm, Delivered: alarm, LastAttempt: testDate},
+			{Type: "webhook", Target: "https://example.com/hook", Queued: alarm, LastAttempt: testDate, LastError: "connection refused"},
+		},
+		"2": {
+			{Type: "email", Queued: alarm, Delivered: alarm, LastAttempt: testDate},
+		},
+		"3": {
+			{Type: "email", Target: "other@example.com", Queued: alarm, Delivered: alarm},
+		},
+		"4": {
+			{Type: "email"},
+		},
+	}
+	for id, channels := range want {
+		if diff := deep.Equal(store.sensors[id].Channels, channels); diff != nil {
+			t.Errorf("channels of sensor %s failed: %v", id, diff)
+		}
+	}
+
+	pending, _ := ob.Pending(context.Background())
+	if len(pending) != 1 || pending[0].Channel.Type != "webhook" || pending[0].Attempts != 1 || !pending[0].NextAttempt.Equal(testDate.Add(outboxBackoff)) {
+		t.Errorf("expected the webhook to be retried, got %v", pending)
+	}
+
+	// nothing is queued again on the next check
+	dispatch(&d, statuses)
+	email.AssertNumberOfCalls(t, "Notify", 1)
+	webhook.AssertNumberOfCalls(t, "Notify", 1)
+}
+
+func TestDeliverRetries(t *testing.T) {
+	now := testDate
+	nowFunc = func() time.Time {
+		return now
+	}
+
+	alarm := Alarm{Offline: testDate}
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:       "1",
+				Alarms:   alarm,
+				Channels: []Channel{{Type: "webhook", Target: "https://example.com/hook"}},
+			},
+		},
+	}
+
+	webhook := notifierMock{}
+	webhook.On("Notify", "https://example.com/hook", mock.AnythingOfType("[]main.AlarmEvent")).Return(errors.New("connection refused"))
+
+	ob := newMemoryOutbox()
+	d := dispatcher{
+		notifiers: map[string]Notifier{"webhook": &webhook},
+		outbox:    ob,
+		sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+	}
+	dispatch(&d, statuses)
+
+	d.deliver(context.Background())
+	webhook.AssertNumberOfCalls(t, "Notify", 1)
+
+	var waited time.Duration
+	for attempt := 2; attempt <= outboxAttempts; attempt++ {
+		wait := outboxBackoff << uint(attempt-2)
+		waited += wait
+		now = testDate.Add(waited)
+		d.deliver(context.Background())
+		webhook.AssertNumberOfCalls(t, "Notify", attempt)
+	}
+
+	n := ob.notifications[ob.order[0]]
+	if n.Status != statusFailed || n.Attempts != outboxAttempts {
+		t.Errorf("expected the notification to fail after %d attempts, got %s after %d", outboxAttempts, n.Status, n.Attempts)
+	}
+
+	// events of the same alarm have the same key for every attempt
+	first := webhook.Calls[0].Arguments.Get(1).([]AlarmEvent)[0].Key
+	last := webhook.Calls[outboxAttempts-1].Arguments.Get(1).([]AlarmEvent)[0].Key
+	if first != n.ID || last != n.ID {
+		t.Errorf("expected key %s, got %s and %s", n.ID, first, last)
+	}
+}
+
+func TestDeliverKeepsChanges(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	statuses := []sensorStatus{{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com", Alarms: Alarm{Offline: testDate}}}}
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	snooze := Snooze{Until: testDate.Add(time.Hour)}
+
+	// the owner snoozes the sensor and adds a channel while the mail is sent
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil).Run(func(mock.Arguments) {
+		store.Update(context.Background(), "1", func(s *Sensor) {
+			s.Snoozes = []Snooze{snooze}
+			s.Channels = append(s.Channels, Channel{Type: "webhook", Target: "https://example.com/hook"})
+		})
+	})
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email},
+		outbox:    newMemoryOutbox(),
+		sensors:   &store,
+	}
+	dispatch(&d, statuses)
+
+	s := store.sensors["1"]
+	want := []Channel{
+		{Type: "email", Queued: Alarm{Offline: testDate}, Delivered: Alarm{Offline: testDate}, LastAttempt: testDate},
+		{Type: "webhook", Target: "https://example.com/hook"},
+	}
+	if diff := deep.Equal(s.Channels, want); diff != nil {
+		t.Errorf("channels failed: %v", diff)
+	}
+	if diff := deep.Equal(s.Snoozes, []Snooze{snooze}); diff != nil {
+		t.Errorf("snoozes failed: %v", diff)
+	}
+}
+
+func TestDispatchRecovery(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	delivered := Alarm{Offline: testDate.Add(-time.Hour)}
+	// the GPS alarm that came later never got out
+	queued := Alarm{Offline: delivered.Offline, GpsMissing: testDate.Add(-30 * time.Minute)}
+	channel := Channel{Type: "matrix", Target: "!room", Queued: queued, Delivered: delivered, Thread: "$first"}
+	statuses := []sensorStatus{
+		{
+			sensor:   Sensor{ID: "1", Channels: []Channel{channel}},
+			previous: queued,
+		},
+	}
+
+	matrix := notifierMock{}
+	matrix.On("Notify", "!room", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	admin := notifierMock{}
+	admin.On("Notify", "https://chat.example.com/hook", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+
+	ob := newMemoryOutbox()
+	// the alarm that never got out is replaced by the recovery
+	stale := newNotification(channel, false, newAlarmEvent(sensorStatus{sensor: Sensor{ID: "1", DocumentID: "1", Alarms: queued}}), testDate.Add(-30*time.Minute))
+	stale.NextAttempt = testDate.Add(time.Hour)
+	ob.Add(context.Background(), stale)
+
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers: map[string]Notifier{"matrix": &matrix, "slack": &admin},
+		admin:     []Channel{{Type: "slack", Target: "https://chat.example.com/hook"}},
+		outbox:    ob,
+		sensors:   &store,
+	}
+	dispatch(&d, statuses)
+
+	matrix.AssertNumberOfCalls(t, "Notify", 1)
+	admin.AssertNumberOfCalls(t, "Notify", 1)
+
+	events := matrix.Calls[0].Arguments.Get(1).([]AlarmEvent)
+	if !events[0].Recovery || events[0].Opens || events[0].Thread != "$first" {
+		t.Errorf("expected a recovery in the thread, got %v", events[0])
+	}
+	if diff := deep.Equal(events[0].Findings, findings(delivered)); diff != nil {
+		t.Errorf("findings failed: %v", diff)
+	}
+	if events := admin.Calls[0].Arguments.Get(1).([]AlarmEvent); !events[0].Recovery {
+		t.Errorf("expected a recovery for the admins, got %v", events[0])
+	}
+	if got := ob.notifications[stale.ID].Status; got != statusSuperseded {
+		t.Errorf("expected the stale alarm to be superseded, got %s", got)
+	}
+
+	want := []Channel{{Type: "matrix", Target: "!room", LastAttempt: testDate}}
+	if diff := deep.Equal(store.sensors["1"].Channels, want); diff != nil {
+		t.Errorf("channels failed: %v", diff)
+	}
+}
+
+func TestDispatchUnsentRecovery(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	queued := Alarm{Offline: testDate.Add(-time.Hour)}
+	channel := Channel{Type: "webhook", Target: "https://example.com/hook", Queued: queued}
+	statuses := []sensorStatus{
+		{
+			sensor:   Sensor{ID: "1", Channels: []Channel{channel}},
+			previous: queued,
+		},
+	}
+
+	webhook := notifierMock{}
+	ob := newMemoryOutbox()
+	// the alarm is waiting for the next attempt when the sensor works again
+	unsent := newNotification(channel, false, newAlarmEvent(sensorStatus{sensor: Sensor{ID: "1", DocumentID: "1", Alarms: queued}}), testDate.Add(-time.Hour))
+	unsent.failed(errors.New("connection refused"), testDate.Add(-time.Hour))
+	ob.Add(context.Background(), unsent)
+
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers: map[string]Notifier{"webhook": &webhook},
+		outbox:    ob,
+		sensors:   &store,
+	}
+	dispatch(&d, statuses)
+
+	webhook.AssertNotCalled(t, "Notify", mock.Anything, mock.Anything)
+	if got := ob.notifications[unsent.ID].Status; got != statusSuperseded {
+		t.Errorf("expected the unsent alarm to be dropped, got %s", got)
+	}
+	want := []Channel{{Type: "webhook", Target: "https://example.com/hook"}}
+	if diff := deep.Equal(store.sensors["1"].Channels, want); diff != nil {
+		t.Errorf("channels failed: %v", diff)
+	}
+}
+
+func TestDeliverHeldBack(t *testing.T) {
+	now := testDate
+	nowFunc = func() time.Time {
+		return now
+	}
+
+	hook := Channel{Type: "webhook", Target: "https://example.com/hook"}
+	limited := hook
+	limited.MaxPerDay = 1
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:         "1",
+				Alarms:     Alarm{LowVoltage: testDate},
+				QuietHours: QuietHours{Start: "22:00", End: "07:00"},
+				Channels:   []Channel{hook},
+			},
+		},
+		{
+			sensor: Sensor{
+				ID:         "2",
+				Alarms:     Alarm{Offline: testDate},
+				QuietHours: QuietHours{Start: "22:00", End: "07:00"},
+				Channels:   []Channel{limited},
+			},
+		},
+	}
+
+	webhook := notifierMock{}
+	webhook.On("Notify", "https://example.com/hook", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+
+	ob := newMemoryOutbox()
+	d := dispatcher{
+		notifiers: map[string]Notifier{"webhook": &webhook},
+		outbox:    ob,
+		sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+		limits:    LimitsConfig{PerRecipient: 2},
+	}
+	dispatch(&d, statuses)
+
+	// the critical alarm goes out during the quiet hours, the warning waits
+	webhook.AssertNumberOfCalls(t, "Notify", 1)
+	if events := webhook.Calls[0].Arguments.Get(1).([]AlarmEvent); len(events) != 1 || events[0].Sensor.ID != "2" {
+		t.Errorf("expected the alarm of sensor 2, got %v", events)
+	}
+	held := ob.notifications[ob.order[0]]
+	if held.Status != statusPending || held.Held != heldQuietHours || held.Attempts != 0 {
+		t.Errorf("expected the warning to be held back by the quiet hours, got %+v", held)
+	}
+
+	// a new alarm for the sensor with one message a day waits for tomorrow
+	now = testDate.Add(time.Hour)
+	statuses[1].sensor, _ = d.sensors.Find(context.Background(), "2")
+	statuses[1].sensor.Alarms.GpsMissing = now
+	dispatch(&d, statuses[1:])
+	webhook.AssertNumberOfCalls(t, "Notify", 1)
+
+	// after the quiet hours the warning is sent, the target's limit holds back the rest
+	now = time.Date(2019, 7, 4, 7, 0, 0, 0, time.UTC)
+	d.deliver(context.Background())
+	webhook.AssertNumberOfCalls(t, "Notify", 2)
+	for _, id := range ob.order[1:] {
+		n := ob.notifications[id]
+		if n.SensorID == "2" && n.Status == statusPending && n.Held != heldRateLimit {
+			t.Errorf("expected the new alarm of sensor 2 to be held back by the rate limit, got %+v", n)
+		}
+	}
+
+	// a day after the first message all is sent
+	now = testDate.Add(limitWindow)
+	d.deliver(context.Background())
+	webhook.AssertNumberOfCalls(t, "Notify", 3)
+	for _, n := range ob.notifications {
+		if n.Status == statusPending {
+			t.Errorf("expected nothing pending, got %+v", n)
+		}
+	}
+}
+
+func TestDeliverSeveralSubscriptions(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	// two people watch the same sensor, one of them has quiet hours
+	alarm := Alarm{LowVoltage: testDate}
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:         "1",
+				DocumentID: "quiet",
+				Alarms:     alarm,
+				QuietHours: QuietHours{Start: "22:00", End: "07:00"},
+				Channels:   []Channel{{Type: "email", Target: "owner@example.com"}},
+			},
+		},
+		{
+			sensor: Sensor{
+				ID:         "1",
+				DocumentID: "neighbour",
+				Alarms:     alarm,
+				Channels:   []Channel{{Type: "email", Target: "neighbour@example.com"}},
+			},
+		},
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "neighbour@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(errors.New("mailbox full"))
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	ob := newMemoryOutbox()
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email},
+		outbox:    ob,
+		sensors:   &store,
+		location:  time.UTC,
+	}
+	dispatch(&d, statuses)
+
+	email.AssertNumberOfCalls(t, "Notify", 1)
+	for _, n := range ob.notifications {
+		if n.Document == "quiet" && n.Held != heldQuietHours {
+			t.Errorf("expected the warning to the owner to wait for the quiet hours, got %+v", n)
+		}
+	}
+	if c := store.sensors["neighbour"].Channels[0]; c.LastError != "mailbox full" {
+		t.Errorf("expected the failure on the channel of the neighbour, got %+v", c)
+	}
+	if c := store.sensors["quiet"].Channels[0]; c.LastError != "" || !c.LastAttempt.IsZero() {
+		t.Errorf("expected no attempt on the channel of the owner, got %+v", c)
+	}
+}
+
+func TestDispatchEscalation(t *testing.T) {
+	now := testDate
+	nowFunc = func() time.Time {
+		return now
+	}
+
+	alarm := Alarm{Offline: testDate}
+	caretaker := Channel{Type: "email", Target: "caretaker@example.com"}
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:           "1",
+				EmailAddress: "owner@example.com",
+				Alarms:       alarm,
+				Escalation:   []Channel{caretaker},
+			},
+		},
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	email.On("Notify", "caretaker@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers:     map[string]Notifier{"email": &email},
+		outbox:        newMemoryOutbox(),
+		sensors:       &store,
+		escalateAfter: 2 * time.Hour,
+	}
+	check := func(alarms Alarm) {
+		s := store.sensors["1"]
+		statuses = []sensorStatus{{sensor: s, previous: s.Alarms}}
+		statuses[0].sensor.Alarms = alarms
+		dispatch(&d, statuses)
+	}
+
+	dispatch(&d, statuses)
+	email.AssertNumberOfCalls(t, "Notify", 1)
+
+	now = testDate.Add(time.Hour)
+	check(alarm)
+	email.AssertNumberOfCalls(t, "Notify", 1)
+
+	// unacknowledged for two hours
+	now = testDate.Add(2 * time.Hour)
+	check(alarm)
+	email.AssertNumberOfCalls(t, "Notify", 2)
+	if target := email.Calls[1].Arguments.Get(0); target != "caretaker@example.com" {
+		t.Errorf("expected the alarm to be escalated to the caretaker, got %v", target)
+	}
+
+	// escalated once
+	now = testDate.Add(3 * time.Hour)
+	check(alarm)
+	email.AssertNumberOfCalls(t, "Notify", 2)
+
+	// the caretaker hears that the sensor works again as well
+	now = testDate.Add(4 * time.Hour)
+	check(Alarm{})
+	email.AssertNumberOfCalls(t, "Notify", 4)
+
+	var actions []string
+	for _, step := range store.sensors["1"].Incident.Steps {
+		actions = append(actions, step.Action+" "+step.Detail)
+	}
+	want := []string{"raised offline", "escalated email caretaker@example.com", "resolved "}
+	if diff := deep.Equal(actions, want); diff != nil {
+		t.Errorf("steps failed: %v", diff)
+	}
+}
+
+func TestDispatchEscalationUnverified(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	started := testDate.Add(-3 * time.Hour)
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:           "1",
+				EmailAddress: "owner@example.com",
+				Alarms:       Alarm{Offline: started},
+				Escalation:   []Channel{{Type: "email", Target: "caretaker@example.com"}},
+				Incident:     &Incident{Started: started},
+				Verifications: []Verification{
+					{Address: "owner@example.com", Confirmed: started},
+					{Address: "caretaker@example.com", Sent: started},
+				},
+			},
+			previous: Alarm{Offline: started},
+		},
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers:     map[string]Notifier{"email": &email},
+		outbox:        newMemoryOutbox(),
+		sensors:       &store,
+		escalateAfter: 2 * time.Hour,
+		verify:        &verifier{tenants: &tenants{fallback: &tenant{mailer: &mailerMock{}}}, within: 24 * time.Hour},
+	}
+	dispatch(&d, statuses)
+
+	email.AssertNotCalled(t, "Notify", "caretaker@example.com", mock.Anything)
+	if escalated := store.sensors["1"].Incident.Escalated; !escalated.IsZero() {
+		t.Errorf("expected no escalation to an unconfirmed address, got %v", escalated)
+	}
+}
+
+func TestDispatchAcknowledged(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	email := notifierMock{}
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers:     map[string]Notifier{"email": &email},
+		outbox:        newMemoryOutbox(),
+		sensors:       &store,
+		escalateAfter: time.Hour,
+	}
+	alarm := Alarm{Offline: testDate.Add(-3 * time.Hour)}
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:         "1",
+				Alarms:     alarm,
+				Channels:   []Channel{{Type: "email", Target: "owner@example.com", Queued: alarm, Delivered: alarm}},
+				Escalation: []Channel{{Type: "email", Target: "caretaker@example.com"}},
+				Incident:   &Incident{Started: alarm.Offline, Acknowledged: testDate.Add(-2 * time.Hour)},
+			},
+			previous: alarm,
+		},
+	}
+	dispatch(&d, statuses)
+	email.AssertNotCalled(t, "Notify", "caretaker@example.com", mock.Anything)
+}
+
+func TestDispatchUnsubscribed(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:     "1",
+				Alarms: Alarm{Offline: testDate, GpsMissing: testDate},
+				Channels: []Channel{
+					{Type: "email", Target: "owner@example.com", Disabled: true},
+					{Type: "email", Target: "other@example.com", Muted: []string{AlarmOffline}},
+				},
+			},
+		},
+		{
+			// the only alarm is muted
+			sensor: Sensor{
+				ID:       "2",
+				Alarms:   Alarm{Offline: testDate},
+				Channels: []Channel{{Type: "email", Target: "other@example.com", Muted: []string{AlarmOffline}}},
+			},
+		},
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "other@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email},
+		outbox:    newMemoryOutbox(),
+		sensors:   &store,
+	}
+	dispatch(&d, statuses)
+
+	email.AssertNumberOfCalls(t, "Notify", 1)
+	events := email.Calls[0].Arguments.Get(1).([]AlarmEvent)
+	if len(events) != 1 || events[0].Sensor.ID != "1" {
+		t.Fatalf("expected only the alarm of sensor 1, got %v", events)
+	}
+	if diff := deep.Equal(events[0].Findings, []Finding{{Type: AlarmGPS, Since: testDate, Severity: SeverityInfo}}); diff != nil {
+		t.Errorf("expected only the GPS alarm: %v", diff)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+)
+
+// Delivery states of notifications.
+const (
+	statusPending    = "pending"
+	statusSent       = "sent"
+	statusFailed     = "failed"     // gave up after the last attempt or the target is gone
+	statusSuperseded = "superseded" // a newer notification for the channel replaced it
+)
+
+// Delivery states the provider reports for sent notifications.
+const (
+	deliveryDelivered  = "delivered"
+	deliveryDeferred   = "deferred" // failed for now, the provider tries again
+	deliveryBounced    = "bounced"
+	deliveryComplained = "complained"
+)
+
+const (
+	outboxAttempts  = 8
+	outboxBackoff   = time.Minute         // wait before the first retry, doubled for every next one
+	outboxRetention = 30 * 24 * time.Hour // keep notifications that are done with this long
+)
+
+// notification is an alarm event waiting in the outbox for delivery to one channel.
+// Its ID is the idempotency key of the delivery: the same event for the same channel
+// always gets the same ID, so it is queued only once.
+type notification struct {
+	ID          string     `firestore:"-"`
+	SensorID    string     `firestore:"sensor_id"`
+	Document    string     `firestore:"document"` // document ID of the subscription
+	Channel     Channel    `firestore:"channel"`
+	Admin       bool       `firestore:"admin"`
+	Event       AlarmEvent `firestore:"event"`
+	Status      string     `firestore:"status"`
+	Attempts    int        `firestore:"attempts"`
+	Created     time.Time  `firestore:"created"`
+	NextAttempt time.Time  `firestore:"next_attempt"`
+	LastError   string     `firestore:"last_error"`
+	Held        string     `firestore:"held"` // why it is held back, if it is
+	Sent        time.Time  `firestore:"sent"`
+	MessageID   string     `firestore:"message_id"` // provider ID of the message, if known
+	// what the provider reported about the message last, if it reports anything
+	Delivery        string    `firestore:"delivery"`
+	DeliveryDetail  string    `firestore:"delivery_detail"`
+	DeliveryUpdated time.Time `firestore:"delivery_updated"`
+}
+
+// outbox stores the notifications.
+type outbox interface {
+	// Add stores a new notification. Adding one that exists already is not an error.
+	Add(ctx context.Context, n notification) error
+	Update(ctx context.Context, n notification) error
+	Pending(ctx context.Context) ([]notification, error)
+	SentSince(ctx context.Context, since time.Time) ([]notification, error)
+	// List returns the notifications of a sensor, the newest first.
+	List(ctx context.Context, sensorID string, limit int) ([]notification, error)
+	// ByMessage returns the notifications sent in the message with the provider ID.
+	ByMessage(ctx context.Context, messageID string) ([]notification, error)
+	// Prune removes the notifications created before the moment that are not pending
+	// and tells how many it removed.
+	Prune(ctx context.Context, before time.Time) (int, error)
+}
+
+// newNotification creates the notification of the event for the channel. The secrets of
+// the channels are left out, they are looked up again when it is delivered.
+func newNotification(c Channel, admin bool, e AlarmEvent, now time.Time) notification {
+	e.Sensor.Channels = nil
+	e.Sensor.Snoozes = nil
+	e.Sensor.Escalation = withoutSecrets(e.Sensor.Escalation)
+	e.Sensor.Fallback = withoutSecrets(e.Sensor.Fallback)
+	if e.Sensor.Incident != nil {
+		incident := *e.Sensor.Incident
+		incident.Steps = nil
+		e.Sensor.Incident = &incident
+	}
+	if c.Type != "email" || e.Recovery {
+		e.History = nil // only alarm mails show the readings
+	}
+	e.Thread = ""
+	e.MessageID = ""
+	return notification{
+		ID:          notificationID(c, e),
+		SensorID:    e.Sensor.ID,
+		Document:    e.Sensor.DocumentID,
+		Channel:     Channel{Type: c.Type, Target: c.Target, Format: c.Format},
+		Admin:       admin,
+		Event:       e,
+		Status:      statusPending,
+		Created:     now,
+		NextAttempt: now,
+	}
+}
+
+// withoutSecrets returns a copy of the channels without their secrets.
+func withoutSecrets(channels []Channel) []Channel {
+	if channels == nil {
+		return nil
+	}
+	res := make([]Channel, len(channels))
+	for i, c := range channels {
+		c.Secret = ""
+		res[i] = c
+	}
+	return res
+}
+
+func notificationID(c Channel, e AlarmEvent) string {
+	h := sha256.New()
+	io.WriteString(h, channelKey(c)+"\x00"+eventID(e))
+	if e.Recovery {
+		io.WriteString(h, "\x00recovery")
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// pruneOutbox removes the notifications that are done with for longer than outboxRetention.
+func pruneOutbox(ctx context.Context, o outbox, now time.Time) {
+	n, err := o.Prune(ctx, now.Add(-outboxRetention))
+	if err != nil {
+		log.Printf("unable to prune the outbox: %v", err)
+		return
+	}
+	log.Printf("pruned %d notifications from the outbox", n)
+}
+
+// failed records a failed attempt and schedules the next one.
+func (n *notification) failed(err error, now time.Time) {
+	n.Attempts++
+	n.LastError = err.Error()
+	if n.Attempts >= outboxAttempts {
+		n.Status = statusFailed
+		return
+	}
+	n.NextAttempt = now.Add(outboxBackoff << uint(n.Attempts-1))
+}
+
+// eventName tells whether the notification is an alarm or a recovery.
+func (n notification) eventName() string {
+	if n.Event.Recovery {
+		return "recovery"
+	}
+	return "alarm"
+}
+
+// track records what the provider reported about the delivery at the time.
+// Reports older than the last one are ignored, as they may arrive out of order.
+func (n *notification) track(delivery, detail string, at time.Time) bool {
+	if at.Before(n.DeliveryUpdated) {
+		return false
+	}
+	n.Delivery = delivery
+	n.DeliveryDetail = detail
+	n.DeliveryUpdated = at
+	return true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// memoryOutbox keeps notifications in the order they were added.
+type memoryOutbox struct {
+	notifications map[string]notification
+	order         []string
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{notifications: make(map[string]notification)}
+}
+
+func (m *memoryOutbox) Add(ctx context.Context, n notification) error {
+	if _, ok := m.notifications[n.ID]; ok {
+		return nil
+	}
+	m.notifications[n.ID] = n
+	m.order = append(m.order, n.ID)
+	return nil
+}
+
+func (m *memoryOutbox) Update(ctx context.Context, n notification) error {
+	m.notifications[n.ID] = n
+	return nil
+}
+
+func (m *memoryOutbox) Pending(ctx context.Context) ([]notification, error) {
+	var res []notification
+	for _, id := range m.order {
+		if n := m.notifications[id]; n.Status == statusPending {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryOutbox) SentSince(ctx context.Context, since time.Time) ([]notification, error) {
+	var res []notification
+	for _, id := range m.order {
+		if n := m.notifications[id]; !n.Sent.Before(since) {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryOutbox) List(ctx context.Context, sensorID string, limit int) ([]notification, error) {
+	var res []notification
+	for i := len(m.order) - 1; i >= 0 && len(res) < limit; i-- {
+		if n := m.notifications[m.order[i]]; n.SensorID == sensorID {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+func (m *memoryOutbox) Prune(ctx context.Context, before time.Time) (int, error) {
+	removed := 0
+	for i := 0; i < len(m.order); i++ {
+		id := m.order[i]
+		if n := m.notifications[id]; n.Created.Before(before) && n.Status != statusPending {
+			delete(m.notifications, id)
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			i--
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (m *memoryOutbox) ByMessage(ctx context.Context, messageID string) ([]notification, error) {
+	var res []notification
+	for _, id := range m.order {
+		if n := m.notifications[id]; n.MessageID == messageID {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+func TestNotificationID(t *testing.T) {
+	alarm := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}}})
+	recovery := newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "1"}}, Alarm{Offline: testDate})
+	email := Channel{Type: "email", Target: "owner@example.com"}
+
+	id := notificationID(email, alarm)
+	if again := notificationID(email, alarm); again != id {
+		t.Errorf("expected the same ID for the same alarm, got %s and %s", id, again)
+	}
+	if other := notificationID(email, recovery); other == id {
+		t.Errorf("expected another ID for the recovery")
+	}
+	if other := notificationID(Channel{Type: "slack", Target: "https://example.com"}, alarm); other == id {
+		t.Errorf("expected another ID for another channel")
+	}
+}
+
+func TestNotificationHistory(t *testing.T) {
+	st := sensorStatus{sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}}, history: []Reading{{SensorID: "1", Date: testDate}}}
+	email := Channel{Type: "email", Target: "owner@example.com"}
+
+	if n := newNotification(email, false, newAlarmEvent(st), testDate); len(n.Event.History) != 1 {
+		t.Errorf("expected the history for an alarm mail, got %v", n.Event.History)
+	}
+	if n := newNotification(email, false, newRecoveryEvent(st, Alarm{Offline: testDate}), testDate); n.Event.History != nil {
+		t.Errorf("expected no history for a recovery mail, got %v", n.Event.History)
+	}
+	if n := newNotification(Channel{Type: "webhook", Target: "https://example.com"}, false, newAlarmEvent(st), testDate); n.Event.History != nil {
+		t.Errorf("expected no history for a webhook, got %v", n.Event.History)
+	}
+}
+
+func TestPruneOutbox(t *testing.T) {
+	ob := newMemoryOutbox()
+	channel := Channel{Type: "email", Target: "owner@example.com"}
+	old := testDate.Add(-outboxRetention - time.Hour)
+
+	for i, status := range []string{statusSent, statusFailed, statusPending} {
+		n := newNotification(channel, false, newAlarmEvent(sensorStatus{sensor: Sensor{ID: strconv.Itoa(i), Alarms: Alarm{Offline: old}}}), old)
+		n.Status = status
+		ob.Add(context.Background(), n)
+	}
+	recent := newNotification(channel, false, newAlarmEvent(sensorStatus{sensor: Sensor{ID: "4", Alarms: Alarm{Offline: testDate}}}), testDate)
+	recent.Status = statusSent
+	ob.Add(context.Background(), recent)
+
+	pruneOutbox(context.Background(), ob, testDate)
+
+	var left []string
+	for _, id := range ob.order {
+		left = append(left, ob.notifications[id].SensorID)
+	}
+	if diff := deep.Equal(left, []string{"2", "4"}); diff != nil {
+		t.Errorf("expected the pending and recent notifications to be kept: %v", diff)
+	}
+}
+
+func TestListOutbox(t *testing.T) {
+	ob := newMemoryOutbox()
+	channel := Channel{Type: "email", Target: "owner@example.com"}
+
+	sent := newNotification(channel, false, newAlarmEvent(sensorStatus{sensor: Sensor{ID: "1", Alarms: Alarm{Offline: testDate}}}), testDate)
+	sent.Status, sent.Attempts, sent.Sent, sent.MessageID = statusSent, 1, testDate, "<1@example.com>"
+	sent.track(deliveryDelivered, "", testDate.Add(time.Minute))
+	ob.Add(context.Background(), sent)
+
+	retry := newNotification(channel, false, newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "1"}}, Alarm{Offline: testDate}), testDate.Add(time.Hour))
+	retry.failed(errors.New("mailgun is down"), testDate.Add(time.Hour))
+	ob.Add(context.Background(), retry)
+
+	var out bytes.Buffer
+	if err := runCommand(context.Background(), commandEnv{outbox: ob}, &out, []string{"outbox", "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `CREATED               CHANNEL  TARGET             EVENT     STATUS   ATTEMPTS  DELIVERY                        DETAILS
+2019-07-04T00:12:45Z  email    owner@example.com  recovery  pending  1         -                               next attempt 2019-07-04T00:13:45Z, mailgun is down
+2019-07-03T23:12:45Z  email    owner@example.com  alarm     sent     1         delivered 2019-07-03T23:13:45Z  sent 2019-07-03T23:12:45Z as <1@example.com>
+`
+	if out.String() != want {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+}
+
+func TestTrackDelivery(t *testing.T) {
+	var n notification
+	if !n.track(deliveryDeferred, "mailbox full", testDate) || !n.track(deliveryDelivered, "", testDate.Add(time.Hour)) {
+		t.Fatal("expected the reports to be recorded")
+	}
+	if n.track(deliveryDeferred, "mailbox full", testDate.Add(time.Minute)) {
+		t.Error("expected a report that arrived late to be ignored")
+	}
+	if n.Delivery != deliveryDelivered || n.DeliveryDetail != "" || n.DeliveryUpdated != testDate.Add(time.Hour) {
+		t.Errorf("unexpected delivery %+v", n)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OutboxCollection stores notifications in a Firestore collection, by ID.
+type OutboxCollection struct {
+	collection *firestore.CollectionRef
+}
+
+func (o *OutboxCollection) Add(ctx context.Context, n notification) error {
+	_, err := o.collection.Doc(n.ID).Create(ctx, n)
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+	return err
+}
+
+func (o *OutboxCollection) Update(ctx context.Context, n notification) error {
+	_, err := o.collection.Doc(n.ID).Set(ctx, n)
+	return err
+}
+
+func (o *OutboxCollection) Pending(ctx context.Context) ([]notification, error) {
+	res, err := o.query(ctx, o.collection.Where("status", "==", statusPending))
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, err
+}
+
+func (o *OutboxCollection) SentSince(ctx context.Context, since time.Time) ([]notification, error) {
+	return o.query(ctx, o.collection.Where("sent", ">=", since))
+}
+
+func (o *OutboxCollection) List(ctx context.Context, sensorID string, limit int) ([]notification, error) {
+	// sorted here, ordering in the query would need a composite index
+	res, err := o.query(ctx, o.collection.Where("sensor_id", "==", sensorID))
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.After(res[j].Created) })
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, err
+}
+
+func (o *OutboxCollection) ByMessage(ctx context.Context, messageID string) ([]notification, error) {
+	return o.query(ctx, o.collection.Where("message_id", "==", messageID))
+}
+
+func (o *OutboxCollection) Prune(ctx context.Context, before time.Time) (int, error) {
+	iter := o.collection.Where("created", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	removed := 0
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return removed, nil
+		}
+		if err != nil {
+			return removed, err
+		}
+		if status, _ := snapshot.DataAt("status"); status == statusPending {
+			continue
+		}
+		if _, err := snapshot.Ref.Delete(ctx); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+}
+
+func (o *OutboxCollection) query(ctx context.Context, q firestore.Query) ([]notification, error) {
+	iter := q.Documents(ctx)
+	defer iter.Stop()
+
+	var res []notification
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var n notification
+		if err := snapshot.DataTo(&n); err != nil {
+			return nil, err
+		}
+		n.ID = snapshot.Ref.ID
+		res = append(res, n)
+	}
+}
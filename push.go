@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/messaging"
+)
+
+// fcmClient sends messages through Firebase Cloud Messaging.
+type fcmClient interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+}
+
+// pushNotifier sends a push notification per sensor to the FCM registration token in the
+// channel's target. Notifications of the same sensor replace each other on the device.
+// Tokens FCM no longer knows are reported as invalid targets so their channel is removed.
+type pushNotifier struct {
+	client   fcmClient
+	location *time.Location // time zone for sensors that have none set
+}
+
+func (p *pushNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	for _, e := range events {
+		_, err := p.client.Send(ctx, newPushMessage(c.Target, e, p.location))
+		// an invalid argument can as well be a bug in the message, only an unregistered token is gone for good
+		if messaging.IsRegistrationTokenNotRegistered(err) {
+			return &invalidTargetError{err: err}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newPushMessage(token string, e AlarmEvent, location *time.Location) *messaging.Message {
+	m := newChatMessage(e, location)
+
+	title := fmt.Sprintf("Sensor %s: %s", m.sensorID, m.headline)
+	body := strings.Join(m.details, ", ")
+	kind, priority, urgency := "alarm", "normal", "normal"
+	switch {
+	case e.Recovery:
+		kind, urgency = "recovery", "low"
+	case e.Severity == SeverityCritical:
+		priority, urgency = "high", "high"
+	}
+	tag := "sensor-" + m.sensorID
+
+	return &messaging.Message{
+		Token:        token,
+		Notification: &messaging.Notification{Title: title, Body: body},
+		Data: map[string]string{
+			"type":      kind,
+			"sensor_id": m.sensorID,
+			"severity":  e.Severity.String(),
+			"url":       m.url,
+		},
+		Android: &messaging.AndroidConfig{
+			Priority:     priority,
+			CollapseKey:  tag,
+			Notification: &messaging.AndroidNotification{Tag: tag},
+		},
+		Webpush: &messaging.WebpushConfig{
+			Headers:      map[string]string{"Urgency": urgency},
+			Notification: &messaging.WebpushNotification{Tag: tag, Renotify: !e.Recovery},
+			FcmOptions:   &messaging.WebpushFcmOptions{Link: m.url},
+		},
+		APNS: &messaging.APNSConfig{
+			Payload: &messaging.APNSPayload{Aps: &messaging.Aps{ThreadID: tag}},
+		},
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"github.com/go-test/deep"
+	"github.com/stretchr/testify/mock"
+	"google.golang.org/api/option"
+)
+
+// redirectTransport sends all requests to a test server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme = rt.target.Scheme
+	r.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestPushNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	var sent []messaging.Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Message messaging.Message }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		sent = append(sent, req.Message)
+		if req.Message.Token == "gone" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"status":"NOT_FOUND","message":"Requested entity was not found."}}`))
+			return
+		}
+		if req.Message.Token == "malformed" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"status":"INVALID_ARGUMENT","message":"Invalid message."}}`))
+			return
+		}
+		w.Write([]byte(`{"name":"projects/test/messages/1"}`))
+	}))
+	defer srv.Close()
+
+	target, _ := url.Parse(srv.URL)
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: "test"},
+		option.WithCredentialsJSON([]byte(`{"type":"authorized_user","client_id":"test","client_secret":"test","refresh_token":"test"}`)),
+		option.WithHTTPClient(&http.Client{Transport: redirectTransport{target: target}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pushNotifier{client: client}
+
+	alarm := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}})
+	if err := p.Notify(ctx, Channel{Type: "push", Target: "device"}, []AlarmEvent{alarm}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].Token != "device" || sent[0].Notification.Title != "Sensor 123: critical" || sent[0].Android.Priority != "high" {
+		t.Errorf("unexpected message %+v", sent)
+	}
+
+	recovery := newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "123"}}, Alarm{Offline: testDate})
+	err = p.Notify(ctx, Channel{Type: "push", Target: "gone"}, []AlarmEvent{recovery})
+	if _, ok := err.(*invalidTargetError); !ok {
+		t.Errorf("expected an invalid target, got %v", err)
+	}
+	if got := sent[1].Webpush.Headers["Urgency"]; got != "low" {
+		t.Errorf("expected a low urgency recovery, got %q", got)
+	}
+
+	err = p.Notify(ctx, Channel{Type: "push", Target: "malformed"}, []AlarmEvent{alarm})
+	if _, ok := err.(*invalidTargetError); ok || err == nil {
+		t.Errorf("expected an invalid message to be retried, got %v", err)
+	}
+}
+
+func TestDispatchRemovesInvalidTargets(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	alarm := Alarm{Offline: testDate}
+	statuses := []sensorStatus{
+		{
+			sensor: Sensor{
+				ID:     "1",
+				Alarms: alarm,
+				Channels: []Channel{
+					{Type: "push", Target: "gone"},
+					{Type: "push", Target: "device"},
+				},
+			},
+		},
+	}
+
+	push := notifierMock{}
+	push.On("Notify", "gone", mock.AnythingOfType("[]main.AlarmEvent")).Return(&invalidTargetError{err: errors.New("not registered")})
+	push.On("Notify", "device", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{notifiers: map[string]Notifier{"push": &push}, outbox: newMemoryOutbox(), sensors: &store}
+	dispatch(&d, statuses)
+
+	want := []Channel{{Type: "push", Target: "device", Queued: alarm, Delivered: alarm, LastAttempt: testDate}}
+	if diff := deep.Equal(store.sensors["1"].Channels, want); diff != nil {
+		t.Errorf("expected the invalid token to be removed: %v", diff)
+	}
+}
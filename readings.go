@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var readingsHeader = []string{"timestamp", "voltage", "latitude", "longitude", "firmware", "rssi", "snr"}
+
+// readingsCSV writes the readings as CSV, the oldest first, with the times in UTC.
+func readingsCSV(readings []Reading) ([]byte, error) {
+	sorted := append([]Reading(nil), readings...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Date.Before(sorted[j].Date) })
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(readingsHeader)
+	for _, r := range sorted {
+		w.Write([]string{
+			r.Date.UTC().Format(time.RFC3339),
+			formatFloat(r.Voltage),
+			formatFloat(r.Position.Lat),
+			formatFloat(r.Position.Lng),
+			r.Firmware,
+			formatFloat(r.RSSI),
+			formatFloat(r.SNR),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReadingsCSV(t *testing.T) {
+	readings := []Reading{
+		{Date: testDate, Voltage: 3.95, Firmware: "v4", Position: Position{Lat: 52.0907, Lng: 5.1214}, RSSI: -112, SNR: 7.5},
+		{Date: testDate.Add(-time.Hour), Voltage: 4.1, Firmware: "v4", RSSI: -98, SNR: -2.25},
+	}
+	got, err := readingsCSV(readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `timestamp,voltage,latitude,longitude,firmware,rssi,snr
+2019-07-03T22:12:45Z,4.1,0,0,v4,-98,-2.25
+2019-07-03T23:12:45Z,3.95,52.0907,5.1214,v4,-112,7.5
+`
+	if string(got) != want {
+		t.Errorf("unexpected CSV:\n%s", got)
+	}
+}
+
+func TestEmailReadings(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+	history := []Reading{{Date: testDate, Voltage: 3.1}}
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email},
+		outbox:    newMemoryOutbox(),
+		sensors:   &sensorStoreMock{sensors: make(map[string]Sensor)},
+	}
+	dispatch(&d, []sensorStatus{
+		{sensor: Sensor{ID: "1", Alarms: Alarm{LowVoltage: testDate}, Channels: []Channel{{Type: "email", Target: "owner@example.com", AttachReadings: true}}}, history: history},
+		{sensor: Sensor{ID: "2", Alarms: Alarm{LowVoltage: testDate}, Channels: []Channel{{Type: "email", Target: "owner@example.com"}}}, history: history},
+	})
+
+	events := email.Calls[0].Arguments.Get(1).([]AlarmEvent)
+	mailer := mailerMock{}
+	e := emailNotifier{tenants: &tenants{fallback: &tenant{mailer: &mailer}}, templates: testTemplates}
+	if err := e.Notify(context.Background(), Channel{Type: "email", Target: "owner@example.com"}, events); err != nil {
+		t.Fatal(err)
+	}
+	attachments := mailer.sent[0].Attachments
+	if len(attachments) != 1 || attachments[0].Filename != "readings-1.csv" || attachments[0].ContentType != "text/csv" {
+		t.Errorf("expected the readings of sensor 1 only, got %+v", attachments)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/mailgun/mailgun-go/v3"
+)
+
+// maxLocalPart is the longest local part of an address mail servers have to accept, RFC 5321.
+const maxLocalPart = 64
+
+// replyAddress adds the token to the local part of an address, support@example.com
+// becomes support+<token>@example.com, so replies can be routed back to the server.
+// The address is left as it is when the local part would get too long.
+func replyAddress(address, token string) string {
+	a, err := netmail.ParseAddress(address)
+	if err != nil {
+		return address
+	}
+	i := strings.LastIndexByte(a.Address, '@')
+	if i+1+len(token) > maxLocalPart {
+		return address
+	}
+	a.Address = a.Address[:i] + "+" + token + a.Address[i:]
+	if a.Name == "" {
+		return a.Address
+	}
+	return a.String()
+}
+
+// replyToken finds the token in the recipient of a reply.
+func replyToken(recipient string) string {
+	at := strings.LastIndexByte(recipient, '@')
+	plus := strings.IndexByte(recipient, '+')
+	if plus < 0 || at < plus {
+		return ""
+	}
+	return recipient[plus+1 : at]
+}
+
+// replyCommand is a command in the first line of a reply to an alarm mail.
+type replyCommand struct {
+	name     string // snooze, ack, stop or status
+	alarm    string // alarm type of snooze and stop, empty for all
+	duration time.Duration
+}
+
+const replyHelp = `Reply with one of these commands to act on the sensors of the mail:
+snooze <duration> [alarm]  e.g. snooze 3d, or snooze 12h gps
+ack                        acknowledge the alarms
+stop [alarm]               stop all alarms, or e.g. stop gps
+status                     show the status of the sensors
+Anything else is passed on to the coordinators.`
+
+// parseReply reads the command in the first line of a reply. Replies that do not start with
+// a command are free text. A command that cannot be used returns an error.
+func parseReply(text string) (replyCommand, bool, error) {
+	var line string
+	for _, l := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(l); line != "" {
+			break
+		}
+	}
+	args := strings.Fields(strings.ToLower(strings.TrimRight(line, ".!")))
+	if len(args) == 0 {
+		return replyCommand{}, false, nil
+	}
+	c := replyCommand{name: args[0]}
+	args = args[1:]
+	switch {
+	case c.name == "ack" && len(args) == 0, c.name == "status" && len(args) == 0:
+	case c.name == "stop" && len(args) <= 1:
+		if len(args) == 1 {
+			c.alarm = args[0]
+		}
+	case c.name == "snooze" && len(args) >= 1 && len(args) <= 2:
+		d, err := parseSnoozeDuration(args[0])
+		if err != nil {
+			return c, true, err
+		}
+		c.duration = d
+		if len(args) == 2 {
+			c.alarm = args[1]
+		}
+	default:
+		return replyCommand{}, false, nil
+	}
+	if c.alarm != "" && !validAlarm(c.alarm) {
+		return c, true, fmt.Errorf("unknown alarm type %s, use %s, %s or %s", c.alarm, AlarmOffline, AlarmVoltage, AlarmGPS)
+	}
+	return c, true, nil
+}
+
+// apply runs the command for the sensor on behalf of the address and describes the outcome.
+func (c replyCommand) apply(s *Sensor, address string, location *time.Location, now time.Time) string {
+	alarms := "The alarms"
+	if c.alarm != "" {
+		alarms = "The " + c.alarm + " alarms"
+	}
+	switch c.name {
+	case "snooze":
+		until := now.Add(c.duration)
+		s.snooze(Snooze{Alarm: c.alarm, Until: until, Reason: "snoozed by a reply from " + address}, now)
+		return fmt.Sprintf("%s of sensor %s are snoozed until %s.", alarms, s.ID, formatDate("en", until.In(sensorLocation(*s, location))))
+	case "ack":
+		switch s.acknowledge(time.Time{}, address, now) {
+		case errAcknowledged:
+			return fmt.Sprintf("The alarms of sensor %s were acknowledged already.", s.ID)
+		case errNoIncident:
+			return fmt.Sprintf("Sensor %s has no alarms.", s.ID)
+		}
+		return fmt.Sprintf("The alarms of sensor %s are acknowledged.", s.ID)
+	case "stop":
+		if s.unsubscribe(address, c.alarm) != nil {
+			return fmt.Sprintf("%s does not get the alarms of sensor %s.", address, s.ID)
+		}
+		return fmt.Sprintf("%s of sensor %s are no longer sent to %s.", alarms, s.ID, address)
+	}
+	return ""
+}
+
+// mailgunInbound handles the mails a Mailgun route forwards, the replies to alarm mails.
+// The token in the reply address names the subscriptions of the mail and the address it went to.
+// Commands from that address are applied to the sensors and answered, other replies are
+// passed on to the admins.
+func (a *apiServer) mailgunInbound(w http.ResponseWriter, r *http.Request) {
+	if a.mailgun == nil {
+		http.NotFound(w, r)
+		return
+	}
+	now := nowFunc()
+	if ok, err := a.mailgun.VerifyWebhookRequest(r); err != nil || !ok || !freshSignature(mailgun.Signature{TimeStamp: r.FormValue("timestamp")}, now) {
+		apiError(w, http.StatusNotAcceptable, "invalid signature")
+		return
+	}
+	if autoReply(r.FormValue("message-headers")) {
+		w.WriteHeader(http.StatusOK) // out of office and the like
+		return
+	}
+
+	from := r.FormValue("from")
+	sender := r.FormValue("sender")
+	if addr, err := netmail.ParseAddress(from); err == nil {
+		sender = addr.Address
+	}
+	text := r.FormValue("stripped-text")
+	if text == "" {
+		text = r.FormValue("body-plain")
+	}
+	documents, err := a.links.verifyReply(replyToken(r.FormValue("recipient")), sender)
+	if err != nil {
+		log.Printf("reply from %s without a valid reply address: %v", sender, err)
+		a.alerts.send(r.Context(), "Unverified reply from "+sender, forwardedReply(from, r.FormValue("subject"), text))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var subs []Sensor
+	var sensors []string
+	for _, id := range documents {
+		s, err := a.sensors.Find(r.Context(), id)
+		if err != nil {
+			if err != ErrSensorNotFound {
+				log.Printf("unable to find subscription %s of a reply: %v", id, err)
+			}
+			continue
+		}
+		subs = append(subs, s)
+		sensors = append(sensors, s.ID)
+	}
+	if len(subs) == 0 {
+		a.answerReply(r.Context(), "", sender, r.FormValue("subject"), "The sensors of the mail are no longer monitored.")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	about := "sensor " + strings.Join(sensors, ", ")
+	if len(sensors) > 1 {
+		about = "sensors " + strings.Join(sensors, ", ")
+	}
+	var answer []string
+	c, isCommand, err := parseReply(text)
+	switch {
+	case !isCommand:
+		a.alerts.send(r.Context(), "Reply about "+about+" from "+sender, forwardedReply(from, r.FormValue("subject"), text))
+		answer = append(answer, "Thank you, your message about "+about+" was passed on to the coordinators.")
+	case err != nil:
+		answer = append(answer, err.Error(), "", replyHelp)
+	case c.name == "status":
+		for _, s := range subs {
+			answer = append(answer, telegramStatus(s, a.location), "")
+		}
+	default:
+		for _, s := range subs {
+			var line string
+			_, err := a.updateSensor(r.Context(), s.DocumentID, func(s *Sensor) {
+				line = c.apply(s, sender, a.location, now)
+			})
+			switch {
+			case err == ErrSensorNotFound:
+				line = fmt.Sprintf("Sensor %s is not monitored.", s.ID)
+			case err != nil:
+				log.Printf("unable to %s sensor %s from a reply: %v", c.name, s.ID, err)
+				line = fmt.Sprintf("Something went wrong with sensor %s, please try again later.", s.ID)
+			default:
+				log.Printf("%s: %s", sender, line)
+			}
+			answer = append(answer, line)
+		}
+	}
+	a.answerReply(r.Context(), subs[0].Tenant, sender, r.FormValue("subject"), strings.Join(answer, "\n"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// answerReply mails the outcome of a reply back to the sender, using the tenant.
+func (a *apiServer) answerReply(ctx context.Context, tenant, to, subject, text string) {
+	if a.tenants == nil {
+		return
+	}
+	t := a.tenants.lookup(tenant)
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	msg := t.message(to, subject, "Hi,\n\n"+strings.TrimSpace(text)+"\n"+t.signatureBlock())
+	msg.Headers = map[string]string{"Auto-Submitted": "auto-replied"}
+	if _, err := t.mailer.Send(ctx, msg); err != nil {
+		log.Printf("unable to answer the reply of %s: %v", to, err)
+	}
+}
+
+func forwardedReply(from, subject, text string) string {
+	return "From: " + from + "\nSubject: " + subject + "\n\n" + text + "\n"
+}
+
+// autoReply tells whether the headers Mailgun passes on mark an automatic mail, see RFC 3834.
+func autoReply(headers string) bool {
+	var hs [][]string
+	if json.Unmarshal([]byte(headers), &hs) != nil {
+		return false
+	}
+	for _, h := range hs {
+		if len(h) == 2 && strings.EqualFold(h[0], "Auto-Submitted") && !strings.EqualFold(strings.TrimSpace(h[1]), "no") {
+			return true
+		}
+	}
+	return false
+}
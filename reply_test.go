@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/mailgun/mailgun-go/v3"
+)
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		text        string
+		want        replyCommand
+		wantCommand bool
+		wantErr     bool
+	}{
+		{text: "snooze 3d", want: replyCommand{name: "snooze", duration: 72 * time.Hour}, wantCommand: true},
+		{text: "\n  Snooze 12h GPS\n\nOn Wed, the monitor wrote:", want: replyCommand{name: "snooze", alarm: AlarmGPS, duration: 12 * time.Hour}, wantCommand: true},
+		{text: "ack", want: replyCommand{name: "ack"}, wantCommand: true},
+		{text: "Stop gps.", want: replyCommand{name: "stop", alarm: AlarmGPS}, wantCommand: true},
+		{text: "stop", want: replyCommand{name: "stop"}, wantCommand: true},
+		{text: "status", want: replyCommand{name: "status"}, wantCommand: true},
+		{text: "snooze forever", wantCommand: true, wantErr: true},
+		{text: "stop radio", wantCommand: true, wantErr: true},
+		{text: "I'm replacing the battery tomorrow"},
+		{text: "Stop sending me these, the sensor moved to my neighbour"},
+		{text: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			c, isCommand, err := parseReply(tt.text)
+			if isCommand != tt.wantCommand || (err != nil) != tt.wantErr {
+				t.Fatalf("expected command %v and error %v, got %v and %v", tt.wantCommand, tt.wantErr, isCommand, err)
+			}
+			if diff := deep.Equal(c, tt.want); err == nil && diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestReplyAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{address: "support@example.com", want: "support+abc-123@example.com"},
+		{address: "Support <support@example.com>", want: `"Support" <support+abc-123@example.com>`},
+		{address: "not an address", want: "not an address"},
+	}
+
+	for _, tt := range tests {
+		if got := replyAddress(tt.address, "abc-123"); got != tt.want {
+			t.Errorf("expected %s, got %s", tt.want, got)
+		}
+	}
+	// the token of a digest about many subscriptions does not fit in the local part
+	long := testLinks.replyToken([]string{"AbCdEfGhIjKlMnOpQrSt", "TsRqPoNmLkJiHgFeDcBa"}, "owner@example.com")
+	if got := replyAddress("support@example.com", long); got != "support@example.com" {
+		t.Errorf("expected the address to be left as it is, got %s", got)
+	}
+	if token := testLinks.replyToken([]string{"AbCdEfGhIjKlMnOpQrSt"}, "owner@example.com"); replyAddress("support@example.com", token) == "support@example.com" {
+		t.Errorf("expected the token of one subscription to fit, got %s", token)
+	}
+	if got := replyToken("support+abc-123@example.com"); got != "abc-123" {
+		t.Errorf("expected the token, got %q", got)
+	}
+}
+
+// inboundForm is a signed Mailgun route request for a mail.
+func inboundForm(key string, fields url.Values, at time.Time) *http.Request {
+	fields.Set("timestamp", strconv.FormatInt(at.Unix(), 10))
+	fields.Set("token", "0123456789abcdef0123456789abcdef0123456789abcdef50")
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(fields.Get("timestamp") + fields.Get("token")))
+	fields.Set("signature", hex.EncodeToString(mac.Sum(nil)))
+	r := httptest.NewRequest("POST", "/mailgun/inbound", strings.NewReader(fields.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestMailgunInbound(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	// the reply address of an alarm mail about two sensors
+	mailer := mailerMock{}
+	d := digest{recipient: "owner@example.com"}
+	for _, id := range []string{"123", "124"} {
+		d.sections = append(d.sections, sensorStatus{sensor: Sensor{ID: id, DocumentID: "sub" + id, Alarms: Alarm{GpsMissing: testDate}}, reading: Reading{Date: testDate}})
+	}
+	if _, err := sendDigest(context.Background(), testTemplates, testLinks, &tenant{mailer: &mailer, replyTo: "support@example.com"}, d); err != nil {
+		t.Fatal(err)
+	}
+	replyTo := mailer.sent[0].ReplyTo
+	if !strings.HasPrefix(replyTo, "support+") {
+		t.Fatalf("expected a reply address with a token, got %s", replyTo)
+	}
+
+	tests := []struct {
+		name       string
+		from       string
+		text       string
+		headers    string
+		want       []Channel // of sensor 124
+		wantSnooze bool
+		wantAnswer string
+		wantAdmin  string
+	}{
+		{
+			name:       "snooze",
+			from:       "Owner <Owner@example.com>",
+			text:       "snooze 3d\n\n> Sensor 123 has no GPS fix",
+			wantSnooze: true,
+			wantAnswer: "The alarms of sensor 124 are snoozed until",
+		},
+		{
+			name:       "stop",
+			from:       "OWNER@example.com",
+			text:       "stop gps",
+			want:       []Channel{{Type: "email", Target: "owner@example.com", Muted: []string{AlarmGPS}}},
+			wantAnswer: "The gps alarms of sensor 124 are no longer sent to OWNER@example.com.",
+		},
+		{
+			name:       "status",
+			from:       "owner@example.com",
+			text:       "status",
+			wantAnswer: "Sensor 124\nAlarms: no GPS fix",
+		},
+		{
+			name:       "free text",
+			from:       "owner@example.com",
+			text:       "I'm replacing the battery tomorrow",
+			wantAnswer: "was passed on to the coordinators",
+			wantAdmin:  "Reply about sensors 123, 124 from owner@example.com",
+		},
+		{
+			name:      "other sender",
+			from:      "someone@example.org",
+			text:      "stop",
+			wantAdmin: "Unverified reply from someone@example.org",
+		},
+		{
+			name:    "auto reply",
+			from:    "owner@example.com",
+			text:    "I am out of office",
+			headers: `[["Auto-Submitted", "auto-replied"]]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := sensorStoreMock{sensors: map[string]Sensor{
+				"sub123": {ID: "123", EmailAddress: "owner@example.com", Alarms: Alarm{GpsMissing: testDate}},
+				"sub124": {ID: "124", Channels: []Channel{{Type: "email", Target: "owner@example.com"}}, Alarms: Alarm{GpsMissing: testDate}},
+				// someone else's subscription to the same sensor
+				"other": {ID: "124", Channels: []Channel{{Type: "email", Target: "owner@example.com"}}},
+			}}
+			owner := mailerMock{}
+			admin := mailerMock{}
+			a := apiServer{
+				sensors: &store,
+				links:   testLinks,
+				mailgun: mailgun.NewMailgun("", "webhook-key"),
+				alerts:  &adminAlerts{tenant: &tenant{mailer: &admin}, to: []string{"admin@example.com"}},
+				tenants: &tenants{fallback: &tenant{mailer: &owner}},
+			}
+			form := url.Values{
+				"recipient":       {replyTo},
+				"from":            {tt.from},
+				"subject":         {"Re: Problems with Meet je stad sensors"},
+				"stripped-text":   {tt.text},
+				"message-headers": {tt.headers},
+			}
+			rec := httptest.NewRecorder()
+			a.routes().ServeHTTP(rec, inboundForm("webhook-key", form, testDate))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected the mail to be taken, got %d: %s", rec.Code, rec.Body)
+			}
+
+			want := tt.want
+			if want == nil {
+				want = []Channel{{Type: "email", Target: "owner@example.com"}}
+			}
+			if diff := deep.Equal(store.sensors["sub124"].Channels, want); diff != nil {
+				t.Error(diff)
+			}
+			if snoozed := len(store.sensors["sub124"].Snoozes) > 0; snoozed != tt.wantSnooze {
+				t.Errorf("expected snoozed %v, got %+v", tt.wantSnooze, store.sensors["sub124"].Snoozes)
+			}
+			if other := store.sensors["other"]; len(other.Channels[0].Muted) > 0 || len(other.Snoozes) > 0 {
+				t.Errorf("expected the other subscription to be kept, got %+v", other)
+			}
+			switch {
+			case tt.wantAnswer == "" && len(owner.sent) > 0:
+				t.Errorf("expected no answer, got %+v", owner.sent)
+			case tt.wantAnswer != "" && (len(owner.sent) != 1 || !strings.EqualFold(owner.sent[0].To, "owner@example.com") || !strings.Contains(owner.sent[0].Text, tt.wantAnswer)):
+				t.Errorf("expected an answer with %q, got %+v", tt.wantAnswer, owner.sent)
+			}
+			switch {
+			case tt.wantAdmin == "" && len(admin.sent) > 0:
+				t.Errorf("expected nothing for the admins, got %+v", admin.sent)
+			case tt.wantAdmin != "" && (len(admin.sent) != 1 || admin.sent[0].Subject != tt.wantAdmin || !strings.Contains(admin.sent[0].Text, tt.text)):
+				t.Errorf("expected %q for the admins, got %+v", tt.wantAdmin, admin.sent)
+			}
+		})
+	}
+
+	a := apiServer{sensors: &sensorStoreMock{}, links: testLinks, mailgun: mailgun.NewMailgun("", "webhook-key")}
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, inboundForm("other-key", url.Values{"recipient": {replyTo}}, testDate))
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("expected a request with another key to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// reportReadingsPerHour is the most readings per hour a sensor is expected to send, it decides
+// how many readings are fetched to cover the period of a report.
+const reportReadingsPerHour = 12
+
+// ownerReporter mails the periodic status reports to the owners of the sensors.
+type ownerReporter struct {
+	tenants  *tenants
+	readings sensorReader
+	links    *linkSigner // signs the link to stop the reports, nil for none
+	verify   bool        // only mail confirmed addresses
+}
+
+// send mails a status overview of the period from start to end to every recipient
+// that opted in to reports. Like alarms, the reports go to the e-mail channels of the sensors
+// that did not unsubscribe, are deliverable and, when verify is set, were confirmed.
+func (r *ownerReporter) send(ctx context.Context, statuses []sensorStatus, start, end time.Time) {
+	limit := int(end.Sub(start).Hours()+1) * reportReadingsPerHour
+
+	var reports digests
+	for _, st := range statuses {
+		if !st.sensor.Reports {
+			continue
+		}
+		targets := reportTargets(st.sensor, r.verify)
+		if len(targets) == 0 {
+			continue
+		}
+		history, err := r.readings.History(st.sensor.ID, limit)
+		if err != nil {
+			log.Printf("unable to get the readings of sensor %s for its report: %v", st.sensor.ID, err)
+			continue
+		}
+		st.history = history
+		for _, to := range targets {
+			reports.addTo(to, st)
+		}
+	}
+
+	now := nowFunc()
+	for _, d := range reports.all() {
+		t := r.tenants.lookup(d.sections[0].sensor.Tenant)
+		var ids, documents []string
+		for _, sec := range d.sections {
+			ids = append(ids, sec.sensor.ID)
+			documents = append(documents, sec.sensor.DocumentID)
+		}
+		unsubscribe := r.links.url("/unsubscribe", linkClaims{
+			Action:    actionUnsubscribe,
+			Target:    d.recipient,
+			Sensors:   ids,
+			Documents: documents,
+			Alarm:     mutedReports,
+			Expires:   now.Add(unsubscribeExpiry).Unix(),
+		}, now)
+
+		msg := t.message(d.recipient, "Status of your Meet je stad sensors", composeOwnerReport(d, t, start, end, unsubscribe))
+		msg.Variables = map[string]string{"sensors": strings.Join(ids, ",")}
+		if unsubscribe != "" {
+			// RFC 8058 one-click unsubscribe
+			msg.Headers = map[string]string{
+				"List-Unsubscribe":      "<" + unsubscribe + ">",
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			}
+		}
+		if _, err := t.mailer.Send(ctx, msg); err != nil {
+			log.Printf("failed to send status report to %s: %v", d.recipient, err)
+		}
+	}
+}
+
+// reportTargets returns the addresses of the e-mail channels of the sensor that get its reports.
+func reportTargets(s Sensor, verify bool) []string {
+	var res []string
+	for _, c := range subscriptionChannels(s) {
+		if c.Type != "email" || c.Disabled || !c.Undeliverable.IsZero() || contains(c.Muted, mutedReports) {
+			continue
+		}
+		if verify && !s.verified(c) {
+			continue
+		}
+		if address := channelTarget(s, c); address != "" && !contains(res, address) {
+			res = append(res, address)
+		}
+	}
+	return res
+}
+
+// composeOwnerReport writes the report of the period from start to end. The history of
+// the sections has to cover the period.
+func composeOwnerReport(d digest, t *tenant, start, end time.Time, unsubscribe string) string {
+	sb := strings.Builder{}
+	sb.WriteString("Hi,\n\n")
+	sb.WriteString("This is the periodic overview of your Meet je stad weather sensors.\n\n")
+
+	for _, sec := range d.sections {
+		s := sec.sensor
+		sb.WriteString(fmt.Sprintf("Sensor %s\n", s.ID))
+		if sec.reading.Date.IsZero() {
+			sb.WriteString("  Last seen:   never\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("  Last seen:   %s\n", sec.reading.Date.Format(time.RFC822)))
+		}
+		sb.WriteString(fmt.Sprintf("  Uptime:      %d%% since %s\n", uptime(sec.history, start, end), start.Format(time.RFC822)))
+		sb.WriteString(fmt.Sprintf("  Voltage:     %.2fV, %s\n", sec.reading.Voltage, describeTrend(voltageTrend(sec.history))))
+		sb.WriteString(fmt.Sprintf("  Firmware:    %s\n", orUnknown(sec.reading.Firmware)))
+		sb.WriteString(fmt.Sprintf("  Health:      %d/100\n", s.Health.Score))
+		sb.WriteString(fmt.Sprintf("  Open alarms: %s\n\n", describeAlarms(s.Alarms)))
+	}
+
+	if unsubscribe != "" {
+		sb.WriteString("To stop these reports: " + unsubscribe + "\n")
+	}
+	sb.WriteString(strings.TrimPrefix(t.signatureBlock(), "\n"))
+
+	return sb.String()
+}
+
+// voltageTrend returns the change in voltage per day using a least squares fit of the readings.
+func voltageTrend(readings []Reading) float64 {
+	if len(readings) < 2 {
+		return 0
+	}
+
+	origin := readings[0].Date
+	var sx, sy, sxx, sxy float64
+	for _, r := range readings {
+		x := r.Date.Sub(origin).Hours() / 24
+		y := float64(r.Voltage)
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+
+	n := float64(len(readings))
+	denominator := n*sxx - sx*sx
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / denominator
+}
+
+func describeTrend(perDay float64) string {
+	if math.Abs(perDay) < 0.005 {
+		return "stable"
+	}
+	if perDay < 0 {
+		return fmt.Sprintf("dropping %.2fV per day", -perDay)
+	}
+	return fmt.Sprintf("rising %.2fV per day", perDay)
+}
+
+func describeAlarms(a Alarm) string {
+	var open []string
+	if !a.Offline.IsZero() {
+		open = append(open, "offline")
+	}
+	if !a.LowVoltage.IsZero() {
+		open = append(open, "low battery")
+	}
+	if !a.GpsMissing.IsZero() {
+		open = append(open, "no GPS fix")
+	}
+	if len(open) == 0 {
+		return "none"
+	}
+	return strings.Join(open, ", ")
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestComposeOwnerReport(t *testing.T) {
+	draining := []Reading{
+		{Date: testDate.Add(-48 * time.Hour), Voltage: 3.5},
+		{Date: testDate.Add(-24 * time.Hour), Voltage: 3.4},
+		{Date: testDate, Voltage: 3.3},
+	}
+
+	d := digest{
+		recipient: "owner@example.com",
+		sections: []sensorStatus{
+			{
+				sensor: Sensor{
+					ID:     "123",
+					Health: Health{Score: 87, Components: HealthComponents{Uptime: 96}},
+				},
+				reading: Reading{Date: testDate, Voltage: 3.3, Firmware: "v3"},
+				history: draining,
+			},
+			{
+				sensor: Sensor{
+					ID:     "456",
+					Alarms: Alarm{Offline: testDate, LowVoltage: testDate},
+				},
+			},
+		},
+	}
+
+	if diff := deep.Equal(composeOwnerReport(d, testTenant, testDate.AddDate(0, 0, -7), testDate, ""), fixture("owner-report")); diff != nil {
+		t.Errorf("report failed: %v", diff)
+	}
+}
+
+func TestSendOwnerReports(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	m := &mailerMock{}
+	ts := &tenants{fallback: &tenant{mailer: m, from: "alert@monitoring.meetjescraper.online"}}
+	week := []Reading{{Date: testDate.Add(-100 * time.Hour), Voltage: 3.4}, {Date: testDate, Voltage: 3.3}}
+
+	c := &sensorReaderMock{}
+	c.On("History", "123", 169*reportReadingsPerHour).Return(week, nil)
+	c.On("History", "789", 169*reportReadingsPerHour).Return([]Reading(nil), errors.New("test error"))
+
+	confirmed := []Verification{{Address: "owner@example.com", Confirmed: testDate}}
+	statuses := []sensorStatus{
+		{sensor: Sensor{ID: "123", EmailAddress: "owner@example.com", Reports: true, Verifications: confirmed}, reading: Reading{Date: testDate, Voltage: 3.3}},
+		{sensor: Sensor{ID: "456", EmailAddress: "owner@example.com", Verifications: confirmed}},
+		{sensor: Sensor{ID: "789", EmailAddress: "other@example.com", Reports: true, Verifications: []Verification{{Address: "other@example.com", Confirmed: testDate}}}},
+		{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com", Reports: true, Verifications: confirmed, Channels: []Channel{
+			{Type: "email", Disabled: true},
+			{Type: "email", Target: "bounced@example.com", Undeliverable: testDate},
+			{Type: "email", Target: "muted@example.com", Muted: []string{mutedReports}},
+			{Type: "email", Target: "unconfirmed@example.com"},
+		}}},
+	}
+	r := ownerReporter{tenants: ts, readings: c, links: testLinks, verify: true}
+	r.send(context.Background(), statuses, testDate.AddDate(0, 0, -7), testDate)
+
+	c.AssertExpectations(t)
+	if len(m.sent) != 1 || m.sent[0].To != "owner@example.com" {
+		t.Fatalf("expected one report for owner@example.com, got %+v", m.sent)
+	}
+	if !strings.Contains(m.sent[0].Text, "Uptime:      1% since 26 Jun 19 23:12 UTC") || strings.Contains(m.sent[0].Text, "Sensor 456") {
+		t.Errorf("unexpected report:\n%s", m.sent[0].Text)
+	}
+	unsubscribe := strings.TrimSuffix(strings.TrimPrefix(m.sent[0].Headers["List-Unsubscribe"], "<"), ">")
+	if !strings.HasPrefix(unsubscribe, "https://monitor.example.com/unsubscribe?t=") || !strings.Contains(m.sent[0].Text, unsubscribe) {
+		t.Fatalf("expected an unsubscribe link in the header and the text, got %q", unsubscribe)
+	}
+	u, _ := url.Parse(unsubscribe)
+	claims, err := testLinks.verify(u.Query().Get("t"), actionUnsubscribe, testDate)
+	if err != nil || claims.Alarm != mutedReports || claims.Target != "owner@example.com" {
+		t.Errorf("expected a link to stop the reports, got %+v, %v", claims, err)
+	}
+}
+
+func TestReportTargets(t *testing.T) {
+	s := Sensor{EmailAddress: "owner@example.com", Channels: []Channel{
+		{Type: "email"},
+		{Type: "email", Target: "friend@example.com"},
+		{Type: "webhook", Target: "https://example.com/hook"},
+	}, Verifications: []Verification{{Address: "owner@example.com", Confirmed: testDate}, {Address: "friend@example.com", Sent: testDate}}}
+
+	if diff := deep.Equal(reportTargets(s, false), []string{"owner@example.com", "friend@example.com"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(reportTargets(s, true), []string{"owner@example.com"}); diff != nil {
+		t.Errorf("unverified addresses failed: %v", diff)
+	}
+}
+
+func TestVoltageTrend(t *testing.T) {
+	tests := []struct {
+		name     string
+		readings []Reading
+		want     string
+	}{
+		{
+			name: "no readings",
+			want: "stable",
+		},
+		{
+			name: "rising",
+			readings: []Reading{
+				{Date: testDate, Voltage: 3.2},
+				{Date: testDate.Add(12 * time.Hour), Voltage: 3.3},
+			},
+			want: "rising 0.20V per day",
+		},
+		{
+			name: "same time",
+			readings: []Reading{
+				{Date: testDate, Voltage: 3.2},
+				{Date: testDate, Voltage: 3.3},
+			},
+			want: "stable",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := describeTrend(voltageTrend(tt.readings)); got != tt.want {
+			t.Errorf("%s failed: %q != %q", tt.name, got, tt.want)
+		}
+	}
+}
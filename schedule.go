@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a recurring moment such as "Mondays 08:00 Europe/Amsterdam",
+// "daily 07:30" or "monthly 1 08:00 UTC".
+type schedule struct {
+	weekly   bool
+	weekday  time.Weekday
+	monthly  bool
+	monthDay int
+	hour     int
+	minute   int
+	location *time.Location
+	upcoming time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseSchedule parses a schedule. An empty string gives a nil schedule which is never due.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	s := schedule{location: time.UTC}
+
+	when := strings.ToLower(fields[0])
+	fields = fields[1:]
+	switch {
+	case when == "daily":
+	case when == "monthly":
+		s.monthly = true
+		s.monthDay = 1
+		if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+			day, err := strconv.Atoi(fields[0])
+			if err != nil || day < 1 || day > 28 {
+				return nil, fmt.Errorf("invalid day of month in schedule %q", spec)
+			}
+			s.monthDay = day
+			fields = fields[1:]
+		}
+	default:
+		wd, ok := weekdays[strings.TrimSuffix(when, "s")]
+		if !ok {
+			return nil, fmt.Errorf("invalid day in schedule %q, use a weekday, daily or monthly", spec)
+		}
+		s.weekly = true
+		s.weekday = wd
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing time of day in schedule %q", spec)
+	}
+	t, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid time of day in schedule %q: %v", spec, err)
+	}
+	s.hour, s.minute = t.Hour(), t.Minute()
+
+	if len(fields) > 1 {
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone in schedule %q: %v", spec, err)
+		}
+		s.location = loc
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("unexpected %q in schedule %q", strings.Join(fields[2:], " "), spec)
+	}
+
+	return &s, nil
+}
+
+// next returns the first moment of the schedule after t.
+func (s *schedule) next(t time.Time) time.Time {
+	local := t.In(s.location)
+	n := time.Date(local.Year(), local.Month(), local.Day(), s.hour, s.minute, 0, 0, s.location)
+
+	switch {
+	case s.monthly:
+		n = time.Date(local.Year(), local.Month(), s.monthDay, s.hour, s.minute, 0, 0, s.location)
+		if !n.After(t) {
+			n = n.AddDate(0, 1, 0)
+		}
+	case s.weekly:
+		days := (int(s.weekday) - int(n.Weekday()) + 7) % 7
+		n = n.AddDate(0, 0, days)
+		if !n.After(t) {
+			n = n.AddDate(0, 0, 7)
+		}
+	default:
+		if !n.After(t) {
+			n = n.AddDate(0, 0, 1)
+		}
+	}
+
+	return n
+}
+
+// start returns the beginning of the period of the schedule that ends at end:
+// a day, a week or a month before it.
+func (s *schedule) start(end time.Time) time.Time {
+	switch {
+	case s.monthly:
+		return end.AddDate(0, -1, 0)
+	case s.weekly:
+		return end.AddDate(0, 0, -7)
+	default:
+		return end.AddDate(0, 0, -1)
+	}
+}
+
+// due tells whether the schedule's moment has passed since the previous call.
+// The first call only determines the upcoming moment.
+func (s *schedule) due(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	if s.upcoming.IsZero() {
+		s.upcoming = s.next(now)
+		return false
+	}
+	if now.Before(s.upcoming) {
+		return false
+	}
+	s.upcoming = s.next(now)
+	return true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a Wednesday
+	now := time.Date(2019, 7, 3, 23, 12, 45, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "weekly in a time zone",
+			spec: "Mondays 08:00 Europe/Amsterdam",
+			want: time.Date(2019, 7, 8, 8, 0, 0, 0, amsterdam),
+		},
+		{
+			name: "weekly later the same day",
+			spec: "wednesday 23:30",
+			want: time.Date(2019, 7, 3, 23, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "weekly earlier the same day",
+			spec: "Wednesdays 08:00",
+			want: time.Date(2019, 7, 10, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "daily",
+			spec: "daily 07:30 UTC",
+			want: time.Date(2019, 7, 4, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "monthly defaults to the first",
+			spec: "monthly 08:00",
+			want: time.Date(2019, 8, 1, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "monthly on a given day",
+			spec: "monthly 15 08:00",
+			want: time.Date(2019, 7, 15, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "unknown day",
+			spec:    "someday 08:00",
+			wantErr: true,
+		},
+		{
+			name:    "missing time",
+			spec:    "Mondays",
+			wantErr: true,
+		},
+		{
+			name:    "unknown time zone",
+			spec:    "Mondays 08:00 Nowhere/Town",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("%s failed: %v", tt.name, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("%s expected error", tt.name)
+			continue
+		}
+		if got := s.next(now); !got.Equal(tt.want) {
+			t.Errorf("%s failed: %v != %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleDue(t *testing.T) {
+	s, err := parseSchedule("daily 08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2019, 7, 3, 7, 0, 0, 0, time.UTC)
+	checks := []struct {
+		at   time.Time
+		want bool
+	}{
+		{at: start, want: false},
+		{at: start.Add(30 * time.Minute), want: false},
+		{at: start.Add(90 * time.Minute), want: true},
+		{at: start.Add(150 * time.Minute), want: false},
+		{at: start.Add(25 * time.Hour), want: true},
+	}
+
+	for _, c := range checks {
+		if got := s.due(c.at); got != c.want {
+			t.Errorf("due at %v: %v != %v", c.at, got, c.want)
+		}
+	}
+
+	var none *schedule
+	if none.due(start) {
+		t.Error("nil schedule should never be due")
+	}
+}
+
+func TestScheduleStart(t *testing.T) {
+	end := time.Date(2019, 7, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{spec: "daily 08:00", want: time.Date(2019, 6, 30, 8, 0, 0, 0, time.UTC)},
+		{spec: "Mondays 08:00", want: time.Date(2019, 6, 24, 8, 0, 0, 0, time.UTC)},
+		{spec: "monthly 08:00", want: time.Date(2019, 6, 1, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.start(end); !got.Equal(tt.want) {
+			t.Errorf("%s: start %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
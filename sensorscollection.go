@@ -5,9 +5,14 @@ import (
 	"context"
 	"errors"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"time"
 )
 
 var ErrSensorEOF = errors.New("no more sensors")
+var ErrSensorNotFound = errors.New("sensor not found")
 
 type SensorIteratable interface {
 	Next(ctx context.Context, s *Sensor) error
@@ -16,6 +21,7 @@ type SensorIteratable interface {
 }
 
 type SensorCollection struct {
+	client     *firestore.Client // runs the transactions of Store and Update
 	collection *firestore.CollectionRef
 	iterator   *firestore.DocumentIterator
 }
@@ -38,6 +44,7 @@ func (s *SensorCollection) Next(ctx context.Context, sensor *Sensor) error {
 	}
 
 	sensor.DocumentID = snapshot.Ref.ID
+	sensor.Created = snapshot.CreateTime
 
 	return nil
 }
@@ -49,13 +56,159 @@ func (s *SensorCollection) Stop() {
 	s.iterator = nil
 }
 
+// Store saves what a check found out about the sensor. The sensor is read again in a
+// transaction, so changes made to it since the check read it are kept, see applyCheck.
 func (a *SensorCollection) Store(ctx context.Context, sensor Sensor) error {
 	doc := a.collection.Doc(sensor.DocumentID)
-	_, err := doc.Update(ctx, []firestore.Update{
-		{Path: "alarms", Value: sensor.Alarms},
+	return a.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			return err
+		}
+		var stored Sensor
+		if err := snapshot.DataTo(&stored); err != nil {
+			return err
+		}
+		stored.applyCheck(sensor)
+		return tx.Update(doc, []firestore.Update{
+			{Path: "alarms", Value: stored.Alarms},
+			{Path: "raised", Value: stored.Raised},
+			{Path: "health", Value: stored.Health},
+			{Path: "channels", Value: stored.Channels},
+			{Path: "incident", Value: stored.Incident},
+			{Path: "verifications", Value: stored.Verifications},
+			{Path: "opt_in", Value: stored.OptIn},
+		})
 	})
+}
+
+// Update changes the subscription with the given document ID in a transaction, so changes
+// made at the same time, by a check or another process, are not lost. The change can be
+// called more than once when the subscription changes while it runs.
+func (a *SensorCollection) Update(ctx context.Context, id string, change func(s *Sensor)) (Sensor, error) {
+	var sensor Sensor
+	doc := a.collection.Doc(id)
+	err := a.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(doc)
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return ErrSensorNotFound
+			}
+			return err
+		}
+		sensor = Sensor{}
+		if err := snapshot.DataTo(&sensor); err != nil {
+			return err
+		}
+		sensor.DocumentID = snapshot.Ref.ID
+		sensor.Created = snapshot.CreateTime
+		change(&sensor)
+		return tx.Update(doc, []firestore.Update{
+			{Path: "channels", Value: sensor.Channels},
+			{Path: "snoozes", Value: sensor.Snoozes},
+			{Path: "incident", Value: sensor.Incident},
+			{Path: "verifications", Value: sensor.Verifications},
+		})
+	})
+	return sensor, err
+}
+
+// applyCheck takes the results of a check of the sensor over to s, the sensor as it is stored
+// now. The check read the sensor before, so the snoozes, acknowledgements, confirmed addresses
+// and channels that were changed in the meantime are kept.
+func (s *Sensor) applyCheck(checked Sensor) {
+	s.Alarms = checked.Alarms
+	s.Raised = checked.Raised
+	s.Health = checked.Health
+
+	// the check only records which alarms were queued for the channels
+	channels := append([]Channel(nil), subscriptionChannels(*s)...)
+	for i := range channels {
+		c := channels[i]
+		c.Target = channelTarget(*s, c)
+		if j := findChannel(checked, channelKey(c)); j >= 0 {
+			channels[i].Queued = checked.Channels[j].Queued
+		}
+	}
+	s.Channels = channels
+
+	acknowledged := s.Incident
+	s.Incident = checked.Incident
+	if acknowledged != nil && s.Incident != nil && acknowledged.Started.Equal(s.Incident.Started) &&
+		s.Incident.Acknowledged.IsZero() && !acknowledged.Acknowledged.IsZero() {
+		incident := *s.Incident
+		incident.Acknowledged = acknowledged.Acknowledged
+		incident.Steps = append([]IncidentStep(nil), incident.Steps...)
+		for _, step := range acknowledged.Steps {
+			if step.Action == stepAcknowledged {
+				incident.Steps = append(incident.Steps, step)
+			}
+		}
+		sort.SliceStable(incident.Steps, func(i, j int) bool {
+			return incident.Steps[i].Time.Before(incident.Steps[j].Time)
+		})
+		s.Incident = &incident
+	}
+
+	if s.OptIn.IsZero() {
+		s.OptIn = checked.OptIn
+	}
+	confirmed := s.Verifications
+	s.Verifications = append([]Verification(nil), checked.Verifications...)
+	for i := range s.Verifications {
+		vr := &s.Verifications[i]
+		for _, c := range confirmed {
+			if c.Address == vr.Address && !c.Confirmed.IsZero() && vr.Confirmed.IsZero() {
+				vr.Confirmed = c.Confirmed
+				vr.Expired = time.Time{}
+			}
+		}
+	}
+}
+
+// Find returns the subscription with the given document ID.
+func (s *SensorCollection) Find(ctx context.Context, id string) (Sensor, error) {
+	var sensor Sensor
+	snapshot, err := s.collection.Doc(id).Get(ctx)
 	if err != nil {
-		return err
+		if status.Code(err) == codes.NotFound {
+			return sensor, ErrSensorNotFound
+		}
+		return sensor, err
 	}
-	return nil
+	if err := snapshot.DataTo(&sensor); err != nil {
+		return sensor, err
+	}
+	sensor.DocumentID = snapshot.Ref.ID
+	sensor.Created = snapshot.CreateTime
+	return sensor, nil
+}
+
+// Subscriptions returns the subscriptions to the sensor with the given sensor ID,
+// several people can watch the same sensor.
+func (s *SensorCollection) Subscriptions(ctx context.Context, sensorID string) ([]Sensor, error) {
+	iter := s.collection.Where("sensor_id", "==", sensorID).Documents(ctx)
+	defer iter.Stop()
+
+	var res []Sensor
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var sensor Sensor
+		if err := snapshot.DataTo(&sensor); err != nil {
+			return nil, err
+		}
+		sensor.DocumentID = snapshot.Ref.ID
+		sensor.Created = snapshot.CreateTime
+		res = append(res, sensor)
+	}
+	if len(res) == 0 {
+		return nil, ErrSensorNotFound
+	}
+	return res, nil
 }
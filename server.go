@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/mailgun/mailgun-go/v3"
+)
+
+// mailSnooze is how long the snooze link in the alarm mails snoozes a sensor.
+const mailSnooze = 7 * 24 * time.Hour
+
+// apiServer serves the HTTP API and the pages the signed links in mails lead to.
+type apiServer struct {
+	sensors sensorStore
+	links   *linkSigner
+	token   string               // bearer token of the API, the API is off without one
+	mailgun *mailgun.MailgunImpl // verifies the event webhooks, they are off without it
+	alerts  *adminAlerts
+	tenants *tenants // mail the answers to replies
+	outbox  outbox
+	// location is the time zone for sensors that have none set
+	location *time.Location
+	// requests runs the changes in the main loop, between the checks, when it is set
+	requests chan func()
+}
+
+func newAPIServer(c HTTPConfig, sensors sensorStore, links *linkSigner) (*apiServer, error) {
+	a := apiServer{sensors: sensors, links: links}
+	if c.TokenPath != "" {
+		b, err := ioutil.ReadFile(c.TokenPath)
+		if err != nil {
+			return nil, err
+		}
+		a.token = strings.TrimSpace(string(b))
+	}
+	if c.MailgunKeyPath != "" {
+		mg, err := readWebhookKey(c.MailgunKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		a.mailgun = mg
+	}
+	return &a, nil
+}
+
+func (a *apiServer) routes() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/snooze", a.snoozePage)
+	r.Post("/snooze", a.snoozeLink)
+	r.Get("/ack", a.ackPage)
+	r.Post("/ack", a.ackLink)
+	r.Get("/unsubscribe", a.unsubscribePage)
+	r.Post("/unsubscribe", a.unsubscribeLink)
+	r.Get("/verify", a.verifyPage)
+	r.Post("/verify", a.verifyLink)
+	r.Post("/mailgun/events", a.mailgunEvents)
+	r.Post("/mailgun/inbound", a.mailgunInbound)
+	r.Route("/api", func(r chi.Router) {
+		r.Use(a.authorize)
+		r.Get("/sensors/{sensor}/snoozes", a.listSnoozes)
+		r.Post("/sensors/{sensor}/snoozes", a.addSnooze)
+		r.Delete("/sensors/{sensor}/snoozes", a.endSnoozes)
+		r.Get("/sensors/{sensor}/incident", a.showIncident)
+		r.Post("/sensors/{sensor}/ack", a.acknowledge)
+		r.Get("/sensors/{sensor}/notifications", a.listNotifications)
+	})
+	return r
+}
+
+// do runs a change to a sensor and waits for it.
+func (a *apiServer) do(f func()) {
+	if a.requests == nil {
+		f()
+		return
+	}
+	done := make(chan struct{})
+	a.requests <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// updateSensor changes the subscription with the document ID and stores it.
+func (a *apiServer) updateSensor(ctx context.Context, id string, change func(s *Sensor)) (Sensor, error) {
+	var s Sensor
+	var err error
+	a.do(func() {
+		s, err = a.sensors.Update(ctx, id, change)
+	})
+	return s, err
+}
+
+// updateSubscriptions changes every subscription to the sensor with the sensor ID.
+func (a *apiServer) updateSubscriptions(ctx context.Context, sensorID string, change func(s *Sensor)) ([]Sensor, error) {
+	var subs []Sensor
+	var err error
+	a.do(func() {
+		subs, err = updateSubscriptions(ctx, a.sensors, sensorID, change)
+	})
+	return subs, err
+}
+
+// linkSubscriptions changes the subscription a link names. Links made before they
+// named the subscription change every subscription to their sensor.
+func (a *apiServer) linkSubscriptions(ctx context.Context, document, sensorID string, change func(s *Sensor)) ([]Sensor, error) {
+	if document == "" {
+		return a.updateSubscriptions(ctx, sensorID, change)
+	}
+	s, err := a.updateSensor(ctx, document, change)
+	if err != nil {
+		return nil, err
+	}
+	return []Sensor{s}, nil
+}
+
+func (a *apiServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			apiError(w, http.StatusNotFound, "the API is not enabled")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+			apiError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *apiServer) listSnoozes(w http.ResponseWriter, r *http.Request) {
+	s, err := findSubscription(r.Context(), a.sensors, chi.URLParam(r, "sensor"))
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snoozeList(s))
+}
+
+// snoozeRequest is a snooze until a moment or for a duration like 3d.
+type snoozeRequest struct {
+	Alarm    string    `json:"alarm"`
+	Until    time.Time `json:"until"`
+	Duration string    `json:"duration"`
+	Reason   string    `json:"reason"`
+}
+
+func (a *apiServer) addSnooze(w http.ResponseWriter, r *http.Request) {
+	var req snoozeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if !validAlarm(req.Alarm) {
+		apiError(w, http.StatusBadRequest, "unknown alarm type "+req.Alarm)
+		return
+	}
+	now := nowFunc()
+	until := req.Until
+	if req.Duration != "" {
+		d, err := parseSnoozeDuration(req.Duration)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		until = now.Add(d)
+	}
+	if !until.After(now) {
+		apiError(w, http.StatusBadRequest, "the snooze needs an until in the future or a duration")
+		return
+	}
+
+	subs, err := a.updateSubscriptions(r.Context(), chi.URLParam(r, "sensor"), func(s *Sensor) {
+		s.snooze(Snooze{Alarm: req.Alarm, Until: until, Reason: req.Reason}, now)
+	})
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, snoozeList(subs[0]))
+}
+
+// endSnoozes ends the snoozes of the alarm type in the query, or all of them.
+func (a *apiServer) endSnoozes(w http.ResponseWriter, r *http.Request) {
+	alarm := r.URL.Query().Get("alarm")
+	subs, err := a.updateSubscriptions(r.Context(), chi.URLParam(r, "sensor"), func(s *Sensor) {
+		var keep []Snooze
+		for _, sn := range activeSnoozes(s.Snoozes, nowFunc()) {
+			if alarm != "" && sn.Alarm != alarm {
+				keep = append(keep, sn)
+			}
+		}
+		s.Snoozes = keep
+	})
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snoozeList(subs[0]))
+}
+
+func snoozeList(s Sensor) []Snooze {
+	res := activeSnoozes(s.Snoozes, nowFunc())
+	if res == nil {
+		res = []Snooze{}
+	}
+	return res
+}
+
+func (a *apiServer) showIncident(w http.ResponseWriter, r *http.Request) {
+	s, err := findSubscription(r.Context(), a.sensors, chi.URLParam(r, "sensor"))
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	if s.Incident == nil {
+		apiError(w, http.StatusNotFound, "the sensor had no alarms yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Incident)
+}
+
+// acknowledge acknowledges the alarms of every subscription to a sensor by whom the body names.
+func (a *apiServer) acknowledge(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		By string `json:"by"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if req.By == "" {
+		req.By = "API"
+	}
+
+	ackErrs := make(map[string]error)
+	subs, err := a.updateSubscriptions(r.Context(), chi.URLParam(r, "sensor"), func(s *Sensor) {
+		ackErrs[s.DocumentID] = s.acknowledge(time.Time{}, req.By, nowFunc())
+	})
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	for _, s := range subs {
+		if ackErrs[s.DocumentID] == nil {
+			writeJSON(w, http.StatusOK, s.Incident)
+			return
+		}
+	}
+	apiError(w, http.StatusConflict, ackErrs[subs[0].DocumentID].Error())
+}
+
+// deliveryReport is a notification as the API shows it.
+type deliveryReport struct {
+	ID              string     `json:"id"`
+	Created         time.Time  `json:"created"`
+	Channel         string     `json:"channel"`
+	Target          string     `json:"target"`
+	Admin           bool       `json:"admin,omitempty"`
+	Event           string     `json:"event"` // alarm or recovery
+	Alarms          []string   `json:"alarms"`
+	Incident        *time.Time `json:"incident,omitempty"` // start of the incident
+	Status          string     `json:"status"`
+	Attempts        int        `json:"attempts"`
+	Sent            *time.Time `json:"sent,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	MessageID       string     `json:"message_id,omitempty"`
+	Delivery        string     `json:"delivery,omitempty"`
+	DeliveryDetail  string     `json:"delivery_detail,omitempty"`
+	DeliveryUpdated *time.Time `json:"delivery_updated,omitempty"`
+}
+
+func newDeliveryReport(n notification) deliveryReport {
+	d := deliveryReport{
+		ID:             n.ID,
+		Created:        n.Created,
+		Channel:        n.Channel.Type,
+		Target:         n.Channel.Target,
+		Admin:          n.Admin,
+		Event:          n.eventName(),
+		Alarms:         []string{},
+		Status:         n.Status,
+		Attempts:       n.Attempts,
+		LastError:      n.LastError,
+		MessageID:      n.MessageID,
+		Delivery:       n.Delivery,
+		DeliveryDetail: n.DeliveryDetail,
+	}
+	for _, f := range n.Event.Findings {
+		d.Alarms = append(d.Alarms, f.Type)
+	}
+	if i := n.Event.Sensor.Incident; i != nil {
+		d.Incident = &i.Started
+	}
+	if !n.Sent.IsZero() {
+		d.Sent = &n.Sent
+	}
+	if !n.DeliveryUpdated.IsZero() {
+		d.DeliveryUpdated = &n.DeliveryUpdated
+	}
+	return d
+}
+
+// listNotifications shows the last notifications of a sensor, 20 or the limit in the query.
+func (a *apiServer) listNotifications(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit "+l)
+			return
+		}
+		limit = n
+	}
+	notifications, err := a.outbox.List(r.Context(), chi.URLParam(r, "sensor"), limit)
+	if err != nil {
+		sensorError(w, err)
+		return
+	}
+	res := []deliveryReport{}
+	for _, n := range notifications {
+		res = append(res, newDeliveryReport(n))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// confirm shows the page of a link, asking to confirm so mail scanners opening links change nothing.
+func (a *apiServer) confirm(w http.ResponseWriter, r *http.Request, action, title string, question func(c linkClaims) string) {
+	c, err := a.links.verify(r.FormValue("t"), action, nowFunc())
+	if err != nil {
+		showPage(w, http.StatusBadRequest, page{Title: title, Message: err.Error()})
+		return
+	}
+	showPage(w, http.StatusOK, page{Title: title, Message: question(c), Button: title})
+}
+
+func (a *apiServer) snoozePage(w http.ResponseWriter, r *http.Request) {
+	a.confirm(w, r, actionSnooze, "Snooze alarms", func(c linkClaims) string {
+		return "Hold back the alarms of sensor " + c.Sensor + " for a week while you work on it?"
+	})
+}
+
+func (a *apiServer) snoozeLink(w http.ResponseWriter, r *http.Request) {
+	now := nowFunc()
+	c, err := a.links.verify(r.FormValue("t"), actionSnooze, now)
+	if err != nil {
+		showPage(w, http.StatusBadRequest, page{Title: "Snooze alarms", Message: err.Error()})
+		return
+	}
+	until := now.Add(mailSnooze)
+	subs, err := a.linkSubscriptions(r.Context(), c.Document, c.Sensor, func(s *Sensor) {
+		s.snooze(Snooze{Alarm: c.Alarm, Until: until, Reason: "snoozed from the alarm mail"}, now)
+	})
+	if err == ErrSensorNotFound {
+		showPage(w, http.StatusOK, page{Title: "Snooze alarms", Message: "Sensor " + c.Sensor + " is no longer monitored."})
+		return
+	}
+	if err != nil {
+		log.Printf("unable to snooze sensor %s: %v", c.Sensor, err)
+		showPage(w, http.StatusInternalServerError, page{Title: "Snooze alarms", Message: "Something went wrong, please try again later."})
+		return
+	}
+	showPage(w, http.StatusOK, page{
+		Title:   "Snooze alarms",
+		Message: "The alarms of sensor " + c.Sensor + " are snoozed until " + formatDate("en", until.In(sensorLocation(subs[0], a.location))) + ".",
+	})
+}
+
+func (a *apiServer) ackPage(w http.ResponseWriter, r *http.Request) {
+	a.confirm(w, r, actionAck, "Acknowledge alarms", func(c linkClaims) string {
+		return "Acknowledge the alarms of sensor " + c.Sensor + "? They are not repeated until it works again."
+	})
+}
+
+func (a *apiServer) ackLink(w http.ResponseWriter, r *http.Request) {
+	now := nowFunc()
+	c, err := a.links.verify(r.FormValue("t"), actionAck, now)
+	if err != nil {
+		showPage(w, http.StatusBadRequest, page{Title: "Acknowledge alarms", Message: err.Error()})
+		return
+	}
+	ackErrs := make(map[string]error)
+	subs, err := a.linkSubscriptions(r.Context(), c.Document, c.Sensor, func(s *Sensor) {
+		ackErrs[s.DocumentID] = s.acknowledge(time.Unix(c.Incident, 0), "link in the alarm mail", now)
+	})
+	if err != nil && err != ErrSensorNotFound {
+		log.Printf("unable to acknowledge the alarms of sensor %s: %v", c.Sensor, err)
+		showPage(w, http.StatusInternalServerError, page{Title: "Acknowledge alarms", Message: "Something went wrong, please try again later."})
+		return
+	}
+	msg := "Sensor " + c.Sensor + " is working normally again or has newer alarms."
+	for _, s := range subs {
+		if ackErr := ackErrs[s.DocumentID]; ackErr == nil {
+			msg = "The alarms of sensor " + c.Sensor + " are acknowledged."
+			break
+		} else if ackErr == errAcknowledged {
+			msg = "The alarms of sensor " + c.Sensor + " were acknowledged already."
+		}
+	}
+	showPage(w, http.StatusOK, page{Title: "Acknowledge alarms", Message: msg})
+}
+
+func (a *apiServer) unsubscribePage(w http.ResponseWriter, r *http.Request) {
+	a.confirm(w, r, actionUnsubscribe, "Unsubscribe", func(c linkClaims) string {
+		return "Stop sending " + describeSubscription(c) + " to " + c.Target + "?"
+	})
+}
+
+// unsubscribeLink turns off the alarms of the link. Mail clients post to it without
+// confirmation for the List-Unsubscribe-Post header, see RFC 8058.
+func (a *apiServer) unsubscribeLink(w http.ResponseWriter, r *http.Request) {
+	c, err := a.links.verify(r.FormValue("t"), actionUnsubscribe, nowFunc())
+	if err != nil {
+		showPage(w, http.StatusBadRequest, page{Title: "Unsubscribe", Message: err.Error()})
+		return
+	}
+	unsubscribed := false
+	for i, id := range c.Sensors {
+		var document string
+		if i < len(c.Documents) {
+			document = c.Documents[i]
+		}
+		subErrs := make(map[string]error)
+		subs, err := a.linkSubscriptions(r.Context(), document, id, func(s *Sensor) {
+			subErrs[s.DocumentID] = s.unsubscribe(c.Target, c.Alarm)
+		})
+		if err == ErrSensorNotFound {
+			continue // nothing to turn off
+		}
+		if err != nil {
+			log.Printf("unable to unsubscribe %s from sensor %s: %v", c.Target, id, err)
+			showPage(w, http.StatusInternalServerError, page{Title: "Unsubscribe", Message: "Something went wrong, please try again later."})
+			return
+		}
+		for _, s := range subs {
+			unsubscribed = unsubscribed || subErrs[s.DocumentID] == nil
+		}
+	}
+	if !unsubscribed {
+		showPage(w, http.StatusOK, page{Title: "Unsubscribe", Message: c.Target + " does not get " + describeSubscription(c) + "."})
+		return
+	}
+	log.Printf("%s unsubscribed from %s", c.Target, describeSubscription(c))
+	showPage(w, http.StatusOK, page{Title: "Unsubscribe", Message: c.Target + " no longer gets " + describeSubscription(c) + "."})
+}
+
+func describeSubscription(c linkClaims) string {
+	alarms := "the alarms"
+	switch c.Alarm {
+	case "":
+	case mutedReports:
+		alarms = "the reports"
+	default:
+		alarms = "the " + c.Alarm + " alarms"
+	}
+	if len(c.Sensors) == 1 {
+		return alarms + " of sensor " + c.Sensors[0]
+	}
+	return alarms + " of sensors " + strings.Join(c.Sensors, ", ")
+}
+
+func (a *apiServer) verifyPage(w http.ResponseWriter, r *http.Request) {
+	a.confirm(w, r, actionVerify, "Confirm", func(c linkClaims) string {
+		return "Send the alarms of sensor " + c.Sensor + " to " + c.Target + "?"
+	})
+}
+
+func (a *apiServer) verifyLink(w http.ResponseWriter, r *http.Request) {
+	c, err := a.links.verify(r.FormValue("t"), actionVerify, nowFunc())
+	if err != nil {
+		showPage(w, http.StatusBadRequest, page{Title: "Confirm", Message: err.Error()})
+		return
+	}
+	confirmErrs := make(map[string]error)
+	subs, err := a.linkSubscriptions(r.Context(), c.Document, c.Sensor, func(s *Sensor) {
+		confirmErrs[s.DocumentID] = s.confirmAddress(c.Target, nowFunc())
+	})
+	if err != nil && err != ErrSensorNotFound {
+		log.Printf("unable to confirm %s for sensor %s: %v", c.Target, c.Sensor, err)
+		showPage(w, http.StatusInternalServerError, page{Title: "Confirm", Message: "Something went wrong, please try again later."})
+		return
+	}
+	for _, s := range subs {
+		if confirmErrs[s.DocumentID] == nil {
+			showPage(w, http.StatusOK, page{Title: "Confirm", Message: c.Target + " gets the alarms of sensor " + c.Sensor + " from now on."})
+			return
+		}
+	}
+	showPage(w, http.StatusOK, page{Title: "Confirm", Message: c.Target + " no longer gets the alarms of sensor " + c.Sensor + "."})
+}
+
+// page is a page shown for a link in a mail. With a button it posts the form back to the link.
+type page struct {
+	Title   string
+	Message string
+	Button  string
+}
+
+var pageTemplate = htmltemplate.Must(htmltemplate.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Button}}<form method="post"><button type="submit">{{.Button}}</button></form>{{end}}
+</body>
+</html>
+`))
+
+func showPage(w http.ResponseWriter, code int, p page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := pageTemplate.Execute(w, p); err != nil {
+		log.Printf("unable to show page: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("unable to write response: %v", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func sensorError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrSensorNotFound:
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	case errSeveralSubscriptions:
+		apiError(w, http.StatusConflict, err.Error())
+		return
+	}
+	log.Printf("sensor request failed: %v", err)
+	apiError(w, http.StatusInternalServerError, "something went wrong, please try again later")
+}
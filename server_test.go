@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestSnoozeAPI(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	active := Snooze{Alarm: AlarmGPS, Until: testDate.Add(time.Hour), Reason: "moved indoors"}
+	ended := Snooze{Until: testDate.Add(-time.Hour)}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		wantCode int
+		want     []Snooze
+	}{
+		{
+			name:     "lists the active snoozes",
+			method:   "GET",
+			path:     "/api/sensors/123/snoozes",
+			token:    "secret",
+			wantCode: http.StatusOK,
+			want:     []Snooze{active},
+		},
+		{
+			name:     "needs the token",
+			method:   "GET",
+			path:     "/api/sensors/123/snoozes",
+			token:    "guess",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown sensor",
+			method:   "GET",
+			path:     "/api/sensors/999/snoozes",
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "snoozes for a duration",
+			method:   "POST",
+			path:     "/api/sensors/123/snoozes",
+			token:    "secret",
+			body:     `{"alarm": "offline", "duration": "3d", "reason": "new battery"}`,
+			wantCode: http.StatusCreated,
+			want:     []Snooze{active, {Alarm: AlarmOffline, Until: testDate.Add(72 * time.Hour), Reason: "new battery"}},
+		},
+		{
+			name:     "snoozes until a moment",
+			method:   "POST",
+			path:     "/api/sensors/123/snoozes",
+			token:    "secret",
+			body:     `{"until": "2019-07-05T12:00:00Z"}`,
+			wantCode: http.StatusCreated,
+			want:     []Snooze{active, {Until: time.Date(2019, 7, 5, 12, 0, 0, 0, time.UTC)}},
+		},
+		{
+			name:     "rejects snoozes in the past",
+			method:   "POST",
+			path:     "/api/sensors/123/snoozes",
+			token:    "secret",
+			body:     `{"until": "2019-07-01T12:00:00Z"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "rejects unknown alarm types",
+			method:   "POST",
+			path:     "/api/sensors/123/snoozes",
+			token:    "secret",
+			body:     `{"alarm": "rain", "duration": "1d"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "ends the snoozes of an alarm type",
+			method:   "DELETE",
+			path:     "/api/sensors/123/snoozes?alarm=gps",
+			token:    "secret",
+			wantCode: http.StatusOK,
+			want:     []Snooze{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := sensorStoreMock{sensors: map[string]Sensor{"123": {ID: "123", Snoozes: []Snooze{ended, active}}}}
+			a := apiServer{sensors: &store, token: "secret"}
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			a.routes().ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tt.wantCode, rec.Code, rec.Body)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []Snooze
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(activeSnoozes(store.sensors["123"].Snoozes, testDate), activeSnoozes(tt.want, testDate)); diff != nil {
+				t.Errorf("stored snoozes: %v", diff)
+			}
+		})
+	}
+}
+
+func TestSnoozeAPISeveralSubscriptions(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	store := sensorStoreMock{sensors: map[string]Sensor{
+		"owner":     {ID: "123"},
+		"neighbour": {ID: "123"},
+	}}
+	a := apiServer{sensors: &store, token: "secret"}
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("POST", "/api/sensors/123/snoozes", `{"duration": "1d"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected the snooze to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	for id, s := range store.sensors {
+		if len(s.Snoozes) != 1 {
+			t.Errorf("expected subscription %s to be snoozed, got %+v", id, s.Snoozes)
+		}
+	}
+	if rec := request("GET", "/api/sensors/123/snoozes", ""); rec.Code != http.StatusConflict {
+		t.Errorf("expected the snoozes of one of several subscriptions to be refused, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSnoozeLink(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	d := digest{sections: []sensorStatus{{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}, reading: Reading{Date: testDate}}}}
+	msg, err := testTemplates.renderIn(d, testTenant, testLinks, "en", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := regexp.MustCompile(`https://monitor\.example\.com/snooze\?t=\S+`).FindString(msg.text)
+	if link == "" {
+		t.Fatalf("no snooze link in the mail:\n%s", msg.text)
+	}
+	if !strings.Contains(msg.html, `href="`+strings.Replace(link, "&", "&amp;", -1)+`"`) {
+		t.Errorf("no snooze link in the HTML mail:\n%s", msg.html)
+	}
+
+	store := sensorStoreMock{sensors: map[string]Sensor{"123": {ID: "123"}}}
+	a := apiServer{sensors: &store, links: testLinks}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// opening the link only asks to confirm
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<form method=\"post\">") {
+		t.Fatalf("expected a confirmation form, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(store.sensors["123"].Snoozes) != 0 {
+		t.Fatal("expected opening the link not to snooze")
+	}
+
+	rec = httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", u.RequestURI(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the snooze to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	want := []Snooze{{Until: testDate.Add(mailSnooze), Reason: "snoozed from the alarm mail"}}
+	if diff := deep.Equal(store.sensors["123"].Snoozes, want); diff != nil {
+		t.Error(diff)
+	}
+
+	rec = httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", "/snooze?t=forged", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a forged link to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAcknowledgeLink(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	started := testDate.Add(-time.Hour)
+	sensor := Sensor{ID: "123", Alarms: Alarm{Offline: started}, Incident: &Incident{Started: started}}
+	d := digest{sections: []sensorStatus{{sensor: sensor, reading: Reading{Date: started}}}}
+	msg, err := testTemplates.renderIn(d, testTenant, testLinks, "en", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := regexp.MustCompile(`https://monitor\.example\.com/ack\?t=\S+`).FindString(msg.text)
+	if link == "" {
+		t.Fatalf("no acknowledge link in the mail:\n%s", msg.text)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := sensorStoreMock{sensors: map[string]Sensor{"123": sensor}}
+	a := apiServer{sensors: &store, links: testLinks, token: "secret"}
+	for _, want := range []string{"are acknowledged", "were acknowledged already"} {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, httptest.NewRequest("POST", u.RequestURI(), nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected the alarms %s, got %d: %s", want, rec.Code, rec.Body)
+		}
+	}
+	if got := store.sensors["123"].Incident; !got.Acknowledged.Equal(testDate) || got.Steps[0].Detail != "link in the alarm mail" {
+		t.Errorf("expected the acknowledgement to be recorded, got %+v", got)
+	}
+
+	// the link of an earlier incident does not acknowledge a new one
+	store.sensors["123"] = Sensor{ID: "123", Incident: &Incident{Started: testDate}}
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", u.RequestURI(), nil))
+	if !strings.Contains(rec.Body.String(), "has newer alarms") || !store.sensors["123"].Incident.Acknowledged.IsZero() {
+		t.Errorf("expected the new incident not to be acknowledged, got %s", rec.Body)
+	}
+
+	// through the API
+	req := httptest.NewRequest("POST", "/api/sensors/123/ack", strings.NewReader(`{"by": "coordinator"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the API to acknowledge, got %d: %s", rec.Code, rec.Body)
+	}
+	var got Incident
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Action != stepAcknowledged || got.Steps[0].Detail != "coordinator" {
+		t.Errorf("expected the acknowledgement by the coordinator, got %+v", got)
+	}
+}
+
+func TestUnsubscribeLink(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	// the neighbour subscribed to sensor 124 as well
+	neighbour := Sensor{ID: "124", Channels: []Channel{{Type: "email", Target: "neighbour@example.com"}}}
+	store := sensorStoreMock{sensors: map[string]Sensor{
+		"sub123":    {ID: "123", EmailAddress: "owner@example.com", Alarms: Alarm{Offline: testDate}},
+		"sub124":    {ID: "124", Channels: []Channel{{Type: "email", Target: "owner@example.com"}}, Alarms: Alarm{GpsMissing: testDate}},
+		"neighbour": neighbour,
+	}}
+	mailer := mailerMock{}
+	d := digest{recipient: "owner@example.com"}
+	for _, id := range []string{"sub123", "sub124"} {
+		s, _ := store.Find(context.Background(), id)
+		d.sections = append(d.sections, sensorStatus{sensor: s, reading: Reading{Date: testDate}})
+	}
+	if _, err := sendDigest(context.Background(), testTemplates, testLinks, &tenant{mailer: &mailer}, d); err != nil {
+		t.Fatal(err)
+	}
+	msg := mailer.sent[0]
+	if msg.Headers["List-Unsubscribe-Post"] != "List-Unsubscribe=One-Click" {
+		t.Errorf("expected a one-click unsubscribe, got %v", msg.Headers)
+	}
+	header := msg.Headers["List-Unsubscribe"]
+	if !strings.HasPrefix(header, "<https://monitor.example.com/unsubscribe?t=") || !strings.Contains(msg.Text, strings.Trim(header, "<>")) {
+		t.Fatalf("expected the unsubscribe link in the header and the mail, got %q", header)
+	}
+
+	a := apiServer{sensors: &store, links: testLinks}
+
+	// turning off one alarm type from the link next to it
+	mute := regexp.MustCompile(`GPS fix\n  Stop these alarms: (\S+)`).FindStringSubmatch(msg.Text)
+	if mute == nil {
+		t.Fatalf("no link to stop the GPS alarms in the mail:\n%s", msg.Text)
+	}
+	u, _ := url.Parse(mute[1])
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", u.RequestURI(), nil))
+	want := []Channel{{Type: "email", Target: "owner@example.com", Muted: []string{AlarmGPS}}}
+	if diff := deep.Equal(store.sensors["sub124"].Channels, want); rec.Code != http.StatusOK || diff != nil {
+		t.Errorf("expected the GPS alarms of sensor 124 to be turned off, got %d: %v", rec.Code, diff)
+	}
+
+	// the one-click unsubscribe of RFC 8058
+	u, _ = url.Parse(strings.Trim(header, "<>"))
+	req := httptest.NewRequest("POST", u.RequestURI(), strings.NewReader("List-Unsubscribe=One-Click"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the unsubscribe to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	for _, id := range []string{"sub123", "sub124"} {
+		if c := store.sensors[id].Channels; len(c) != 1 || !c[0].Disabled {
+			t.Errorf("expected the e-mail of subscription %s to be turned off, got %+v", id, c)
+		}
+	}
+	if diff := deep.Equal(store.sensors["neighbour"], neighbour); diff != nil {
+		t.Errorf("expected the subscription of the neighbour to be kept: %v", diff)
+	}
+
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ntfyServer      = "https://ntfy.sh"
+	pushoverAPIBase = "https://api.pushover.net"
+)
+
+// ntfyNotifier publishes a message per sensor to an ntfy topic. The channel's target is
+// the topic on the configured server, or the URL of a topic on another server.
+type ntfyNotifier struct {
+	client   *http.Client
+	server   string
+	token    string         // access token for protected topics
+	location *time.Location // time zone for sensors that have none set
+}
+
+func newNtfyNotifier(client *http.Client, c NtfyConfig, location *time.Location) (*ntfyNotifier, error) {
+	n := ntfyNotifier{client: client, server: strings.TrimSuffix(c.Server, "/"), location: location}
+	if n.server == "" {
+		n.server = ntfyServer
+	}
+	if c.TokenPath != "" {
+		b, err := ioutil.ReadFile(c.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ntfy token file: %v", err)
+		}
+		n.token = strings.TrimSpace(string(b))
+	}
+	return &n, nil
+}
+
+type ntfyMessage struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title"`
+	Message  string   `json:"message"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags,omitempty"`
+	Click    string   `json:"click,omitempty"`
+}
+
+// ntfyPriority maps an event to ntfy's priorities, from 1 (min) to 5 (max).
+func ntfyPriority(e AlarmEvent) int {
+	switch {
+	case e.Recovery:
+		return 2
+	case e.Severity == SeverityCritical:
+		return 5
+	case e.Severity == SeverityWarning:
+		return 4
+	default:
+		return 3
+	}
+}
+
+func (n *ntfyNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	server, topic := n.server, c.Target
+	if i := strings.LastIndex(c.Target, "/"); strings.Contains(c.Target, "://") && i >= 0 {
+		server, topic = c.Target[:i], c.Target[i+1:]
+	}
+	token := n.token
+	if server != n.server {
+		token = "" // the access token is only for the configured server
+	}
+
+	for _, e := range events {
+		m := newChatMessage(e, n.location)
+		msg := ntfyMessage{
+			Topic:    topic,
+			Title:    fmt.Sprintf("Sensor %s: %s", m.sensorID, m.headline),
+			Message:  strings.Join(m.details, "\n"),
+			Priority: ntfyPriority(e),
+			Tags:     []string{"warning"},
+			Click:    m.url,
+		}
+		if e.Recovery {
+			msg.Message = "The sensor is working normally again."
+			msg.Tags = []string{"white_check_mark"}
+		}
+		body, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := chatRequest(ctx, n.client, "POST", server, token, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushoverNotifier sends a message per sensor with the Pushover API to the user or
+// group key in the channel's target.
+type pushoverNotifier struct {
+	client   *http.Client
+	apiBase  string
+	token    string         // application token
+	location *time.Location // time zone for sensors that have none set
+}
+
+func newPushoverNotifier(client *http.Client, c PushoverConfig, location *time.Location) (*pushoverNotifier, error) {
+	p := pushoverNotifier{client: client, apiBase: strings.TrimSuffix(c.APIBase, "/"), location: location}
+	if p.apiBase == "" {
+		p.apiBase = pushoverAPIBase
+	}
+	if c.TokenPath != "" {
+		b, err := ioutil.ReadFile(c.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Pushover token file: %v", err)
+		}
+		p.token = strings.TrimSpace(string(b))
+	}
+	return &p, nil
+}
+
+// pushoverPriority maps an event to Pushover's priorities: -1 is quiet, 1 bypasses
+// the user's quiet hours. Emergency priority 2 needs acknowledgement and is not used.
+func pushoverPriority(e AlarmEvent) int {
+	switch {
+	case e.Recovery:
+		return -1
+	case e.Severity == SeverityCritical:
+		return 1
+	case e.Severity == SeverityWarning:
+		return 0
+	default:
+		return -1
+	}
+}
+
+func (p *pushoverNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	if p.token == "" {
+		return fmt.Errorf("no Pushover application token configured")
+	}
+
+	for _, e := range events {
+		m := newChatMessage(e, p.location)
+		message := strings.Join(m.details, "\n")
+		if e.Recovery {
+			message = "The sensor is working normally again."
+		}
+		form := url.Values{
+			"token":     {p.token},
+			"user":      {c.Target},
+			"title":     {fmt.Sprintf("Sensor %s: %s", m.sensorID, m.headline)},
+			"message":   {message},
+			"priority":  {strconv.Itoa(pushoverPriority(e))},
+			"url":       {m.url},
+			"url_title": {"Sensor " + m.sensorID},
+		}
+
+		req, err := http.NewRequest("POST", p.apiBase+"/1/messages.json", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		res, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			Status int      `json:"status"`
+			Errors []string `json:"errors"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil || resp.Status != 1 {
+			if len(resp.Errors) > 0 {
+				return fmt.Errorf("pushover failed: %s", strings.Join(resp.Errors, ", "))
+			}
+			return fmt.Errorf("pushover responded with %s", res.Status)
+		}
+	}
+	return nil
+}
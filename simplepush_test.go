@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestNtfyNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	var paths []string
+	var messages []ntfyMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer tk_secret" {
+			t.Errorf("unexpected authorization %q", got)
+		}
+		var m ntfyMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Error(err)
+		}
+		paths = append(paths, r.URL.Path)
+		messages = append(messages, m)
+		w.Write([]byte(`{"id":"x"}`))
+	}))
+	defer srv.Close()
+
+	events := []AlarmEvent{
+		newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}}),
+		newAlarmEvent(sensorStatus{sensor: Sensor{ID: "456", Alarms: Alarm{GpsMissing: testDate}}}),
+		newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "789"}}, Alarm{LowVoltage: testDate}),
+	}
+
+	n := ntfyNotifier{client: srv.Client(), server: srv.URL, token: "tk_secret"}
+	if err := n.Notify(context.Background(), Channel{Type: "ntfy", Target: "meetjestad"}, events); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), Channel{Type: "ntfy", Target: srv.URL + "/other"}, events[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ntfyMessage{
+		{
+			Topic:    "meetjestad",
+			Title:    "Sensor 123: critical",
+			Message:  "offline since 03 Jul 19 23:12 UTC",
+			Priority: 5,
+			Tags:     []string{"warning"},
+			Click:    "https://meetjestad.net/data/sensors_recent.php?sensor=123",
+		},
+		{
+			Topic:    "meetjestad",
+			Title:    "Sensor 456: info",
+			Message:  "no GPS fix",
+			Priority: 3,
+			Tags:     []string{"warning"},
+			Click:    "https://meetjestad.net/data/sensors_recent.php?sensor=456",
+		},
+		{
+			Topic:    "meetjestad",
+			Title:    "Sensor 789: working normally again",
+			Message:  "The sensor is working normally again.",
+			Priority: 2,
+			Tags:     []string{"white_check_mark"},
+			Click:    "https://meetjestad.net/data/sensors_recent.php?sensor=789",
+		},
+		{
+			Topic:    "other",
+			Title:    "Sensor 123: critical",
+			Message:  "offline since 03 Jul 19 23:12 UTC",
+			Priority: 5,
+			Tags:     []string{"warning"},
+			Click:    "https://meetjestad.net/data/sensors_recent.php?sensor=123",
+		},
+	}
+	if diff := deep.Equal(messages, want); diff != nil {
+		t.Errorf("messages failed: %v", diff)
+	}
+	if diff := deep.Equal(paths, []string{"/", "/", "/", "/"}); diff != nil {
+		t.Errorf("paths failed: %v", diff)
+	}
+}
+
+func TestNtfyNotifierOtherServer(t *testing.T) {
+	var topics []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "" {
+			t.Errorf("expected no authorization on another server, got %q", got)
+		}
+		var m ntfyMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Error(err)
+		}
+		topics = append(topics, m.Topic)
+		w.Write([]byte(`{"id":"x"}`))
+	}))
+	defer srv.Close()
+
+	n := ntfyNotifier{client: srv.Client(), server: "https://ntfy.example.org", token: "tk_secret"}
+	event := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}})
+	if err := n.Notify(context.Background(), Channel{Type: "ntfy", Target: srv.URL + "/meetjestad"}, []AlarmEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(topics, []string{"meetjestad"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPushoverNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	var priorities []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1/messages.json" || r.FormValue("token") != "app" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Form)
+		}
+		if r.FormValue("user") == "unknown" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"user":"invalid","errors":["user identifier is invalid"],"status":0}`))
+			return
+		}
+		priorities = append(priorities, r.FormValue("priority"))
+		w.Write([]byte(`{"status":1,"request":"r"}`))
+	}))
+	defer srv.Close()
+
+	events := []AlarmEvent{
+		newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}}),
+		newAlarmEvent(sensorStatus{sensor: Sensor{ID: "456", Alarms: Alarm{LowVoltage: testDate}}}),
+		newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "789"}}, Alarm{LowVoltage: testDate}),
+	}
+
+	p := pushoverNotifier{client: srv.Client(), apiBase: srv.URL, token: "app"}
+	if err := p.Notify(context.Background(), Channel{Type: "pushover", Target: "user"}, events); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(priorities, []string{"1", "0", "-1"}); diff != nil {
+		t.Errorf("priorities failed: %v", diff)
+	}
+
+	err := p.Notify(context.Background(), Channel{Type: "pushover", Target: "unknown"}, events)
+	if err == nil || err.Error() != "pushover failed: user identifier is invalid" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const smtpTimeout = 10 * time.Second
+
+// smtpMailer sends mail through an SMTP server. The connection is kept open
+// and reused for following mails until the server closes it.
+type smtpMailer struct {
+	host string
+	addr string
+	tls  string // "starttls", "tls" (implicit) or "none"
+	auth smtp.Auth
+
+	mu     sync.Mutex
+	client *smtp.Client
+	conn   net.Conn // the connection of the client, for the deadlines
+}
+
+func newSMTPMailer(c SMTPConfig) (*smtpMailer, error) {
+	if c.Host == "" {
+		return nil, fmt.Errorf("SMTP host is not configured")
+	}
+
+	m := smtpMailer{
+		host: c.Host,
+		addr: net.JoinHostPort(c.Host, fmt.Sprint(c.Port)),
+		tls:  strings.ToLower(c.TLS),
+	}
+	if m.tls == "" {
+		m.tls = "starttls"
+	}
+	if m.tls != "starttls" && m.tls != "tls" && m.tls != "none" {
+		return nil, fmt.Errorf("invalid SMTP TLS mode %q, use starttls, tls or none", c.TLS)
+	}
+	if c.Port == 0 {
+		m.addr = net.JoinHostPort(c.Host, map[string]string{"starttls": "587", "tls": "465", "none": "25"}[m.tls])
+	}
+
+	if c.Username != "" {
+		b, err := ioutil.ReadFile(c.PasswordPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read SMTP password file: %v", err)
+		}
+		m.auth = smtp.PlainAuth("", c.Username, strings.TrimSpace(string(b)), c.Host)
+	}
+
+	return &m, nil
+}
+
+func (s *smtpMailer) Send(ctx context.Context, msg Message) (string, error) {
+	if msg.MessageID == "" {
+		msg.MessageID = newMessageID(msg.From)
+	}
+	body, err := buildMIME(msg, nowFunc())
+	if err != nil {
+		return "", fmt.Errorf("unable to encode mail: %v", err)
+	}
+
+	deadline := time.Now().Add(smtpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reused := s.client != nil
+	if retry, err := s.deliver(ctx, deadline, msg.From, msg.To, body); err != nil {
+		s.close()
+		if !reused || !retry {
+			return "", err
+		}
+		// the server may have closed the idle connection, try again with a new one
+		if _, err := s.deliver(ctx, deadline, msg.From, msg.To, body); err != nil {
+			s.close()
+			return "", err
+		}
+	}
+
+	log.Printf("mail sent to %s via %s", msg.To, s.addr)
+
+	return msg.MessageID, nil
+}
+
+// deliver sends the mail and tells whether a failure happened before the data was sent.
+// Only then it is safe to try again, a failure later on may leave the mail delivered.
+func (s *smtpMailer) deliver(ctx context.Context, deadline time.Time, from, to string, body []byte) (bool, error) {
+	c, err := s.connection(ctx, deadline)
+	if err != nil {
+		return true, err
+	}
+	defer watch(ctx, s.conn)()
+
+	if err := c.Mail(from); err != nil {
+		return true, err
+	}
+	if err := c.Rcpt(to); err != nil {
+		c.Reset()
+		return true, err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return true, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return false, err
+	}
+	return false, w.Close()
+}
+
+// watch cuts the I/O on the connection short when the context is done, until the
+// returned function is called.
+func watch(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// connection returns the open connection or sets up a new one, with the deadline for
+// everything that is sent and received.
+func (s *smtpMailer) connection(ctx context.Context, deadline time.Time) (*smtp.Client, error) {
+	if s.client != nil {
+		s.conn.SetDeadline(deadline)
+		if err := s.client.Reset(); err == nil {
+			return s.client, nil
+		}
+		s.close()
+	}
+
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	raw, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to SMTP server: %v", err)
+	}
+	raw.SetDeadline(deadline)
+	conn := raw
+	if s.tls == "tls" {
+		conn = tls.Client(raw, &tls.Config{ServerName: s.host})
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if s.tls == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("unable to start TLS: %v", err)
+		}
+	}
+
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	s.client = c
+	s.conn = raw
+	return c, nil
+}
+
+func (s *smtpMailer) close() {
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+		s.conn = nil
+	}
+}
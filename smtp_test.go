@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is a minimal SMTP server that keeps the mails it receives.
+type smtpSink struct {
+	listener    net.Listener
+	mu          sync.Mutex
+	connections int
+	mails       []string
+	dropAfter   int // close the connection instead of confirming this mail
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtpSink{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.connections++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return &s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 sink ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 sink")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, data.String())
+			drop := len(s.mails) == s.dropAfter
+			s.mu.Unlock()
+			if drop {
+				return
+			}
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.listener.Close()
+
+	addr := sink.listener.Addr().(*net.TCPAddr)
+	m, err := newMailer(MailerConfig{
+		Backend: "smtp",
+		SMTP:    SMTPConfig{Host: addr.IP.String(), Port: addr.Port, TLS: "none"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []Message{
+		{To: "owner@example.com", From: testTenant.from, Subject: "Plain", Text: "Hi,\n\nplain text"},
+		{
+			To:         "owner@example.com",
+			From:       testTenant.from,
+			Subject:    "Problemen met je sensor",
+			Text:       "Hallo,\n\nDe batterij lijkt bijna leeg: 3,20V",
+			HTML:       `<p>Hallo</p><img src="cid:chart-1.png">`,
+			Inline:     []Attachment{{Filename: "chart-1.png", ContentType: "image/png", Data: []byte("not really a png")}},
+			Headers:    map[string]string{"List-Unsubscribe": "<https://monitor.example.com/unsubscribe?t=x>"},
+			MessageID:  "<abc@monitoring.meetjescraper.online>",
+			InReplyTo:  "<incident.1.1562195565@monitoring.meetjescraper.online>",
+			References: []string{"<incident.1.1562195565@monitoring.meetjescraper.online>", "<incident.2.1562195565@monitoring.meetjescraper.online>"},
+		},
+	}
+	var ids []string
+	for _, msg := range messages {
+		id, err := m.Send(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("sending %q failed: %v", msg.Subject, err)
+		}
+		ids = append(ids, id)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if sink.connections != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", sink.connections)
+	}
+	if len(sink.mails) != 2 {
+		t.Fatalf("expected 2 mails, got %d", len(sink.mails))
+	}
+
+	plain, err := netmail.ReadMessage(strings.NewReader(sink.mails[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plain.Header.Get("Subject"); got != "Plain" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	if got := plain.Header.Get("Message-Id"); got == "" || got != ids[0] {
+		t.Errorf("expected the generated Message-ID %q to be returned, got %q", got, ids[0])
+	}
+	body, _ := ioutil.ReadAll(plain.Body)
+	if !strings.Contains(string(body), "plain text") {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	rich, err := netmail.ReadMessage(strings.NewReader(sink.mails[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(rich.Header.Get("Subject"))
+	if err != nil || subject != "Problemen met je sensor" {
+		t.Errorf("unexpected subject %q (%v)", subject, err)
+	}
+	if got := rich.Header.Get("List-Unsubscribe"); got != "<https://monitor.example.com/unsubscribe?t=x>" {
+		t.Errorf("unexpected List-Unsubscribe header %q", got)
+	}
+	if rich.Header.Get("Message-Id") != messages[1].MessageID || ids[1] != messages[1].MessageID ||
+		rich.Header.Get("In-Reply-To") != messages[1].InReplyTo ||
+		rich.Header.Get("References") != strings.Join(messages[1].References, " ") {
+		t.Errorf("unexpected thread headers %v", rich.Header)
+	}
+	mediaType, params, err := mime.ParseMediaType(rich.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("unexpected content type %q (%v)", mediaType, err)
+	}
+
+	var types []string
+	related := multipart.NewReader(rich.Body, params["boundary"])
+	for {
+		p, err := related.NextPart()
+		if err != nil {
+			break
+		}
+		mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		types = append(types, mediaType)
+		if mediaType == "multipart/alternative" {
+			alt := multipart.NewReader(p, params["boundary"])
+			for {
+				ap, err := alt.NextPart()
+				if err != nil {
+					break
+				}
+				mediaType, _, _ := mime.ParseMediaType(ap.Header.Get("Content-Type"))
+				types = append(types, mediaType)
+			}
+		}
+		if mediaType == "image/png" && p.Header.Get("Content-Id") != "<chart-1.png>" {
+			t.Errorf("unexpected content id %q", p.Header.Get("Content-Id"))
+		}
+	}
+	if got := strings.Join(types, ","); got != "multipart/alternative,text/plain,text/html,image/png" {
+		t.Errorf("unexpected parts %s", got)
+	}
+}
+
+func TestSMTPMailerNoRetryAfterData(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.listener.Close()
+	sink.mu.Lock()
+	sink.dropAfter = 2
+	sink.mu.Unlock()
+
+	addr := sink.listener.Addr().(*net.TCPAddr)
+	m, err := newSMTPMailer(SMTPConfig{Host: addr.IP.String(), Port: addr.Port, TLS: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{To: "owner@example.com", From: testTenant.from, Subject: "Plain", Text: "Hi"}
+	if _, err := m.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Send(context.Background(), msg); err == nil {
+		t.Error("expected an error when the server does not confirm the mail")
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.mails) != 2 || sink.connections != 1 {
+		t.Errorf("expected the mail not to be sent again, got %d mails over %d connections", len(sink.mails), sink.connections)
+	}
+}
+
+func TestSMTPMailerTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// accept but never greet, like a hung server
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	m, err := newSMTPMailer(SMTPConfig{Host: addr.IP.String(), Port: addr.Port, TLS: "none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := m.Send(ctx, Message{To: "owner@example.com", From: testTenant.from, Subject: "Plain", Text: "Hi"}); err == nil {
+		t.Error("expected the hung server to time out")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected the deadline of the context to be kept, took %v", took)
+	}
+}
+
+func TestBuildMIMEAttachments(t *testing.T) {
+	msg := Message{
+		To:          "owner@example.com",
+		From:        testTenant.from,
+		Subject:     "Readings",
+		Text:        "Hi,\n\nthe readings are attached",
+		Attachments: []Attachment{{Filename: "readings-1.csv", ContentType: "text/csv", Data: []byte("timestamp,voltage\n")}},
+	}
+	b, err := buildMIME(msg, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := netmail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content type %q (%v)", mediaType, err)
+	}
+
+	mixed := multipart.NewReader(m.Body, params["boundary"])
+	text, err := mixed.NextPart()
+	if err != nil || text.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("expected the text first, got %v (%v)", text.Header, err)
+	}
+	body, _ := ioutil.ReadAll(text)
+	if !strings.Contains(string(body), "the readings are attached") {
+		t.Errorf("unexpected text %q", body)
+	}
+	csv, err := mixed.NextPart()
+	if err != nil || csv.FileName() != "readings-1.csv" || csv.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("expected the attachment, got %v (%v)", csv.Header, err)
+	}
+	data, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, csv))
+	if string(data) != "timestamp,voltage\n" {
+		t.Errorf("unexpected attachment %q", data)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snoozed tells whether an alarm type of the sensor is snoozed at the given moment.
+func (s Sensor) snoozed(alarm string, now time.Time) bool {
+	for _, sn := range s.Snoozes {
+		if (sn.Alarm == "" || sn.Alarm == alarm) && now.Before(sn.Until) {
+			return true
+		}
+	}
+	return false
+}
+
+// snooze adds a snooze to the sensor and drops the ones that have ended.
+func (s *Sensor) snooze(sn Snooze, now time.Time) {
+	s.Snoozes = append(activeSnoozes(s.Snoozes, now), sn)
+}
+
+// activeSnoozes drops the snoozes that have ended.
+func activeSnoozes(snoozes []Snooze, now time.Time) []Snooze {
+	var res []Snooze
+	for _, sn := range snoozes {
+		if now.Before(sn.Until) {
+			res = append(res, sn)
+		}
+	}
+	return res
+}
+
+// validAlarm tells whether a snooze can be for the alarm type, empty meaning all alarms.
+func validAlarm(alarm string) bool {
+	switch alarm {
+	case "", AlarmOffline, AlarmVoltage, AlarmGPS:
+		return true
+	}
+	return false
+}
+
+// parseSnoozeDuration parses durations like 3d, 12h or 1h30m.
+func parseSnoozeDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q, use e.g. 3d or 12h", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestSnoozeCommand(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []Snooze
+		wantOut string
+		wantErr bool
+	}{
+		{
+			name:    "all alarms",
+			args:    []string{"snooze", "123", "3d", "new", "battery"},
+			want:    []Snooze{{Until: testDate.Add(72 * time.Hour), Reason: "new battery"}},
+			wantOut: "all alarms of sensor 123 are snoozed until 2019-07-06T23:12:45Z\n",
+		},
+		{
+			name:    "one alarm type",
+			args:    []string{"snooze", "123", "12h", "gps", "moved", "indoors"},
+			want:    []Snooze{{Alarm: AlarmGPS, Until: testDate.Add(12 * time.Hour), Reason: "moved indoors"}},
+			wantOut: "gps alarms of sensor 123 are snoozed until 2019-07-04T11:12:45Z\n",
+		},
+		{
+			name:    "invalid duration",
+			args:    []string{"snooze", "123", "soon"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown sensor",
+			args:    []string{"snooze", "999", "1d"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := sensorStoreMock{sensors: map[string]Sensor{"123": {ID: "123", Snoozes: []Snooze{{Until: testDate}}}}}
+			var out bytes.Buffer
+			err := runCommand(context.Background(), commandEnv{sensors: &store}, &out, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("expected %q, got %q", tt.wantOut, out.String())
+			}
+			if diff := deep.Equal(store.sensors["123"].Snoozes, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	errNotSubscribed        = errors.New("the address does not get the alarms of the sensor")
+	errSeveralSubscriptions = errors.New("several subscriptions watch the sensor")
+)
+
+// mutedReports is muted by channels that do not want the periodic reports of the sensor.
+const mutedReports = "reports"
+
+// alarms returns the alarms without the types the channel muted.
+func (c Channel) alarms(a Alarm) Alarm {
+	for _, m := range c.Muted {
+		switch m {
+		case AlarmOffline:
+			a.Offline = time.Time{}
+		case AlarmVoltage:
+			a.LowVoltage = time.Time{}
+		case AlarmGPS:
+			a.GpsMissing = time.Time{}
+		}
+	}
+	return a
+}
+
+// unsubscribe turns off the e-mail channel of the sensor to the address,
+// or only the alarm type when one is given.
+func (s *Sensor) unsubscribe(address, alarm string) error {
+	s.Channels = subscriptionChannels(*s)
+	for i := range s.Channels {
+		c := &s.Channels[i]
+		if c.Type != "email" || !strings.EqualFold(channelTarget(*s, *c), address) {
+			continue
+		}
+		if alarm == "" {
+			c.Disabled = true
+			return nil
+		}
+		for _, m := range c.Muted {
+			if m == alarm {
+				return nil
+			}
+		}
+		c.Muted = append(c.Muted, alarm)
+		return nil
+	}
+	return errNotSubscribed
+}
+
+// undeliverable marks the e-mail channels to the address as undeliverable, adding the
+// fallback channels of the sensor in their place. It returns the fallback channels added.
+func (s *Sensor) undeliverable(address, reason string, now time.Time) ([]Channel, error) {
+	s.Channels = subscriptionChannels(*s)
+	found := false
+	for i := range s.Channels {
+		c := &s.Channels[i]
+		if c.Type != "email" || !strings.EqualFold(channelTarget(*s, *c), address) || c.Disabled {
+			continue
+		}
+		found = true
+		if c.Undeliverable.IsZero() {
+			c.Undeliverable = now
+		}
+		c.LastError = reason
+	}
+	if !found {
+		return nil, errNotSubscribed
+	}
+
+	var added []Channel
+	for _, f := range s.Fallback {
+		f.Target = channelTarget(*s, f)
+		if f.Type == "email" && strings.EqualFold(f.Target, address) || findChannel(*s, channelKey(f)) >= 0 {
+			continue
+		}
+		s.Channels = append(s.Channels, f)
+		added = append(added, f)
+	}
+	return added, nil
+}
+
+// findSubscription returns the subscription to the sensor with the sensor ID. It refuses
+// sensors with several subscriptions, as it cannot tell which one is meant.
+func findSubscription(ctx context.Context, sensors sensorStore, sensorID string) (Sensor, error) {
+	subs, err := sensors.Subscriptions(ctx, sensorID)
+	if err != nil {
+		return Sensor{}, err
+	}
+	if len(subs) > 1 {
+		return Sensor{}, errSeveralSubscriptions
+	}
+	return subs[0], nil
+}
+
+// updateSubscriptions changes every subscription to the sensor with the sensor ID
+// and returns them as they are stored now.
+func updateSubscriptions(ctx context.Context, sensors sensorStore, sensorID string, change func(s *Sensor)) ([]Sensor, error) {
+	subs, err := sensors.Subscriptions(ctx, sensorID)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range subs {
+		updated, err := sensors.Update(ctx, s.DocumentID, change)
+		if err != nil {
+			return nil, err
+		}
+		subs[i] = updated
+	}
+	return subs, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestUnsubscribe(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensor  Sensor
+		address string
+		alarm   string
+		want    []Channel
+		wantErr error
+	}{
+		{
+			name:    "turns off the e-mail of a sensor without channels",
+			sensor:  Sensor{EmailAddress: "owner@example.com"},
+			address: "owner@example.com",
+			want:    []Channel{{Type: "email", Disabled: true}},
+		},
+		{
+			name:    "turns off one alarm type",
+			sensor:  Sensor{Channels: []Channel{{Type: "webhook", Target: "https://example.com/hook"}, {Type: "email", Target: "other@example.com", Muted: []string{AlarmGPS}}}},
+			address: "other@example.com",
+			alarm:   AlarmOffline,
+			want:    []Channel{{Type: "webhook", Target: "https://example.com/hook"}, {Type: "email", Target: "other@example.com", Muted: []string{AlarmGPS, AlarmOffline}}},
+		},
+		{
+			name:    "turns off an alarm type once",
+			sensor:  Sensor{Channels: []Channel{{Type: "email", Target: "other@example.com", Muted: []string{AlarmGPS}}}},
+			address: "other@example.com",
+			alarm:   AlarmGPS,
+			want:    []Channel{{Type: "email", Target: "other@example.com", Muted: []string{AlarmGPS}}},
+		},
+		{
+			name:    "other address",
+			sensor:  Sensor{Channels: []Channel{{Type: "email", Target: "other@example.com"}}},
+			address: "owner@example.com",
+			want:    []Channel{{Type: "email", Target: "other@example.com"}},
+			wantErr: errNotSubscribed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sensor
+			if err := s.unsubscribe(tt.address, tt.alarm); err != tt.wantErr {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if diff := deep.Equal(s.Channels, tt.want); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestChannelAlarms(t *testing.T) {
+	a := Alarm{Offline: testDate, LowVoltage: testDate, GpsMissing: testDate}
+	c := Channel{Muted: []string{AlarmGPS, AlarmVoltage}}
+	if diff := deep.Equal(c.alarms(a), Alarm{Offline: testDate}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestUndeliverable(t *testing.T) {
+	bounced := testDate.Add(-time.Hour)
+	sms := Channel{Type: "pushover", Target: "user-key"}
+	tests := []struct {
+		name      string
+		sensor    Sensor
+		want      []Channel
+		wantAdded []Channel
+		wantErr   error
+	}{
+		{
+			name:      "switches to the fallback channels",
+			sensor:    Sensor{EmailAddress: "owner@example.com", Fallback: []Channel{sms}},
+			want:      []Channel{{Type: "email", Undeliverable: testDate, LastError: "bounced"}, sms},
+			wantAdded: []Channel{sms},
+		},
+		{
+			name:   "switches once",
+			sensor: Sensor{Channels: []Channel{{Type: "email", Target: "owner@example.com", Undeliverable: bounced}, sms}, Fallback: []Channel{sms}},
+			want:   []Channel{{Type: "email", Target: "owner@example.com", Undeliverable: bounced, LastError: "bounced"}, sms},
+		},
+		{
+			name:   "ignores the case of the address",
+			sensor: Sensor{Channels: []Channel{{Type: "email", Target: "Owner@Example.com"}}},
+			want:   []Channel{{Type: "email", Target: "Owner@Example.com", Undeliverable: testDate, LastError: "bounced"}},
+		},
+		{
+			name:   "does not fall back to the same address",
+			sensor: Sensor{EmailAddress: "owner@example.com", Fallback: []Channel{{Type: "email", Target: "owner@example.com"}}},
+			want:   []Channel{{Type: "email", Undeliverable: testDate, LastError: "bounced"}},
+		},
+		{
+			name:    "other address",
+			sensor:  Sensor{Channels: []Channel{{Type: "email", Target: "other@example.com"}}, Fallback: []Channel{sms}},
+			want:    []Channel{{Type: "email", Target: "other@example.com"}},
+			wantErr: errNotSubscribed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.sensor
+			added, err := s.undeliverable("owner@example.com", "bounced", testDate)
+			if err != tt.wantErr {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if diff := deep.Equal(s.Channels, tt.want); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(added, tt.wantAdded); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	telegramAPIBase     = "https://api.telegram.org"
+	telegramPollTimeout = 50 // seconds the Bot API holds a getUpdates request
+	// requests to the Bot API time out after this, longer than a getUpdates request is held
+	telegramClientTimeout = (telegramPollTimeout + 10) * time.Second
+)
+
+const telegramHelp = `I send the alarms of Meet je stad sensors to this chat.
+
+To get the alarms of a sensor here, open the Telegram link in an alarm mail of the sensor.
+
+/subscribe <token> - get them with the token after start= in the link, when it does not open here
+/unsubscribe <sensor> - stop getting them
+/status <sensor> - show the alarms and health of a sensor
+/snooze <sensor> <duration> [reason] - hold back the alarms of the sensor, e.g. /snooze 123 3d new battery`
+
+// telegramInvalidLink answers a link to the bot that is not signed or has expired.
+const telegramInvalidLink = "This link does not work (anymore). Open the Telegram link in a newer alarm mail of the sensor."
+
+// sensorStore looks up and changes single subscriptions, by their document ID.
+type sensorStore interface {
+	Find(ctx context.Context, id string) (Sensor, error)
+	// Update changes a subscription without losing changes that are made to it at the same time
+	Update(ctx context.Context, id string, change func(s *Sensor)) (Sensor, error)
+	// Subscriptions returns the subscriptions to a sensor, by its sensor ID
+	Subscriptions(ctx context.Context, sensorID string) ([]Sensor, error)
+}
+
+// telegramAPI calls methods of the Telegram Bot API.
+type telegramAPI struct {
+	client *http.Client
+	base   string
+	token  string
+}
+
+func newTelegramAPI(client *http.Client, c TelegramConfig) (*telegramAPI, error) {
+	api := telegramAPI{client: client, base: strings.TrimSuffix(c.APIBase, "/")}
+	if api.base == "" {
+		api.base = telegramAPIBase
+	}
+	if c.TokenPath != "" {
+		b, err := ioutil.ReadFile(c.TokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Telegram token file: %v", err)
+		}
+		api.token = strings.TrimSpace(string(b))
+	}
+	return &api, nil
+}
+
+func (api *telegramAPI) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if api.token == "" {
+		return fmt.Errorf("no Telegram bot token configured")
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", api.base+"/bot"+api.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := api.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("telegram %s failed: %v", method, strings.Replace(err.Error(), api.token, "<token>", -1))
+	}
+	defer res.Body.Close()
+
+	var resp struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("telegram %s responded with %s", method, res.Status)
+	}
+	if !resp.OK {
+		return fmt.Errorf("telegram %s failed: %s", method, resp.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+type telegramSendMessage struct {
+	ChatID                   string `json:"chat_id"`
+	Text                     string `json:"text"`
+	ParseMode                string `json:"parse_mode,omitempty"`
+	DisableWebPagePreview    bool   `json:"disable_web_page_preview,omitempty"`
+	ReplyToMessageID         int64  `json:"reply_to_message_id,omitempty"`
+	AllowSendingWithoutReply bool   `json:"allow_sending_without_reply,omitempty"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramNotifier sends a message per sensor to the chat ID in the channel's target.
+// Updates and the recovery of an incident are replies to its first message.
+type telegramNotifier struct {
+	api      *telegramAPI
+	location *time.Location // time zone for sensors that have none set
+}
+
+func (t *telegramNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	for i, e := range events {
+		m := newChatMessage(e, t.location)
+		text := fmt.Sprintf(`<b><a href="%s">Sensor %s</a></b>: %s`, html.EscapeString(m.url), html.EscapeString(m.sensorID), m.headline)
+		for _, d := range m.details {
+			text += "\n• " + html.EscapeString(d)
+		}
+
+		params := telegramSendMessage{
+			ChatID:                c.Target,
+			Text:                  text,
+			ParseMode:             "HTML",
+			DisableWebPagePreview: true,
+		}
+		if id, err := strconv.ParseInt(e.Thread, 10, 64); err == nil {
+			params.ReplyToMessageID = id
+			params.AllowSendingWithoutReply = true
+		}
+
+		var sent telegramMessage
+		if err := t.api.call(ctx, "sendMessage", params, &sent); err != nil {
+			return err
+		}
+		if events[i].Thread == "" {
+			events[i].Thread = strconv.FormatInt(sent.MessageID, 10)
+		}
+	}
+	return nil
+}
+
+// telegramBot answers the commands sent to the bot.
+type telegramBot struct {
+	api      *telegramAPI
+	sensors  sensorStore
+	links    *linkSigner    // checks the links that add a chat to a sensor
+	location *time.Location // time zone for sensors that have none set
+	offset   int64
+}
+
+// poll fetches the updates for the bot and passes them on until the context is done.
+func (b *telegramBot) poll(ctx context.Context, updates chan<- telegramUpdate) {
+	for ctx.Err() == nil {
+		var res []telegramUpdate
+		params := map[string]interface{}{
+			"offset":          b.offset,
+			"timeout":         telegramPollTimeout,
+			"allowed_updates": []string{"message"},
+		}
+		if err := b.api.call(ctx, "getUpdates", params, &res); err != nil {
+			log.Printf("unable to get Telegram updates: %v", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for _, u := range res {
+			b.offset = u.UpdateID + 1
+			select {
+			case updates <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// handle answers a message to the bot.
+func (b *telegramBot) handle(ctx context.Context, u telegramUpdate) {
+	if u.Message == nil || !strings.HasPrefix(u.Message.Text, "/") {
+		return
+	}
+	chatID := strconv.FormatInt(u.Message.Chat.ID, 10)
+	reply := b.execute(ctx, chatID, u.Message.Text)
+	params := telegramSendMessage{ChatID: chatID, Text: reply, ReplyToMessageID: u.Message.MessageID}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if err := b.api.call(ctx, "sendMessage", params, nil); err != nil {
+		log.Printf("unable to answer Telegram chat %s: %v", chatID, err)
+	}
+}
+
+// execute runs a command from a chat and returns the answer.
+func (b *telegramBot) execute(ctx context.Context, chatID, text string) string {
+	args := strings.Fields(text)
+	command := strings.ToLower(args[0])
+	if i := strings.Index(command, "@"); i >= 0 {
+		command = command[:i] // commands in groups are addressed as /status@bot
+	}
+	args = args[1:]
+
+	switch command {
+	case "/start", "/subscribe":
+		// the links in the alarm mails start the bot with a token, proving the sensor's owner sent the chat
+		if len(args) == 0 {
+			return telegramHelp
+		}
+		document, err := b.links.verifyTelegram(args[0], nowFunc())
+		if err != nil {
+			return telegramInvalidLink
+		}
+		return b.change(ctx, chatID, document, "/subscribe", nil)
+	case "/help":
+		return telegramHelp
+	case "/unsubscribe", "/status", "/snooze":
+	default:
+		return "Unknown command.\n\n" + telegramHelp
+	}
+
+	if len(args) == 0 {
+		return fmt.Sprintf("Which sensor? Send %s <sensor>.", command)
+	}
+	subs, err := b.sensors.Subscriptions(ctx, args[0])
+	if err == ErrSensorNotFound {
+		return fmt.Sprintf("Sensor %s is not monitored.", args[0])
+	}
+	if err != nil {
+		log.Printf("unable to find sensor %s: %v", args[0], err)
+		return "Something went wrong, please try again later."
+	}
+	// the chat can be subscribed through several subscriptions to the sensor
+	var subscribed []Sensor
+	for _, s := range subs {
+		if subscription(s, chatID) >= 0 {
+			subscribed = append(subscribed, s)
+		}
+	}
+	switch {
+	case len(subscribed) == 0 && command == "/snooze":
+		return fmt.Sprintf("Only chats that get the alarms of sensor %s can snooze them.", args[0])
+	case len(subscribed) == 0:
+		return fmt.Sprintf("This chat does not get the alarms of sensor %s.", args[0])
+	case command == "/status":
+		return telegramStatus(subscribed[0], b.location)
+	}
+
+	var reply string
+	for _, s := range subscribed {
+		reply = b.change(ctx, chatID, s.DocumentID, command, args)
+	}
+	return reply
+}
+
+// change runs a command that changes the subscription with the document ID and returns the answer.
+func (b *telegramBot) change(ctx context.Context, chatID, document, command string, args []string) string {
+	var reply string
+	_, err := b.sensors.Update(ctx, document, func(s *Sensor) {
+		reply = changeSubscription(s, chatID, command, args, b.location)
+	})
+	if err == ErrSensorNotFound {
+		return "This sensor is no longer monitored."
+	}
+	if err != nil {
+		log.Printf("unable to store subscription %s: %v", document, err)
+		return "Something went wrong, please try again later."
+	}
+	return reply
+}
+
+// subscription returns the index of the channel of the sensor to the chat, or -1.
+func subscription(s Sensor, chatID string) int {
+	for i, c := range s.Channels {
+		if c.Type == "telegram" && c.Target == chatID {
+			return i
+		}
+	}
+	return -1
+}
+
+// changeSubscription runs a command that changes the subscription of a chat to the sensor
+// and returns the answer. Only the links in the alarm mails subscribe a chat.
+func changeSubscription(s *Sensor, chatID, command string, args []string, location *time.Location) string {
+	subscribed := subscription(*s, chatID)
+
+	switch command {
+	case "/subscribe":
+		if subscribed >= 0 {
+			return fmt.Sprintf("This chat already gets the alarms of sensor %s.", s.ID)
+		}
+		// keep the e-mail alarms the sensor got without channels
+		s.Channels = append(subscriptionChannels(*s), Channel{Type: "telegram", Target: chatID})
+		return fmt.Sprintf("This chat now gets the alarms of sensor %s.", s.ID)
+
+	case "/unsubscribe":
+		if subscribed < 0 {
+			return fmt.Sprintf("This chat does not get the alarms of sensor %s.", s.ID)
+		}
+		s.Channels = append(s.Channels[:subscribed:subscribed], s.Channels[subscribed+1:]...)
+		return fmt.Sprintf("This chat no longer gets the alarms of sensor %s.", s.ID)
+
+	case "/snooze":
+		if subscribed < 0 {
+			return fmt.Sprintf("Only chats that get the alarms of sensor %s can snooze them.", s.ID)
+		}
+		if len(args) < 2 {
+			return "For how long? Send e.g. /snooze " + s.ID + " 3d"
+		}
+		d, err := parseSnoozeDuration(args[1])
+		if err != nil {
+			return err.Error()
+		}
+		until := nowFunc().Add(d)
+		s.snooze(Snooze{Until: until, Reason: strings.Join(args[2:], " ")}, nowFunc())
+		return fmt.Sprintf("The alarms of sensor %s are snoozed until %s.", s.ID, formatDate("en", until.In(sensorLocation(*s, location))))
+	}
+	return ""
+}
+
+func telegramStatus(s Sensor, location *time.Location) string {
+	status := fmt.Sprintf("Sensor %s\nAlarms: %s", s.ID, describeAlarms(s.Alarms))
+	if !s.Health.Computed.IsZero() {
+		status += fmt.Sprintf("\nHealth: %d/100", s.Health.Score)
+	}
+	for _, sn := range activeSnoozes(s.Snoozes, nowFunc()) {
+		alarm := sn.Alarm
+		if alarm == "" {
+			alarm = "all alarms"
+		}
+		status += fmt.Sprintf("\nSnoozed: %s until %s", alarm, formatDate("en", sn.Until.In(sensorLocation(s, location))))
+	}
+	return status
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+// telegramStandIn is a local Bot API that keeps the messages sent to it.
+type telegramStandIn struct {
+	server *httptest.Server
+	sent   []telegramSendMessage
+}
+
+func newTelegramStandIn(t *testing.T) *telegramStandIn {
+	s := telegramStandIn{}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botT0KEN/sendMessage" {
+			w.Write([]byte(`{"ok":false,"description":"Not Found"}`))
+			return
+		}
+		var m telegramSendMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Error(err)
+		}
+		s.sent = append(s.sent, m)
+		w.Write([]byte(`{"ok":true,"result":{"message_id":42,"chat":{"id":7}}}`))
+	}))
+	return &s
+}
+
+func TestTelegramNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	standIn := newTelegramStandIn(t)
+	defer standIn.server.Close()
+
+	alarm := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "123", Alarms: Alarm{GpsMissing: testDate}}})
+	recovery := newRecoveryEvent(sensorStatus{sensor: Sensor{ID: "456"}}, Alarm{Offline: testDate})
+	recovery.Thread = "12"
+	events := []AlarmEvent{alarm, recovery}
+
+	n := telegramNotifier{api: &telegramAPI{client: standIn.server.Client(), base: standIn.server.URL, token: "T0KEN"}}
+	if err := n.Notify(context.Background(), Channel{Type: "telegram", Target: "7"}, events); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []telegramSendMessage{
+		{
+			ChatID:                "7",
+			Text:                  "<b><a href=\"https://meetjestad.net/data/sensors_recent.php?sensor=123\">Sensor 123</a></b>: info\n• no GPS fix",
+			ParseMode:             "HTML",
+			DisableWebPagePreview: true,
+		},
+		{
+			ChatID:                   "7",
+			Text:                     "<b><a href=\"https://meetjestad.net/data/sensors_recent.php?sensor=456\">Sensor 456</a></b>: working normally again",
+			ParseMode:                "HTML",
+			DisableWebPagePreview:    true,
+			ReplyToMessageID:         12,
+			AllowSendingWithoutReply: true,
+		},
+	}
+	if diff := deep.Equal(standIn.sent, want); diff != nil {
+		t.Errorf("messages failed: %v", diff)
+	}
+	if events[0].Thread != "42" || events[1].Thread != "12" {
+		t.Errorf("unexpected threads %q and %q", events[0].Thread, events[1].Thread)
+	}
+
+	n.api.token = "wrong"
+	if err := n.Notify(context.Background(), Channel{Type: "telegram", Target: "7"}, events); err == nil || !strings.Contains(err.Error(), "Not Found") {
+		t.Errorf("expected the API error, got %v", err)
+	}
+}
+
+// sensorStoreMock keeps the subscriptions by document ID. Sensors stored without
+// one get their sensor ID as document ID.
+type sensorStoreMock struct {
+	sensors map[string]Sensor
+}
+
+func (sm *sensorStoreMock) Find(ctx context.Context, id string) (Sensor, error) {
+	s, ok := sm.sensors[id]
+	if !ok {
+		return s, ErrSensorNotFound
+	}
+	s.DocumentID = id
+	return s, nil
+}
+
+func (sm *sensorStoreMock) Store(ctx context.Context, s Sensor) error {
+	if s.DocumentID == "" {
+		s.DocumentID = s.ID
+	}
+	sm.sensors[s.DocumentID] = s
+	return nil
+}
+
+func (sm *sensorStoreMock) Update(ctx context.Context, id string, change func(s *Sensor)) (Sensor, error) {
+	s, err := sm.Find(ctx, id)
+	if err != nil {
+		return s, err
+	}
+	change(&s)
+	stored := s
+	stored.DocumentID = sm.sensors[id].DocumentID
+	sm.sensors[id] = stored
+	return s, nil
+}
+
+func (sm *sensorStoreMock) Subscriptions(ctx context.Context, sensorID string) ([]Sensor, error) {
+	var res []Sensor
+	for id, s := range sm.sensors {
+		if s.ID == sensorID {
+			s.DocumentID = id
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return nil, ErrSensorNotFound
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].DocumentID < res[j].DocumentID })
+	return res, nil
+}
+
+func TestTelegramCommands(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	subscribed := []Channel{{Type: "email"}, {Type: "telegram", Target: "7"}}
+
+	token := testLinks.telegramToken("sub123", testDate)
+	expired := testLinks.telegramToken("sub123", testDate.Add(-linkExpiry-time.Second))
+
+	tests := []struct {
+		name      string
+		sensor    Sensor
+		command   string
+		wantReply string
+		want      Sensor
+	}{
+		{
+			name:      "subscribes with the link of an alarm mail",
+			sensor:    Sensor{ID: "123"},
+			command:   "/start " + token,
+			wantReply: "This chat now gets the alarms of sensor 123.",
+			want:      Sensor{ID: "123", Channels: subscribed},
+		},
+		{
+			name:      "subscribes once",
+			sensor:    Sensor{ID: "123", Channels: subscribed},
+			command:   "/start@MeetJeStadBot " + token,
+			wantReply: "This chat already gets the alarms of sensor 123.",
+			want:      Sensor{ID: "123", Channels: subscribed},
+		},
+		{
+			name:      "subscribes with the token of a link",
+			sensor:    Sensor{ID: "123"},
+			command:   "/subscribe " + token,
+			wantReply: "This chat now gets the alarms of sensor 123.",
+			want:      Sensor{ID: "123", Channels: subscribed},
+		},
+		{
+			name:      "does not subscribe without a link",
+			sensor:    Sensor{ID: "123"},
+			command:   "/subscribe 123",
+			wantReply: telegramInvalidLink,
+			want:      Sensor{ID: "123"},
+		},
+		{
+			name:      "asks for the token",
+			sensor:    Sensor{ID: "123"},
+			command:   "/subscribe",
+			wantReply: telegramHelp,
+			want:      Sensor{ID: "123"},
+		},
+		{
+			name:      "refuses forged links",
+			sensor:    Sensor{ID: "123"},
+			command:   "/start " + strings.Replace(token, "sub123", "sub456", 1),
+			wantReply: telegramInvalidLink,
+			want:      Sensor{ID: "123"},
+		},
+		{
+			name:      "refuses expired links",
+			sensor:    Sensor{ID: "123"},
+			command:   "/start " + expired,
+			wantReply: telegramInvalidLink,
+			want:      Sensor{ID: "123"},
+		},
+		{
+			name:      "unsubscribes",
+			sensor:    Sensor{ID: "123", Channels: subscribed},
+			command:   "/unsubscribe 123",
+			wantReply: "This chat no longer gets the alarms of sensor 123.",
+			want:      Sensor{ID: "123", Channels: subscribed[:1]},
+		},
+		{
+			name:      "snoozes",
+			sensor:    Sensor{ID: "123", Channels: subscribed, Snoozes: []Snooze{{Until: testDate.Add(-time.Hour)}}},
+			command:   "/snooze 123 3d new battery",
+			wantReply: "The alarms of sensor 123 are snoozed until 06 Jul 19 23:12 UTC.",
+			want: Sensor{ID: "123", Channels: subscribed, Snoozes: []Snooze{
+				{Until: testDate.Add(72 * time.Hour), Reason: "new battery"},
+			}},
+		},
+		{
+			name:      "only snoozes for subscribers",
+			sensor:    Sensor{ID: "123"},
+			command:   "/snooze 123 3d",
+			wantReply: "Only chats that get the alarms of sensor 123 can snooze them.",
+			want:      Sensor{ID: "123"},
+		},
+		{
+			name:      "rejects invalid durations",
+			sensor:    Sensor{ID: "123", Channels: subscribed},
+			command:   "/snooze 123 soon",
+			wantReply: `invalid duration "soon", use e.g. 3d or 12h`,
+			want:      Sensor{ID: "123", Channels: subscribed},
+		},
+		{
+			name:      "shows the status",
+			sensor:    Sensor{ID: "123", Channels: subscribed, Alarms: Alarm{Offline: testDate}, Health: Health{Score: 48, Computed: testDate}},
+			command:   "/status 123",
+			wantReply: "Sensor 123\nAlarms: offline\nHealth: 48/100",
+			want:      Sensor{ID: "123", Channels: subscribed, Alarms: Alarm{Offline: testDate}, Health: Health{Score: 48, Computed: testDate}},
+		},
+		{
+			name:      "shows the status to subscribers only",
+			sensor:    Sensor{ID: "123", Alarms: Alarm{Offline: testDate}},
+			command:   "/status 123",
+			wantReply: "This chat does not get the alarms of sensor 123.",
+			want:      Sensor{ID: "123", Alarms: Alarm{Offline: testDate}},
+		},
+		{
+			name:      "knows only monitored sensors",
+			sensor:    Sensor{ID: "123"},
+			command:   "/status 456",
+			wantReply: "Sensor 456 is not monitored.",
+			want:      Sensor{ID: "123"},
+		},
+	}
+
+	for _, tt := range tests {
+		// the chat's subscription and someone else's to the same sensor
+		other := Sensor{ID: "123", Channels: []Channel{{Type: "telegram", Target: "8"}}}
+		store := sensorStoreMock{sensors: map[string]Sensor{"sub123": tt.sensor, "other": other}}
+		b := telegramBot{sensors: &store, links: testLinks}
+
+		if got := b.execute(context.Background(), "7", tt.command); got != tt.wantReply {
+			t.Errorf("%s: unexpected reply %q", tt.name, got)
+		}
+		if diff := deep.Equal(store.sensors["sub123"], tt.want); diff != nil {
+			t.Errorf("%s failed: %v", tt.name, diff)
+		}
+		if diff := deep.Equal(store.sensors["other"], other); diff != nil {
+			t.Errorf("%s failed: %v", tt.name, diff)
+		}
+	}
+}
+
+func TestTelegramLink(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	templates := *testTemplates
+	templates.telegram = "MeetJeStadBot"
+	d := digest{sections: []sensorStatus{{sensor: Sensor{ID: "123", DocumentID: "sub123", Alarms: Alarm{Offline: testDate}}, reading: Reading{Date: testDate}}}}
+	msg, err := templates.renderIn(d, testTenant, testLinks, "en", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := regexp.MustCompile(`https://t\.me/MeetJeStadBot\?start=(\S+)`).FindStringSubmatch(msg.text)
+	if token == nil {
+		t.Fatalf("no Telegram link in the mail:\n%s", msg.text)
+	}
+	// Telegram only passes short start parameters of letters, digits, _ and -
+	if len(token[1]) > 64 || !regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(token[1]) {
+		t.Errorf("invalid start parameter %q", token[1])
+	}
+	if document, err := testLinks.verifyTelegram(token[1], testDate); err != nil || document != "sub123" {
+		t.Errorf("expected a link for subscription sub123, got %q, %v", document, err)
+	}
+}
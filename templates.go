@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	subjectTemplate = "subject.tmpl"
+	textTemplate    = "body.txt.tmpl"
+	htmlTemplate    = "body.html.tmpl"
+)
+
+// mail is a rendered mail.
+type mail struct {
+	subject string
+	text    string
+	html    string
+	inline  []Attachment
+	// unsubscribe is the link for the List-Unsubscribe header, empty when there is none
+	unsubscribe string
+}
+
+// templateBundle holds the templates of one language.
+type templateBundle struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// templateSet holds the template bundles of all languages and the defaults
+// used for sensors that have no language or time zone set.
+type templateSet struct {
+	bundles  map[string]*templateBundle
+	language string
+	location *time.Location
+	telegram string // username of the Telegram bot the mails link to, empty for no links
+}
+
+// alarmData is what the alarm templates are rendered with.
+// Recovery is set when all sensors are working normally again.
+type alarmData struct {
+	Sensors        []alarmSection
+	Recovery       bool
+	Signature      string
+	Links          []Link
+	UnsubscribeURL string // signed link turning off these alarms, empty when there is none
+}
+
+// alarmSection holds one sensor's problems with values already formatted for the recipient.
+type alarmSection struct {
+	ID           string
+	Offline      bool
+	OfflineSince string
+	LowVoltage   bool
+	Voltage      string
+	GpsMissing   bool
+	Recovered    bool             // the sensor has no problems (anymore)
+	Chart        htmltemplate.URL // cid: URL of the voltage chart, empty when there is none
+	SnoozeURL    string           // signed link snoozing the alarms of the sensor, empty when there is none
+	AckURL       string           // signed link acknowledging the alarms, empty when there is none
+	TelegramURL  string           // signed link adding a Telegram chat to the sensor, empty when there is none
+	// signed links turning off an alarm type for the recipient, empty when there are none
+	MuteOffline, MuteVoltage, MuteGPS string
+}
+
+type templateSource struct {
+	subject, text, html string
+}
+
+func newTemplateSet(sources map[string]templateSource, language string, location *time.Location) (*templateSet, error) {
+	ts := templateSet{
+		bundles:  make(map[string]*templateBundle),
+		language: language,
+		location: location,
+	}
+	for lang, src := range sources {
+		b, err := parseBundle(lang, src)
+		if err != nil {
+			return nil, err
+		}
+		ts.bundles[lang] = b
+	}
+	if _, ok := ts.bundles[language]; !ok {
+		return nil, fmt.Errorf("no templates for default language %q", language)
+	}
+	return &ts, nil
+}
+
+func parseBundle(lang string, src templateSource) (*templateBundle, error) {
+	var b templateBundle
+	var err error
+	if b.subject, err = texttemplate.New(lang + "/" + subjectTemplate).Parse(src.subject); err != nil {
+		return nil, err
+	}
+	if b.text, err = texttemplate.New(lang + "/" + textTemplate).Parse(src.text); err != nil {
+		return nil, err
+	}
+	if b.html, err = htmltemplate.New(lang + "/" + htmlTemplate).Parse(src.html); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// loadTemplates creates the template set for the configuration. Templates in
+// the configured directory, laid out as <dir>/<language>/<template>, replace
+// the built-in ones and can add languages. Missing files fall back to the
+// built-in English templates.
+func loadTemplates(config Config) (*templateSet, error) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %v", config.Timezone, err)
+	}
+
+	sources := make(map[string]templateSource)
+	for lang, src := range defaultTemplateSources {
+		sources[lang] = src
+	}
+
+	if config.Templates != "" {
+		dirs, err := ioutil.ReadDir(config.Templates)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read templates: %v", err)
+		}
+		for _, d := range dirs {
+			if !d.IsDir() {
+				continue
+			}
+			lang := d.Name()
+			src, ok := sources[lang]
+			if !ok {
+				src = defaultTemplateSources["en"]
+			}
+			dir := filepath.Join(config.Templates, lang)
+			if src.subject, err = readTemplate(dir, subjectTemplate, src.subject); err != nil {
+				return nil, err
+			}
+			if src.text, err = readTemplate(dir, textTemplate, src.text); err != nil {
+				return nil, err
+			}
+			if src.html, err = readTemplate(dir, htmlTemplate, src.html); err != nil {
+				return nil, err
+			}
+			sources[lang] = src
+			log.Printf("loaded %s templates from %s", lang, dir)
+		}
+	}
+
+	ts, err := newTemplateSet(sources, config.Language, location)
+	if err != nil {
+		return nil, err
+	}
+	ts.telegram = config.Telegram.Username
+	return ts, nil
+}
+
+func readTemplate(dir, name, fallback string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fallback, nil
+		}
+		return "", err
+	}
+	return string(b), nil
+}
+
+// sensorLocation returns the time zone of the sensor, or the fallback if it has none.
+// Without a fallback it is UTC.
+func sensorLocation(s Sensor, fallback *time.Location) *time.Location {
+	if fallback == nil {
+		fallback = time.UTC
+	}
+	if s.Timezone == "" {
+		return fallback
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		log.Printf("invalid time zone %q for sensor %s: %v", s.Timezone, s.ID, err)
+		return fallback
+	}
+	return loc
+}
+
+// render renders the alarm mail for a digest in the language and time zone of its first sensor.
+// The links in the mail are signed with links, without it the mail has none.
+func (ts *templateSet) render(d digest, t *tenant, links *linkSigner) (mail, error) {
+	lang, loc := ts.language, ts.location
+	if len(d.sections) > 0 {
+		s := d.sections[0].sensor
+		if _, ok := ts.bundles[s.Language]; ok {
+			lang = s.Language
+		}
+		loc = sensorLocation(s, loc)
+	}
+	return ts.renderIn(d, t, links, lang, loc)
+}
+
+func (ts *templateSet) renderIn(d digest, t *tenant, links *linkSigner, lang string, loc *time.Location) (mail, error) {
+	b, ok := ts.bundles[lang]
+	if !ok {
+		return mail{}, fmt.Errorf("no templates for language %q", lang)
+	}
+
+	var res mail
+	data := alarmData{Recovery: true, Signature: t.signature, Links: t.links}
+	now := nowFunc()
+	var ids, documents []string
+	for _, sec := range d.sections {
+		ids = append(ids, sec.sensor.ID)
+		documents = append(documents, sec.sensor.DocumentID)
+	}
+	res.unsubscribe = links.url("/unsubscribe", linkClaims{
+		Action:    actionUnsubscribe,
+		Target:    d.recipient,
+		Sensors:   ids,
+		Documents: documents,
+		Expires:   now.Add(unsubscribeExpiry).Unix(),
+	}, now)
+	data.UnsubscribeURL = res.unsubscribe
+	mute := func(s Sensor, alarm string) string {
+		return links.url("/unsubscribe", linkClaims{
+			Action:    actionUnsubscribe,
+			Target:    d.recipient,
+			Sensors:   []string{s.ID},
+			Documents: []string{s.DocumentID},
+			Alarm:     alarm,
+			Expires:   now.Add(unsubscribeExpiry).Unix(),
+		}, now)
+	}
+
+	for _, sec := range d.sections {
+		a := sec.sensor.Alarms
+		section := alarmSection{
+			ID:           sec.sensor.ID,
+			Offline:      !a.Offline.IsZero(),
+			OfflineSince: formatDate(lang, sec.reading.Date.In(loc)),
+			LowVoltage:   !a.LowVoltage.IsZero(),
+			Voltage:      formatDecimal(lang, float64(sec.reading.Voltage)),
+			GpsMissing:   !a.GpsMissing.IsZero(),
+		}
+		section.Recovered = !section.Offline && !section.LowVoltage && !section.GpsMissing
+		data.Recovery = data.Recovery && section.Recovered
+		if !section.Recovered {
+			section.SnoozeURL = links.url("/snooze", linkClaims{Action: actionSnooze, Sensor: sec.sensor.ID, Document: sec.sensor.DocumentID}, now)
+		}
+		if section.Offline {
+			section.MuteOffline = mute(sec.sensor, AlarmOffline)
+		}
+		if section.LowVoltage {
+			section.MuteVoltage = mute(sec.sensor, AlarmVoltage)
+		}
+		if section.GpsMissing {
+			section.MuteGPS = mute(sec.sensor, AlarmGPS)
+		}
+		if token := links.telegramToken(sec.sensor.DocumentID, now); token != "" && ts.telegram != "" && !section.Recovered {
+			section.TelegramURL = "https://t.me/" + ts.telegram + "?start=" + token
+		}
+		if inc := sec.sensor.Incident; inc.open() && !inc.acknowledged() {
+			section.AckURL = links.url("/ack", linkClaims{Action: actionAck, Sensor: sec.sensor.ID, Document: sec.sensor.DocumentID, Incident: inc.Started.Unix()}, now)
+		}
+		if len(sec.history) > 1 && !section.Recovered {
+			chart, err := voltageChart(sec.history, sec.sensor.Threshold, now)
+			if err != nil {
+				log.Printf("unable to draw chart for sensor %s: %v", sec.sensor.ID, err)
+			} else {
+				name := "chart-" + sec.sensor.ID + ".png"
+				res.inline = append(res.inline, Attachment{Filename: name, ContentType: "image/png", Data: chart})
+				section.Chart = htmltemplate.URL("cid:" + name)
+			}
+		}
+		data.Sensors = append(data.Sensors, section)
+	}
+
+	var buf bytes.Buffer
+	if err := b.subject.Execute(&buf, data); err != nil {
+		return res, err
+	}
+	res.subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := b.text.Execute(&buf, data); err != nil {
+		return res, err
+	}
+	res.text = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := b.html.Execute(&buf, data); err != nil {
+		return res, err
+	}
+	res.html = buf.String()
+
+	return res, nil
+}
+
+var dutchMonths = [...]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"}
+
+// formatDate formats a date the way it is usually written in the language.
+func formatDate(lang string, t time.Time) string {
+	switch lang {
+	case "nl":
+		zone, _ := t.Zone()
+		return fmt.Sprintf("%d %s %d %s %s", t.Day(), dutchMonths[t.Month()-1], t.Year(), t.Format("15:04"), zone)
+	default:
+		return t.Format(time.RFC822)
+	}
+}
+
+// formatDecimal formats a number with two decimals and the language's decimal separator.
+func formatDecimal(lang string, f float64) string {
+	s := fmt.Sprintf("%.2f", f)
+	if lang == "nl" {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
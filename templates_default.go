@@ -0,0 +1,202 @@
+package main
+
+// defaultTemplateSources are the built-in alarm mail templates per language.
+// They can be replaced by files in the configured templates directory.
+var defaultTemplateSources = map[string]templateSource{
+	"en": {
+		subject: `{{if .Recovery}}{{if eq (len .Sensors) 1}}Meet je stad sensor {{(index .Sensors 0).ID}} is working again{{else}}{{len .Sensors}} of your Meet je stad sensors are working again{{end}}{{else}}{{if eq (len .Sensors) 1}}Issues with Meet je stad sensor {{(index .Sensors 0).ID}}{{else}}Issues with {{len .Sensors}} of your Meet je stad sensors{{end}}{{end}}`,
+		text: `Hi,
+
+{{if eq (len .Sensors) 1 -}}
+{{if .Recovery -}}
+This is an automated message to tell you that your Meet je stad weather sensor is working normally again.
+
+{{else -}}
+This is an automated message to tell you that there is one or more problems with your Meet je stad weather sensor.
+
+The problems are:
+
+{{template "problems" index .Sensors 0}}
+{{end -}}
+{{else -}}
+{{if .Recovery -}}
+This is an automated message to tell you that {{len .Sensors}} of your Meet je stad weather sensors are working normally again.
+{{- else -}}
+This is an automated message to tell you that there are problems with {{len .Sensors}} of your Meet je stad weather sensors.
+{{- end}}
+
+{{range .Sensors}}Sensor {{.ID}}:
+
+{{template "problems" .}}
+{{end}}
+{{- end -}}
+-- 
+Regards,
+
+{{if .Signature}}{{.Signature}}{{else}}The Meet je stad monitoring robot{{end}}
+{{- if .Links}}
+{{range .Links}}
+{{.Title}}: {{.URL}}
+{{- end}}
+{{- end}}
+{{- if .UnsubscribeURL}}
+
+Unsubscribe from these alarms: {{.UnsubscribeURL}}
+{{- end}}
+{{define "problems" -}}
+{{if .Offline}}* The sensor has been offline since {{.OfflineSince}}
+{{if .MuteOffline}}  Stop these alarms: {{.MuteOffline}}
+{{end}}{{end -}}
+{{if .LowVoltage}}* The battery seems to be low: {{.Voltage}}V
+{{if .MuteVoltage}}  Stop these alarms: {{.MuteVoltage}}
+{{end}}{{end -}}
+{{if .GpsMissing}}* The sensor has lost GPS fix
+{{if .MuteGPS}}  Stop these alarms: {{.MuteGPS}}
+{{end}}{{end -}}
+{{if .Recovered}}* The sensor is working normally again
+{{end -}}
+{{if .AckURL}}
+Seen this? Acknowledge the alarms so they are not repeated: {{.AckURL}}
+{{end -}}
+{{if .SnoozeURL}}
+Working on the sensor? Snooze its alarms for a week: {{.SnoozeURL}}
+{{end -}}
+{{if .TelegramURL}}
+Get the alarms of the sensor in a Telegram chat: {{.TelegramURL}}
+{{end -}}
+{{end}}`,
+		html: `<!DOCTYPE html>
+<html>
+<body>
+<p>Hi,</p>
+{{if eq (len .Sensors) 1 -}}
+{{if .Recovery -}}
+<p>This is an automated message to tell you that your Meet je stad weather sensor is working normally again.</p>
+{{- else -}}
+<p>This is an automated message to tell you that there is one or more problems with your Meet je stad weather sensor.</p>
+<p>The problems are:</p>
+{{template "problems" index .Sensors 0}}
+{{- end}}
+{{- else -}}
+<p>{{if .Recovery}}This is an automated message to tell you that {{len .Sensors}} of your Meet je stad weather sensors are working normally again.{{else}}This is an automated message to tell you that there are problems with {{len .Sensors}} of your Meet je stad weather sensors.{{end}}</p>
+{{range .Sensors}}<h3>Sensor {{.ID}}</h3>
+{{template "problems" .}}
+{{end}}
+{{- end}}
+<p>Regards,<br>{{if .Signature}}{{.Signature}}{{else}}The Meet je stad monitoring robot{{end}}</p>
+{{if .Links}}<p>{{range $i, $l := .Links}}{{if $i}} | {{end}}<a href="{{$l.URL}}">{{$l.Title}}</a>{{end}}</p>{{end}}
+{{if .UnsubscribeURL}}<p><a href="{{.UnsubscribeURL}}">Unsubscribe from these alarms</a></p>{{end}}
+</body>
+</html>
+{{define "problems" -}}
+<ul>
+{{if .Offline}}<li>The sensor has been offline since {{.OfflineSince}}{{if .MuteOffline}} (<a href="{{.MuteOffline}}">stop these alarms</a>){{end}}</li>{{end -}}
+{{if .LowVoltage}}<li>The battery seems to be low: {{.Voltage}}V{{if .MuteVoltage}} (<a href="{{.MuteVoltage}}">stop these alarms</a>){{end}}</li>{{end -}}
+{{if .GpsMissing}}<li>The sensor has lost GPS fix{{if .MuteGPS}} (<a href="{{.MuteGPS}}">stop these alarms</a>){{end}}</li>{{end -}}
+{{if .Recovered}}<li>The sensor is working normally again</li>{{end}}
+</ul>
+{{if .Chart}}<p><img src="{{.Chart}}" width="600" height="200" alt="Voltage and messages of the last three days"></p>{{end}}
+{{if .AckURL}}<p>Seen this? <a href="{{.AckURL}}">Acknowledge the alarms</a> so they are not repeated.</p>{{end}}
+{{if .SnoozeURL}}<p>Working on the sensor? <a href="{{.SnoozeURL}}">Snooze its alarms for a week</a>.</p>{{end}}
+{{if .TelegramURL}}<p><a href="{{.TelegramURL}}">Get the alarms of the sensor in a Telegram chat</a>.</p>{{end}}
+{{- end}}`,
+	},
+	"nl": {
+		subject: `{{if .Recovery}}{{if eq (len .Sensors) 1}}Meet je stad-sensor {{(index .Sensors 0).ID}} werkt weer{{else}}{{len .Sensors}} van je Meet je stad-sensoren werken weer{{end}}{{else}}{{if eq (len .Sensors) 1}}Problemen met Meet je stad-sensor {{(index .Sensors 0).ID}}{{else}}Problemen met {{len .Sensors}} van je Meet je stad-sensoren{{end}}{{end}}`,
+		text: `Hallo,
+
+{{if eq (len .Sensors) 1 -}}
+{{if .Recovery -}}
+Dit is een automatisch bericht om je te laten weten dat je Meet je stad-weerstation weer normaal werkt.
+
+{{else -}}
+Dit is een automatisch bericht om je te laten weten dat er een of meer problemen zijn met je Meet je stad-weerstation.
+
+De problemen zijn:
+
+{{template "problems" index .Sensors 0}}
+{{end -}}
+{{else -}}
+{{if .Recovery -}}
+Dit is een automatisch bericht om je te laten weten dat {{len .Sensors}} van je Meet je stad-weerstations weer normaal werken.
+{{- else -}}
+Dit is een automatisch bericht om je te laten weten dat er problemen zijn met {{len .Sensors}} van je Meet je stad-weerstations.
+{{- end}}
+
+{{range .Sensors}}Sensor {{.ID}}:
+
+{{template "problems" .}}
+{{end}}
+{{- end -}}
+-- 
+Groeten,
+
+{{if .Signature}}{{.Signature}}{{else}}De Meet je stad-monitoringrobot{{end}}
+{{- if .Links}}
+{{range .Links}}
+{{.Title}}: {{.URL}}
+{{- end}}
+{{- end}}
+{{- if .UnsubscribeURL}}
+
+Afmelden voor deze meldingen: {{.UnsubscribeURL}}
+{{- end}}
+{{define "problems" -}}
+{{if .Offline}}* De sensor is offline sinds {{.OfflineSince}}
+{{if .MuteOffline}}  Zet deze meldingen uit: {{.MuteOffline}}
+{{end}}{{end -}}
+{{if .LowVoltage}}* De batterij lijkt bijna leeg: {{.Voltage}}V
+{{if .MuteVoltage}}  Zet deze meldingen uit: {{.MuteVoltage}}
+{{end}}{{end -}}
+{{if .GpsMissing}}* De sensor heeft geen GPS-fix meer
+{{if .MuteGPS}}  Zet deze meldingen uit: {{.MuteGPS}}
+{{end}}{{end -}}
+{{if .Recovered}}* De sensor werkt weer normaal
+{{end -}}
+{{if .AckURL}}
+Gezien? Bevestig de meldingen, dan worden ze niet herhaald: {{.AckURL}}
+{{end -}}
+{{if .SnoozeURL}}
+Ben je met de sensor bezig? Zet de meldingen een week uit: {{.SnoozeURL}}
+{{end -}}
+{{if .TelegramURL}}
+Ontvang de meldingen van de sensor in een Telegram-chat: {{.TelegramURL}}
+{{end -}}
+{{end}}`,
+		html: `<!DOCTYPE html>
+<html lang="nl">
+<body>
+<p>Hallo,</p>
+{{if eq (len .Sensors) 1 -}}
+{{if .Recovery -}}
+<p>Dit is een automatisch bericht om je te laten weten dat je Meet je stad-weerstation weer normaal werkt.</p>
+{{- else -}}
+<p>Dit is een automatisch bericht om je te laten weten dat er een of meer problemen zijn met je Meet je stad-weerstation.</p>
+<p>De problemen zijn:</p>
+{{template "problems" index .Sensors 0}}
+{{- end}}
+{{- else -}}
+<p>{{if .Recovery}}Dit is een automatisch bericht om je te laten weten dat {{len .Sensors}} van je Meet je stad-weerstations weer normaal werken.{{else}}Dit is een automatisch bericht om je te laten weten dat er problemen zijn met {{len .Sensors}} van je Meet je stad-weerstations.{{end}}</p>
+{{range .Sensors}}<h3>Sensor {{.ID}}</h3>
+{{template "problems" .}}
+{{end}}
+{{- end}}
+<p>Groeten,<br>{{if .Signature}}{{.Signature}}{{else}}De Meet je stad-monitoringrobot{{end}}</p>
+{{if .Links}}<p>{{range $i, $l := .Links}}{{if $i}} | {{end}}<a href="{{$l.URL}}">{{$l.Title}}</a>{{end}}</p>{{end}}
+{{if .UnsubscribeURL}}<p><a href="{{.UnsubscribeURL}}">Afmelden voor deze meldingen</a></p>{{end}}
+</body>
+</html>
+{{define "problems" -}}
+<ul>
+{{if .Offline}}<li>De sensor is offline sinds {{.OfflineSince}}{{if .MuteOffline}} (<a href="{{.MuteOffline}}">deze meldingen uitzetten</a>){{end}}</li>{{end -}}
+{{if .LowVoltage}}<li>De batterij lijkt bijna leeg: {{.Voltage}}V{{if .MuteVoltage}} (<a href="{{.MuteVoltage}}">deze meldingen uitzetten</a>){{end}}</li>{{end -}}
+{{if .GpsMissing}}<li>De sensor heeft geen GPS-fix meer{{if .MuteGPS}} (<a href="{{.MuteGPS}}">deze meldingen uitzetten</a>){{end}}</li>{{end -}}
+{{if .Recovered}}<li>De sensor werkt weer normaal</li>{{end}}
+</ul>
+{{if .Chart}}<p><img src="{{.Chart}}" width="600" height="200" alt="Spanning en berichten van de afgelopen drie dagen"></p>{{end}}
+{{if .AckURL}}<p>Gezien? <a href="{{.AckURL}}">Bevestig de meldingen</a>, dan worden ze niet herhaald.</p>{{end}}
+{{if .SnoozeURL}}<p>Ben je met de sensor bezig? <a href="{{.SnoozeURL}}">Zet de meldingen een week uit</a>.</p>{{end}}
+{{if .TelegramURL}}<p><a href="{{.TelegramURL}}">Ontvang de meldingen van de sensor in een Telegram-chat</a>.</p>{{end}}
+{{- end}}`,
+	},
+}
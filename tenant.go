@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const defaultSignature = "The Meet je stad monitoring robot"
+
+// tenant is a Meet je stad instance with its own mailer and branding.
+type tenant struct {
+	name      string
+	mailer    Mailer
+	from      string
+	replyTo   string
+	signature string
+	links     []Link
+}
+
+// tenants holds the configured tenants. Sensors without a tenant,
+// or with an unknown one, use the default tenant.
+type tenants struct {
+	byName   map[string]*tenant
+	fallback *tenant
+}
+
+func newTenants(c Config) (*tenants, error) {
+	fallback, err := newTenant("", c.Mailer, c.Mailer)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := tenants{byName: make(map[string]*tenant), fallback: fallback}
+	for name, mc := range c.Tenants {
+		t, err := newTenant(name, mc, c.Mailer)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", name, err)
+		}
+		ts.byName[name] = t
+	}
+
+	return &ts, nil
+}
+
+// newTenant sets up a tenant. Mailer settings that are left out are taken from
+// the default mailer, so tenants can share a Mailgun account with their own domain.
+func newTenant(name string, mc MailerConfig, defaults MailerConfig) (*tenant, error) {
+	if mc.Backend == "" {
+		mc.Backend = defaults.Backend
+	}
+	if mc.SecretPath == "" {
+		mc.SecretPath = defaults.SecretPath
+	}
+	if mc.Domain == "" {
+		mc.Domain = defaults.Domain
+	}
+	if mc.APIBase == "" {
+		mc.APIBase = defaults.APIBase
+	}
+	if mc.SMTP.Host == "" {
+		mc.SMTP = defaults.SMTP
+	}
+
+	m, err := newMailer(mc)
+	if err != nil {
+		return nil, err
+	}
+
+	t := tenant{
+		name:      name,
+		mailer:    m,
+		from:      mc.From,
+		replyTo:   mc.ReplyTo,
+		signature: mc.Signature,
+		links:     mc.FooterLinks,
+	}
+	if t.from == "" {
+		t.from = "alert@" + mc.Domain
+	}
+
+	return &t, nil
+}
+
+func (ts *tenants) lookup(name string) *tenant {
+	if name == "" {
+		return ts.fallback
+	}
+	t, ok := ts.byName[name]
+	if !ok {
+		log.Printf("unknown tenant %q, using the default", name)
+		return ts.fallback
+	}
+	return t
+}
+
+// message creates a message from the tenant's sender.
+func (t *tenant) message(to, subject, text string) Message {
+	return Message{
+		To:      to,
+		From:    t.from,
+		ReplyTo: t.replyTo,
+		Subject: subject,
+		Text:    text,
+	}
+}
+
+// signatureBlock is the end of the plain text mails.
+func (t *tenant) signatureBlock() string {
+	signature := t.signature
+	if signature == "" {
+		signature = defaultSignature
+	}
+	s := "\n-- \nRegards,\n\n" + signature
+	for i, l := range t.links {
+		if i == 0 {
+			s += "\n"
+		}
+		s += fmt.Sprintf("\n%s: %s", l.Title, l.URL)
+	}
+	return s
+}
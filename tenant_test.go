@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestNewTenants(t *testing.T) {
+	c := Config{
+		Mailer: MailerConfig{Domain: "monitoring.meetjescraper.online", APIBase: "https://api.eu.mailgun.net/v3"},
+		Tenants: map[string]MailerConfig{
+			"amersfoort": {
+				Domain:    "monitor.meetjestad-amersfoort.nl",
+				ReplyTo:   "info@meetjestad-amersfoort.nl",
+				Signature: "Meet je stad Amersfoort",
+			},
+		},
+	}
+
+	ts, err := newTenants(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		tenant      string
+		wantFrom    string
+		wantReplyTo string
+	}{
+		{name: "default tenant", tenant: "", wantFrom: "alert@monitoring.meetjescraper.online"},
+		{name: "configured tenant", tenant: "amersfoort", wantFrom: "alert@monitor.meetjestad-amersfoort.nl", wantReplyTo: "info@meetjestad-amersfoort.nl"},
+		{name: "unknown tenant falls back", tenant: "nowhere", wantFrom: "alert@monitoring.meetjescraper.online"},
+	}
+
+	for _, tt := range tests {
+		msg := ts.lookup(tt.tenant).message("owner@example.com", "subject", "body")
+		if msg.From != tt.wantFrom || msg.ReplyTo != tt.wantReplyTo {
+			t.Errorf("%s failed: from %q reply to %q", tt.name, msg.From, msg.ReplyTo)
+		}
+	}
+}
+
+func TestRenderBranding(t *testing.T) {
+	branded := &tenant{
+		signature: "Meet je stad Amersfoort",
+		links: []Link{
+			{Title: "Website", URL: "https://meetjestad-amersfoort.nl"},
+			{Title: "Monitoring", URL: "https://monitoring.meetjescraper.online"},
+		},
+	}
+	d := digest{sections: []sensorStatus{
+		{sensor: Sensor{ID: "123", Alarms: Alarm{Offline: testDate}}, reading: Reading{Date: testDate}},
+	}}
+
+	msg, err := testTemplates.renderIn(d, branded, nil, "en", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(msg.text, fixture("branded")); diff != nil {
+		t.Errorf("branding failed: %v", diff)
+	}
+}
@@ -9,6 +9,8 @@ type Reading struct {
 	Voltage  float32   `json:"voltage"`
 	Firmware string    `json:"firmware_version"`
 	Position Position  `json:"coordinates"`
+	RSSI     float32   `json:"rssi"`
+	SNR      float32   `json:"snr"`
 }
 
 // Position is a coordinate with latitude and longitude.
@@ -21,23 +23,191 @@ type Position struct {
 type Config struct {
 	Frequency time.Duration
 	Mailer    MailerConfig
+	Reports   ReportsConfig
+	Templates string // directory with templates replacing the built-in ones
+	Language  string // language for sensors that have none set
+	Timezone  string // time zone for sensors that have none set
+	Tenants   map[string]MailerConfig
+	Matrix    MatrixConfig
+	Telegram  TelegramConfig
+	Ntfy      NtfyConfig
+	Pushover  PushoverConfig
+	Limits    LimitsConfig
+	HTTP      HTTPConfig
+	// EscalateAfter is how long alarms can go unacknowledged before they go to
+	// the escalation channels of the sensor, 0 to never escalate
+	EscalateAfter time.Duration `yaml:"escalateAfter"`
+	// VerifyWithin is how long new addresses have to confirm they want the alarms,
+	// 0 to mail them without asking
+	VerifyWithin time.Duration `yaml:"verifyWithin"`
+	// VerifySince is when double opt-in was enabled, the subscriptions created before
+	// keep the addresses they have when they are first checked
+	VerifySince time.Time `yaml:"verifySince"`
+	// AdminChannels get every alarm and recovery of all sensors
+	AdminChannels []Channel `yaml:"adminChannels"`
 }
 
-// MailerConfig stores configuration for Mailgun.
+// ReportsConfig stores the schedules of the periodic reports.
+type ReportsConfig struct {
+	Owner       string   // e.g. "Mondays 08:00 Europe/Amsterdam", empty to disable
+	Fleet       string   // schedule of the fleet report sent to the admins
+	Admins      []string // addresses receiving the fleet report
+	OfflineDays int      `yaml:"offlineDays"`
+}
+
+// MailerConfig stores configuration for sending mail and the branding of the mails.
 type MailerConfig struct {
-	SecretPath string `yaml:"secretPath"`
-	Domain     string
-	APIBase    string
+	Backend     string // "mailgun" (default) or "smtp"
+	SecretPath  string `yaml:"secretPath"`
+	Domain      string
+	APIBase     string
+	SMTP        SMTPConfig
+	From        string // defaults to alert@<domain>
+	ReplyTo     string `yaml:"replyTo"`
+	Signature   string
+	FooterLinks []Link `yaml:"footerLinks"`
+}
+
+// Link is a link shown at the bottom of mails.
+type Link struct {
+	Title string
+	URL   string
+}
+
+// MatrixConfig is the account the Matrix notifier posts with.
+type MatrixConfig struct {
+	Homeserver string // e.g. https://matrix.org
+	TokenPath  string `yaml:"tokenPath"` // file with the access token
+}
+
+// TelegramConfig is the bot that sends alarms and answers commands.
+type TelegramConfig struct {
+	APIBase   string `yaml:"apiBase"`   // defaults to https://api.telegram.org
+	TokenPath string `yaml:"tokenPath"` // file with the bot token
+	Username  string // of the bot, for the links in alarm mails that add a chat
+}
+
+// NtfyConfig is the server ntfy topics are published on.
+type NtfyConfig struct {
+	Server    string // defaults to https://ntfy.sh
+	TokenPath string `yaml:"tokenPath"` // optional file with an access token
+}
+
+// PushoverConfig is the application Pushover messages are sent from.
+type PushoverConfig struct {
+	APIBase   string `yaml:"apiBase"`   // defaults to https://api.pushover.net
+	TokenPath string `yaml:"tokenPath"` // file with the application token
+}
+
+// HTTPConfig is the server for the API and the links in the mails.
+type HTTPConfig struct {
+	Listen     string // address to listen on, e.g. :8080, empty to disable
+	BaseURL    string `yaml:"baseURL"`    // where the server is reachable, e.g. https://monitor.example.com
+	SecretPath string `yaml:"secretPath"` // file with the key the links are signed with
+	TokenPath  string `yaml:"tokenPath"`  // file with the bearer token of the API
+	// file with the HTTP webhook signing key of Mailgun, enables the events webhook
+	MailgunKeyPath string `yaml:"mailgunKeyPath"`
+}
+
+// LimitsConfig limits the messages to every target, such as an address or a chat.
+type LimitsConfig struct {
+	PerRecipient int `yaml:"perRecipient"` // messages per day, 0 for no limit
+}
+
+// SMTPConfig stores configuration for sending mail through an SMTP server.
+type SMTPConfig struct {
+	Host         string
+	Port         int
+	TLS          string // "starttls" (default), "tls" or "none"
+	Username     string
+	PasswordPath string `yaml:"passwordPath"`
 }
 
 // Subscription represents a sensor to monitor and an email address to send alarms to.
 type Sensor struct {
-	ID           string  `firestore:"sensor_id"`
-	EmailAddress string  `firestore:"email_address"`
-	Threshold    float32 `firestore:"threshold"`
-	Owner        string  `firestore:"owner"`
-	Alarms       Alarm   `firestore:"alarms"`
-	DocumentID   string
+	ID           string     `firestore:"sensor_id"`
+	EmailAddress string     `firestore:"email_address"`
+	Threshold    float32    `firestore:"threshold"`
+	Owner        string     `firestore:"owner"`
+	Alarms       Alarm      `firestore:"alarms"`
+	Raised       Alarm      `firestore:"raised"` // when the alarms were last raised, kept after they are cleared
+	Health       Health     `firestore:"health"`
+	Reports      bool       `firestore:"reports"`
+	Language     string     `firestore:"language"`
+	Tenant       string     `firestore:"tenant"`
+	Channels     []Channel  `firestore:"channels"`
+	Timezone     string     `firestore:"timezone"`
+	Snoozes      []Snooze   `firestore:"snoozes"`
+	QuietHours   QuietHours `firestore:"quiet_hours"`
+	Escalation   []Channel  `firestore:"escalation"` // get unacknowledged alarms, e.g. a caretaker
+	Fallback     []Channel  `firestore:"fallback"`   // replace e-mail channels that became undeliverable
+	Incident     *Incident  `firestore:"incident"`   // the current or last incident
+	// Verifications are the double opt-ins of the addresses the alarms are mailed to
+	Verifications []Verification `firestore:"verifications"`
+	// OptIn is when the addresses of the subscription were first checked for double opt-in
+	OptIn      time.Time `firestore:"opt_in"`
+	DocumentID string
+	Created    time.Time `firestore:"-"` // when the subscription was created
+}
+
+// Verification is the double opt-in of an address the alarms of a sensor are mailed to.
+type Verification struct {
+	Address   string    `firestore:"address"`
+	Sent      time.Time `firestore:"sent"` // when the mail asking to confirm was sent
+	Confirmed time.Time `firestore:"confirmed"`
+	Expired   time.Time `firestore:"expired"` // when it was not confirmed in time
+}
+
+// Incident is a period in which a sensor has alarms, from the first alarm until it works again.
+type Incident struct {
+	Started      time.Time      `firestore:"started" json:"started"`
+	Acknowledged time.Time      `firestore:"acknowledged" json:"acknowledged"`
+	Escalated    time.Time      `firestore:"escalated" json:"escalated"`
+	Resolved     time.Time      `firestore:"resolved" json:"resolved"`
+	Steps        []IncidentStep `firestore:"steps" json:"steps"`
+}
+
+// IncidentStep records what happened during an incident.
+type IncidentStep struct {
+	Time   time.Time `firestore:"time" json:"time"`
+	Action string    `firestore:"action" json:"action"` // raised, acknowledged, escalated or resolved
+	Detail string    `firestore:"detail" json:"detail"` // the alarms, who acknowledged or the escalation targets
+}
+
+// QuietHours is the time of day, like 22:00 to 07:00 in the sensor's time zone,
+// during which only critical alarms are sent.
+type QuietHours struct {
+	Start string `firestore:"start"`
+	End   string `firestore:"end"`
+}
+
+// Snooze keeps an alarm type, or all alarms when Alarm is empty, from being raised until a moment.
+type Snooze struct {
+	Alarm  string    `firestore:"alarm" json:"alarm"`
+	Until  time.Time `firestore:"until" json:"until"`
+	Reason string    `firestore:"reason" json:"reason"`
+}
+
+// Channel is a way of notifying the subscriber: "email", "webhook", "slack" (also for Mattermost), "matrix",
+// "telegram", "push", "ntfy" or "pushover".
+// It keeps track of its own deliveries so a failing channel does not hold back the others.
+type Channel struct {
+	Type        string    `firestore:"type"`
+	Target      string    `firestore:"target"`    // address, URL, chat or device, depending on the type
+	Secret      string    `firestore:"secret"`    // key to sign webhook payloads with
+	Format      string    `firestore:"format"`    // payload format of webhooks, "cloudevents" or empty
+	Thread      string    `firestore:"thread"`    // chat thread of the ongoing incident
+	Queued      Alarm     `firestore:"queued"`    // the alarms last queued for the channel
+	Delivered   Alarm     `firestore:"delivered"` // the alarms last delivered, none after a recovery
+	LastAttempt time.Time `firestore:"last_attempt"`
+	LastError   string    `firestore:"last_error"`
+	MaxPerDay   int       `firestore:"max_per_day"` // limit of messages per day, 0 for none
+	Disabled    bool      `firestore:"disabled"`    // unsubscribed, kept so the sensor does not fall back to e-mail
+	Muted       []string  `firestore:"muted"`       // alarm types, or "reports", the channel does not get
+	// when mails to the address bounced permanently or were reported as spam
+	Undeliverable time.Time `firestore:"undeliverable"`
+	// attach the readings the check looked at as CSV to alarm mails
+	AttachReadings bool `firestore:"attach_readings"`
 }
 
 // Alarm represents a sensor that was below the threshold and an email has been sent.
@@ -47,8 +217,24 @@ type Alarm struct {
 	LowVoltage time.Time `firestore:"voltage"`
 }
 
+// merge returns a with the timestamps of the alarms that are set in b.
+func (a Alarm) merge(b Alarm) Alarm {
+	if !b.Offline.IsZero() {
+		a.Offline = b.Offline
+	}
+	if !b.GpsMissing.IsZero() {
+		a.GpsMissing = b.GpsMissing
+	}
+	if !b.LowVoltage.IsZero() {
+		a.LowVoltage = b.LowVoltage
+	}
+	return a
+}
+
 var defaultConfig = Config{
 	Frequency: time.Duration(3600000000000),
+	Language:  "en",
+	Timezone:  "Europe/Amsterdam",
 	Mailer: MailerConfig{
 		Domain:  "monitoring.meetjescraper.online",
 		APIBase: "https://api.eu.mailgun.net/v3",
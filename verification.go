@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var errAddressChanged = errors.New("the address no longer gets the alarms of the sensor")
+
+// verifier asks new addresses to confirm they want the alarms of a sensor before
+// they are mailed, so nobody gets alarms for an address someone else entered.
+type verifier struct {
+	tenants  *tenants
+	within   time.Duration  // how long an address has to confirm
+	since    time.Time      // subscriptions created before keep their addresses
+	location *time.Location // time zone for sensors that have none set
+	links    *linkSigner    // signs the links to confirm
+}
+
+// check starts the verification of new addresses, resends the mails that failed and
+// expires the verifications that were not confirmed in time. Addresses that are no longer
+// mailed lose their verification. Subscriptions created before opt-in was enabled keep
+// the addresses they have when they are first checked, addresses added later are asked.
+func (v *verifier) check(ctx context.Context, st *sensorStatus, now time.Time) {
+	s := &st.sensor
+	grandfathered := s.OptIn.IsZero() && !s.Created.IsZero() && s.Created.Before(v.since)
+	if s.OptIn.IsZero() {
+		s.OptIn = now
+	}
+
+	var verifications []Verification
+	for _, address := range emailTargets(*s) {
+		vr := Verification{Address: address}
+		if i := s.verification(address); i >= 0 {
+			vr = s.Verifications[i]
+		}
+		switch {
+		case grandfathered:
+			vr.Confirmed = now
+		case !vr.Confirmed.IsZero() || !vr.Expired.IsZero():
+		case vr.Sent.IsZero():
+			v.send(ctx, *s, &vr, now)
+		case now.Sub(vr.Sent) >= v.within:
+			log.Printf("%s did not confirm the alarms of sensor %s", vr.Address, s.ID)
+			vr.Expired = now
+		}
+		verifications = append(verifications, vr)
+	}
+	s.Verifications = verifications
+}
+
+func (v *verifier) send(ctx context.Context, s Sensor, vr *Verification, now time.Time) {
+	deadline := now.Add(v.within)
+	link := v.links.url("/verify", linkClaims{
+		Action:   actionVerify,
+		Sensor:   s.ID,
+		Document: s.DocumentID,
+		Target:   vr.Address,
+		Expires:  deadline.Unix(),
+	}, now)
+
+	t := v.tenants.lookup(s.Tenant)
+	msg := t.message(vr.Address, "Confirm the alarms of Meet je stad sensor "+s.ID,
+		composeVerification(s, link, deadline.In(sensorLocation(s, v.location)), t))
+	msg.Variables = map[string]string{"sensors": s.ID}
+	if _, err := t.mailer.Send(ctx, msg); err != nil {
+		log.Printf("failed to send verification of sensor %s to %s: %v", s.ID, vr.Address, err)
+		return
+	}
+	vr.Sent = now
+}
+
+// emailTargets returns the addresses the alarms of the sensor can be mailed to: those of its
+// channels, its escalation channels and its fallback channels. Addresses that unsubscribed
+// or are undeliverable are left out.
+func emailTargets(s Sensor) []string {
+	var res []string
+	for _, channels := range [][]Channel{subscriptionChannels(s), s.Escalation, s.Fallback} {
+		for _, c := range channels {
+			if c.Type != "email" || c.Disabled || !c.Undeliverable.IsZero() {
+				continue
+			}
+			if address := channelTarget(s, c); address != "" && !contains(res, address) {
+				res = append(res, address)
+			}
+		}
+	}
+	return res
+}
+
+// verification returns the index of the verification of the address, or -1.
+func (s Sensor) verification(address string) int {
+	for i, vr := range s.Verifications {
+		if vr.Address == address {
+			return i
+		}
+	}
+	return -1
+}
+
+func composeVerification(s Sensor, link string, deadline time.Time, t *tenant) string {
+	sb := strings.Builder{}
+	sb.WriteString("Hi,\n\n")
+	sb.WriteString(fmt.Sprintf("Someone, hopefully you, asked to get the alarms of Meet je stad sensor %s at this address.\n", s.ID))
+	sb.WriteString(fmt.Sprintf("Please confirm this before %s with the link below:\n\n", formatDate("en", deadline)))
+	sb.WriteString(link + "\n\n")
+	sb.WriteString("If you did not ask for this you can ignore this mail, you will not get any alarms.\n")
+	sb.WriteString(t.signatureBlock())
+	return sb.String()
+}
+
+// verified tells whether alarms can go to the channel, that is when it does not
+// send mail or its address has been confirmed.
+func (s Sensor) verified(c Channel) bool {
+	if c.Type != "email" {
+		return true
+	}
+	i := s.verification(channelTarget(s, c))
+	return i >= 0 && !s.Verifications[i].Confirmed.IsZero()
+}
+
+// confirmAddress records that the address confirmed it wants the alarms of the sensor.
+func (s *Sensor) confirmAddress(address string, now time.Time) error {
+	i := s.verification(address)
+	if i < 0 {
+		return errAddressChanged
+	}
+	if vr := &s.Verifications[i]; vr.Confirmed.IsZero() {
+		vr.Confirmed = now
+		vr.Expired = time.Time{}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestVerifierCheck(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	earlier := testDate.Add(-24 * time.Hour)
+	tests := []struct {
+		name      string
+		status    sensorStatus
+		want      []Verification
+		wantMails []string
+	}{
+		{
+			name:   "no address",
+			status: sensorStatus{sensor: Sensor{ID: "1"}},
+		},
+		{
+			name:      "asks a new sensor's address to confirm",
+			status:    sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com"}},
+			want:      []Verification{{Address: "owner@example.com", Sent: testDate}},
+			wantMails: []string{"owner@example.com"},
+		},
+		{
+			name:   "keeps the addresses of subscriptions created before opt-in",
+			status: sensorStatus{sensor: Sensor{ID: "1", Created: earlier, EmailAddress: "owner@example.com", Escalation: []Channel{{Type: "email", Target: "caretaker@example.com"}}}},
+			want:   []Verification{{Address: "owner@example.com", Confirmed: testDate}, {Address: "caretaker@example.com", Confirmed: testDate}},
+		},
+		{
+			name:      "asks the addresses of subscriptions created since",
+			status:    sensorStatus{sensor: Sensor{ID: "1", Created: testDate, EmailAddress: "owner@example.com"}},
+			want:      []Verification{{Address: "owner@example.com", Sent: testDate}},
+			wantMails: []string{"owner@example.com"},
+		},
+		{
+			name:      "asks an address added to a subscription created before opt-in",
+			status:    sensorStatus{sensor: Sensor{ID: "1", Created: earlier, OptIn: earlier, EmailAddress: "owner@example.com"}},
+			want:      []Verification{{Address: "owner@example.com", Sent: testDate}},
+			wantMails: []string{"owner@example.com"},
+		},
+		{
+			name: "asks a changed address to confirm",
+			status: sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "new@example.com", Verifications: []Verification{
+				{Address: "owner@example.com", Confirmed: earlier},
+			}}},
+			want:      []Verification{{Address: "new@example.com", Sent: testDate}},
+			wantMails: []string{"new@example.com"},
+		},
+		{
+			name: "asks every address the alarms can be mailed to",
+			status: sensorStatus{sensor: Sensor{
+				ID:            "1",
+				EmailAddress:  "owner@example.com",
+				Channels:      []Channel{{Type: "email"}, {Type: "email", Target: "friend@example.com"}, {Type: "email", Target: "gone@example.com", Disabled: true}},
+				Escalation:    []Channel{{Type: "email", Target: "caretaker@example.com"}},
+				Fallback:      []Channel{{Type: "email", Target: "backup@example.com"}, {Type: "pushover", Target: "user-key"}},
+				Verifications: []Verification{{Address: "owner@example.com", Confirmed: earlier}},
+			}},
+			want: []Verification{
+				{Address: "owner@example.com", Confirmed: earlier},
+				{Address: "friend@example.com", Sent: testDate},
+				{Address: "caretaker@example.com", Sent: testDate},
+				{Address: "backup@example.com", Sent: testDate},
+			},
+			wantMails: []string{"friend@example.com", "caretaker@example.com", "backup@example.com"},
+		},
+		{
+			name:      "sends the mail that failed again",
+			status:    sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com", Verifications: []Verification{{Address: "owner@example.com"}}}},
+			want:      []Verification{{Address: "owner@example.com", Sent: testDate}},
+			wantMails: []string{"owner@example.com"},
+		},
+		{
+			name:   "waits for the confirmation",
+			status: sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com", Verifications: []Verification{{Address: "owner@example.com", Sent: testDate.Add(-time.Hour)}}}},
+			want:   []Verification{{Address: "owner@example.com", Sent: testDate.Add(-time.Hour)}},
+		},
+		{
+			name:   "expires",
+			status: sensorStatus{sensor: Sensor{ID: "1", EmailAddress: "owner@example.com", Verifications: []Verification{{Address: "owner@example.com", Sent: earlier}}}},
+			want:   []Verification{{Address: "owner@example.com", Sent: earlier, Expired: testDate}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := mailerMock{}
+			v := verifier{tenants: &tenants{fallback: &tenant{mailer: &mailer}}, within: 24 * time.Hour, since: testDate.Add(-time.Hour), links: testLinks}
+			st := tt.status
+			v.check(context.Background(), &st, testDate)
+			if diff := deep.Equal(st.sensor.Verifications, tt.want); diff != nil {
+				t.Error(diff)
+			}
+			if st.sensor.OptIn.IsZero() {
+				t.Error("expected the start of the opt-in to be kept")
+			}
+			var mailed []string
+			for _, m := range mailer.sent {
+				if !strings.Contains(m.Text, "https://monitor.example.com/verify?t=") {
+					t.Errorf("expected a link in the mail to %s, got %s", m.To, m.Text)
+				}
+				mailed = append(mailed, m.To)
+			}
+			if diff := deep.Equal(mailed, tt.wantMails); diff != nil {
+				t.Errorf("mails failed: %v", diff)
+			}
+		})
+	}
+}
+
+func TestDoubleOptIn(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	email := notifierMock{}
+	email.On("Notify", "owner@example.com", mock.AnythingOfType("[]main.AlarmEvent")).Return(nil)
+	mailer := mailerMock{}
+	store := sensorStoreMock{sensors: make(map[string]Sensor)}
+	d := dispatcher{
+		notifiers: map[string]Notifier{"email": &email},
+		outbox:    newMemoryOutbox(),
+		sensors:   &store,
+		verify:    &verifier{tenants: &tenants{fallback: &tenant{mailer: &mailer}}, within: 24 * time.Hour, links: testLinks},
+	}
+	// another subscription to the sensor, waiting for the same address to confirm
+	other := Sensor{ID: "1", EmailAddress: "owner@example.com", Verifications: []Verification{{Address: "owner@example.com", Sent: testDate}}}
+	store.sensors["other"] = other
+	alarm := Alarm{Offline: testDate}
+	dispatch(&d, []sensorStatus{{sensor: Sensor{ID: "1", DocumentID: "sub1", EmailAddress: "owner@example.com", Alarms: alarm}}})
+
+	email.AssertNotCalled(t, "Notify", "owner@example.com", mock.Anything)
+	link := regexp.MustCompile(`https://monitor\.example\.com/verify\?t=\S+`).FindString(mailer.sent[0].Text)
+	u, err := url.Parse(link)
+	if err != nil || link == "" {
+		t.Fatalf("no link in the verification mail: %s", mailer.sent[0].Text)
+	}
+
+	a := apiServer{sensors: &store, links: testLinks}
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest("POST", u.RequestURI(), nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "from now on") {
+		t.Fatalf("expected the address to be confirmed, got %d: %s", rec.Code, rec.Body)
+	}
+	if diff := deep.Equal(store.sensors["other"], other); diff != nil {
+		t.Errorf("expected only the subscription of the link to be confirmed: %v", diff)
+	}
+
+	// the alarm that was held back goes out with the next check
+	s := store.sensors["sub1"]
+	dispatch(&d, []sensorStatus{{sensor: s, previous: s.Alarms}})
+	email.AssertNumberOfCalls(t, "Notify", 1)
+	if len(mailer.sent) != 1 {
+		t.Errorf("expected one verification mail, got %d", len(mailer.sent))
+	}
+}
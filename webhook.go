@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookVersion      = "1"
+	webhookSignature    = "X-Monitor-Signature"
+	cloudEventsAlarm    = "online.meetjescraper.monitor.alarm"
+	cloudEventsRecovery = "online.meetjescraper.monitor.recovery"
+	cloudEventsSource   = "https://monitoring.meetjescraper.online"
+)
+
+// webhookNotifier posts alarms as JSON to the URL in the channel's target.
+// With a secret on the channel the body is signed with HMAC-SHA256 in the
+// X-Monitor-Signature header as "sha256=<hex>". Failed posts are retried from the outbox.
+type webhookNotifier struct {
+	client *http.Client
+}
+
+// webhookPayload is version 1 of the JSON sent to webhooks. Its type is "recovery" when
+// all events are recoveries and "alarm" otherwise.
+type webhookPayload struct {
+	Version string         `json:"version"`
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	Events  []webhookEvent `json:"events"`
+}
+
+type webhookEvent struct {
+	ID       string           `json:"id"` // the same for retries of the same alarm
+	SensorID string           `json:"sensor_id"`
+	Severity string           `json:"severity"`
+	Recovery bool             `json:"recovery"` // the findings are solved
+	Findings []webhookFinding `json:"findings"`
+	Reading  Reading          `json:"reading"`
+}
+
+type webhookFinding struct {
+	Type     string    `json:"type"`
+	Since    time.Time `json:"since"`
+	Severity string    `json:"severity"`
+}
+
+// cloudEvent is a CloudEvents 1.0 event in structured JSON mode.
+type cloudEvent struct {
+	SpecVersion     string       `json:"specversion"`
+	Type            string       `json:"type"`
+	Source          string       `json:"source"`
+	Subject         string       `json:"subject"`
+	ID              string       `json:"id"`
+	Time            time.Time    `json:"time"`
+	DataContentType string       `json:"datacontenttype"`
+	Data            webhookEvent `json:"data"`
+}
+
+func newWebhookEvent(e AlarmEvent) webhookEvent {
+	if e.Key == "" {
+		e.Key = eventID(e)
+	}
+	we := webhookEvent{
+		ID:       e.Key,
+		SensorID: e.Sensor.ID,
+		Severity: e.Severity.String(),
+		Recovery: e.Recovery,
+		Reading:  e.Reading,
+	}
+	for _, f := range e.Findings {
+		we.Findings = append(we.Findings, webhookFinding{Type: f.Type, Since: f.Since, Severity: f.Severity.String()})
+	}
+	return we
+}
+
+// eventID identifies an alarm of a sensor so receivers can recognise repeated deliveries.
+func eventID(e AlarmEvent) string {
+	h := sha256.New()
+	io.WriteString(h, e.Sensor.ID)
+	for _, f := range e.Findings {
+		fmt.Fprintf(h, "|%s@%d", f.Type, f.Since.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, c Channel, events []AlarmEvent) error {
+	body, contentType, err := webhookBody(c, events, nowFunc())
+	if err != nil {
+		return err
+	}
+	return w.post(ctx, c, body, contentType)
+}
+
+func webhookBody(c Channel, events []AlarmEvent, now time.Time) ([]byte, string, error) {
+	if c.Format == "cloudevents" {
+		ces := make([]cloudEvent, len(events))
+		for i, e := range events {
+			we := newWebhookEvent(e)
+			typ := cloudEventsAlarm
+			if e.Recovery {
+				typ = cloudEventsRecovery
+			}
+			ces[i] = cloudEvent{
+				SpecVersion:     "1.0",
+				Type:            typ,
+				Source:          cloudEventsSource,
+				Subject:         e.Sensor.ID,
+				ID:              we.ID,
+				Time:            now,
+				DataContentType: "application/json",
+				Data:            we,
+			}
+		}
+		b, err := json.Marshal(ces)
+		return b, "application/cloudevents-batch+json", err
+	}
+
+	p := webhookPayload{Version: webhookVersion, Type: "recovery", Time: now}
+	for _, e := range events {
+		if !e.Recovery {
+			p.Type = "alarm"
+		}
+		p.Events = append(p.Events, newWebhookEvent(e))
+	}
+	b, err := json.Marshal(p)
+	return b, "application/json", err
+}
+
+// post sends the body once.
+func (w *webhookNotifier) post(ctx context.Context, c Channel, body []byte, contentType string) error {
+	req, err := http.NewRequest("POST", c.Target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "meetjestad-monitor")
+	if c.Secret != "" {
+		req.Header.Set(webhookSignature, "sha256="+sign(c.Secret, body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("webhook responded with %s", res.Status)
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	nowFunc = func() time.Time {
+		return testDate
+	}
+
+	events := []AlarmEvent{
+		newAlarmEvent(sensorStatus{
+			sensor:  Sensor{ID: "123", Alarms: Alarm{Offline: testDate, GpsMissing: testDate}},
+			reading: Reading{SensorID: "123", Date: testDate, Voltage: 3.3},
+		}),
+	}
+
+	tests := []struct {
+		name         string
+		channel      Channel
+		statuses     []int
+		wantErr      bool
+		wantAttempts int
+		wantType     string
+	}{
+		{
+			name:         "posts json",
+			channel:      Channel{Type: "webhook", Secret: "s3cret"},
+			statuses:     []int{204},
+			wantAttempts: 1,
+			wantType:     "application/json",
+		},
+		{
+			name:         "leaves retrying server errors to the outbox",
+			channel:      Channel{Type: "webhook"},
+			statuses:     []int{503},
+			wantErr:      true,
+			wantAttempts: 1,
+			wantType:     "application/json",
+		},
+		{
+			name:         "fails on client errors",
+			channel:      Channel{Type: "webhook"},
+			statuses:     []int{404},
+			wantErr:      true,
+			wantAttempts: 1,
+			wantType:     "application/json",
+		},
+		{
+			name:         "sends cloud events",
+			channel:      Channel{Type: "webhook", Format: "cloudevents", Secret: "s3cret"},
+			statuses:     []int{200},
+			wantAttempts: 1,
+			wantType:     "application/cloudevents-batch+json",
+		},
+	}
+
+	for _, tt := range tests {
+		var attempts int
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			if got := r.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("%s: unexpected content type %q", tt.name, got)
+			}
+			if tt.channel.Secret != "" {
+				if got := r.Header.Get(webhookSignature); got != "sha256="+sign(tt.channel.Secret, body) {
+					t.Errorf("%s: invalid signature %q", tt.name, got)
+				}
+			}
+			w.WriteHeader(tt.statuses[attempts])
+			attempts++
+		}))
+
+		n := webhookNotifier{client: srv.Client()}
+		c := tt.channel
+		c.Target = srv.URL
+		err := n.Notify(context.Background(), c, events)
+		srv.Close()
+
+		if err != nil && !tt.wantErr {
+			t.Errorf("%s failed: %v", tt.name, err)
+		}
+		if tt.wantErr && err == nil {
+			t.Errorf("%s expected error", tt.name)
+		}
+		if attempts != tt.wantAttempts {
+			t.Errorf("%s: %d attempts, want %d", tt.name, attempts, tt.wantAttempts)
+		}
+
+		if tt.channel.Format == "cloudevents" {
+			var ces []cloudEvent
+			if err := json.Unmarshal(body, &ces); err != nil {
+				t.Fatalf("%s: invalid body: %v", tt.name, err)
+			}
+			if len(ces) != 1 || ces[0].SpecVersion != "1.0" || ces[0].Subject != "123" || ces[0].Data.SensorID != "123" {
+				t.Errorf("%s: unexpected events %+v", tt.name, ces)
+			}
+			continue
+		}
+
+		var p webhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Fatalf("%s: invalid body: %v", tt.name, err)
+		}
+		if p.Version != webhookVersion || len(p.Events) != 1 {
+			t.Fatalf("%s: unexpected payload %+v", tt.name, p)
+		}
+		e := p.Events[0]
+		if e.SensorID != "123" || e.Severity != "critical" || len(e.Findings) != 2 || e.Findings[1].Type != AlarmGPS {
+			t.Errorf("%s: unexpected event %+v", tt.name, e)
+		}
+		if e.ID != eventID(events[0]) {
+			t.Errorf("%s: unexpected id %s", tt.name, e.ID)
+		}
+	}
+}
+
+func TestWebhookBodyRecovery(t *testing.T) {
+	st := sensorStatus{sensor: Sensor{ID: "123"}, reading: Reading{SensorID: "123", Date: testDate, Voltage: 3.3}}
+	alarm := newAlarmEvent(sensorStatus{sensor: Sensor{ID: "456", Alarms: Alarm{Offline: testDate}}})
+	recovery := newRecoveryEvent(st, Alarm{Offline: testDate})
+
+	tests := []struct {
+		name     string
+		events   []AlarmEvent
+		wantType string
+	}{
+		{name: "recoveries only", events: []AlarmEvent{recovery}, wantType: "recovery"},
+		{name: "alarms and recoveries", events: []AlarmEvent{alarm, recovery}, wantType: "alarm"},
+	}
+
+	for _, tt := range tests {
+		b, _, err := webhookBody(Channel{Type: "webhook"}, tt.events, testDate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(b, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Type != tt.wantType {
+			t.Errorf("%s: type %q, want %q", tt.name, p.Type, tt.wantType)
+		}
+		for i, e := range p.Events {
+			if e.Recovery != tt.events[i].Recovery {
+				t.Errorf("%s: event %d has recovery %v", tt.name, i, e.Recovery)
+			}
+		}
+	}
+
+	b, _, err := webhookBody(Channel{Type: "webhook", Format: "cloudevents"}, []AlarmEvent{alarm, recovery}, testDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ces []cloudEvent
+	if err := json.Unmarshal(b, &ces); err != nil {
+		t.Fatal(err)
+	}
+	if len(ces) != 2 || ces[0].Type != cloudEventsAlarm || ces[1].Type != cloudEventsRecovery || !ces[1].Data.Recovery {
+		t.Errorf("unexpected events %+v", ces)
+	}
+}